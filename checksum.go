@@ -0,0 +1,222 @@
+package umint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/mably/btcwire"
+	"io"
+)
+
+// block index flags as hashed into the stake modifier checksum
+const (
+	blockProofOfStake  uint32 = 1 << 0 // is proof-of-stake block
+	blockStakeEntropy  uint32 = 1 << 1 // entropy bit for stake modifier
+	blockStakeModifier uint32 = 1 << 2 // regenerated stake modifier
+)
+
+// ModifierCheckpoints maps block heights to stake modifier checksums.
+type ModifierCheckpoints map[int32]uint32
+
+var (
+	// MainNetModifierCheckpoints are the hard checkpoints of ppcoind.
+	MainNetModifierCheckpoints = ModifierCheckpoints{
+		0:     0x0e00670b,
+		19080: 0xad4e4d29,
+		30583: 0xdc7bf136,
+		99999: 0xf555cfd2,
+	}
+	TestNetModifierCheckpoints = ModifierCheckpoints{
+		0: 0xfd11f4e7,
+	}
+)
+
+// ModifierMismatchError is returned when a block's stake modifier differs
+// from the one computed from its predecessors.
+type ModifierMismatchError struct {
+	Height           int32
+	Have, Want       uint64
+	HaveGen, WantGen bool
+}
+
+func (e *ModifierMismatchError) Error() string {
+	return fmt.Sprintf("stake modifier mismatch at height %d: have %016x (generated %v) want %016x (generated %v)",
+		e.Height, e.Have, e.HaveGen, e.Want, e.WantGen)
+}
+
+// ChecksumMismatchError is returned when a stake modifier checksum
+// doesn't match a checkpoint.
+type ChecksumMismatchError struct {
+	Height     int32
+	Have, Want uint32
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("stake modifier checksum mismatch at height %d: have %08x want %08x",
+		e.Height, e.Have, e.Want)
+}
+
+func blockFlags(b BlockIndex) (flags uint32) {
+	if b.IsProofOfStake() {
+		flags |= blockProofOfStake
+	}
+	if b.StakeEntropyBit() != 0 {
+		flags |= blockStakeEntropy
+	}
+	if b.GeneratedStakeModifier() {
+		flags |= blockStakeModifier
+	}
+	return
+}
+
+// StakeModifierChecksum hashes the previous block's checksum with b's flags,
+// proof-of-stake hash and stake modifier. prevChecksum is not used for the
+// genesis block (height 0).
+func StakeModifierChecksum(b BlockIndex, prevChecksum uint32) uint32 {
+	buf := make([]byte, 0, 4+4+btcwire.HashSize+8)
+	if b.Height() > 0 {
+		buf = appendUint32(buf, prevChecksum)
+	}
+	buf = appendUint32(buf, blockFlags(b))
+	if b.IsProofOfStake() {
+		buf = append(buf, b.ProofOfStakeHash()[:]...)
+	} else {
+		buf = append(buf, make([]byte, btcwire.HashSize)...)
+	}
+	var modifier [8]byte
+	binary.LittleEndian.PutUint64(modifier[:], b.StakeModifier())
+	buf = append(buf, modifier[:]...)
+	hash := doubleSha256(buf)
+	// hashChecksum >>= (256 - 32)
+	return binary.LittleEndian.Uint32(hash[btcwire.HashSize-4:])
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// ModifierVerifier checks a sequence of blocks, fed in height order from
+// the genesis block, against recomputed stake modifiers and checkpoints.
+type ModifierVerifier struct {
+	Net         *Network
+	Checkpoints ModifierCheckpoints
+	// Checksum is the stake modifier checksum of the last added block.
+	Checksum uint32
+}
+
+// NewModifierVerifier creates verifier for the network's checkpoints.
+func NewModifierVerifier(net *Network) *ModifierVerifier {
+	return &ModifierVerifier{Net: net, Checkpoints: net.ModifierCheckpoints}
+}
+
+// Add verifies b, which must follow the previously added block.
+func (v *ModifierVerifier) Add(b BlockIndex) error {
+	modifier, generated, err := ComputeNextStakeModifier(v.Net, b.Prev(), b.Time())
+	if err != nil {
+		return fmt.Errorf("compute stake modifier at height %d: %v", b.Height(), err)
+	}
+	if modifier != b.StakeModifier() || generated != b.GeneratedStakeModifier() {
+		return &ModifierMismatchError{Height: b.Height(),
+			Have: b.StakeModifier(), HaveGen: b.GeneratedStakeModifier(),
+			Want: modifier, WantGen: generated}
+	}
+	v.Checksum = StakeModifierChecksum(b, v.Checksum)
+	if want, ok := v.Checkpoints[b.Height()]; ok && want != v.Checksum {
+		return &ChecksumMismatchError{Height: b.Height(), Have: v.Checksum, Want: want}
+	}
+	return nil
+}
+
+// blockIndexSize is the size of a block index file record: height, time,
+// hash, flags, proof-of-stake hash and stake modifier.
+const blockIndexSize = 4 + 8 + btcwire.HashSize + 4 + btcwire.HashSize + 8
+
+// WriteBlockIndex appends b's record to a block index file, the blocks of
+// which are written in height order from the genesis block.
+func WriteBlockIndex(w io.Writer, b BlockIndex) error {
+	buf := make([]byte, 0, blockIndexSize)
+	buf = appendUint32(buf, uint32(b.Height()))
+	var t [8]byte
+	binary.LittleEndian.PutUint64(t[:], uint64(b.Time()))
+	buf = append(buf, t[:]...)
+	buf = append(buf, b.Hash()[:]...)
+	buf = appendUint32(buf, blockFlags(b))
+	if b.IsProofOfStake() {
+		buf = append(buf, b.ProofOfStakeHash()[:]...)
+	} else {
+		buf = append(buf, make([]byte, btcwire.HashSize)...)
+	}
+	var modifier [8]byte
+	binary.LittleEndian.PutUint64(modifier[:], b.StakeModifier())
+	buf = append(buf, modifier[:]...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadBlockIndex reads the next record of a block index file and links it
+// after prev, nil for the genesis block. It returns io.EOF at the end of
+// the file.
+func ReadBlockIndex(r io.Reader, prev *BlockNode) (*BlockNode, error) {
+	var buf [blockIndexSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("truncated block index record")
+	} else if err != nil {
+		return nil, err
+	}
+	b := &BlockNode{
+		BlockHeight: int32(binary.LittleEndian.Uint32(buf[0:])),
+		BlockTime:   int64(binary.LittleEndian.Uint64(buf[4:])),
+		Modifier:    binary.LittleEndian.Uint64(buf[blockIndexSize-8:]),
+		PrevNode:    prev,
+	}
+	copy(b.BlockHash[:], buf[12:])
+	flags := binary.LittleEndian.Uint32(buf[12+btcwire.HashSize:])
+	b.ProofOfStake = flags&blockProofOfStake != 0
+	if flags&blockStakeEntropy != 0 {
+		b.EntropyBit = 1
+	}
+	b.GeneratedModifier = flags&blockStakeModifier != 0
+	copy(b.HashProofOfStake[:], buf[16+btcwire.HashSize:])
+	want := int32(0)
+	if prev != nil {
+		want = prev.BlockHeight + 1
+		prev.NextNode = b
+	}
+	if b.BlockHeight != want {
+		return nil, fmt.Errorf("block index record of height %d follows height %d", b.BlockHeight, want-1)
+	}
+	return b, nil
+}
+
+// VerifyStakeModifierFile walks the blocks of the block index file r and
+// returns the first stake modifier or checkpoint mismatch, along with the
+// height and checksum of the last verified block.
+func VerifyStakeModifierFile(net *Network, r io.Reader) (height int32, checksum uint32, err error) {
+	v := NewModifierVerifier(net)
+	height = -1
+	var tip *BlockNode
+	for {
+		if tip, err = ReadBlockIndex(r, tip); err == io.EOF {
+			return height, v.Checksum, nil
+		} else if err != nil {
+			return height, v.Checksum, fmt.Errorf("block index after height %d: %v", height, err)
+		}
+		if err = v.Add(tip); err != nil {
+			return height, v.Checksum, err
+		}
+		height = tip.BlockHeight
+	}
+}
+
+// VerifyStakeModifiers walks the chain from genesis and returns the first
+// stake modifier or checkpoint mismatch.
+func VerifyStakeModifiers(net *Network, genesis BlockIndex) (checksum uint32, err error) {
+	v := NewModifierVerifier(net)
+	for b := genesis; b != nil; b = b.Next() {
+		if err = v.Add(b); err != nil {
+			return v.Checksum, err
+		}
+	}
+	return v.Checksum, nil
+}
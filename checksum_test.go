@@ -0,0 +1,100 @@
+package umint_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/kac-/umint"
+	"testing"
+)
+
+func TestStakeModifierChecksumGenesis(t *testing.T) {
+	tests := []struct {
+		net        *umint.Network
+		entropyBit uint32
+	}{
+		{umint.MainNet, 1},
+		{umint.TestNet, 0},
+	}
+	for _, test := range tests {
+		genesis, err := (*umint.BlockNode)(nil).Append(test.net,
+			&umint.BlockNode{EntropyBit: test.entropyBit})
+		if err != nil {
+			t.Fatalf("append genesis: %v", err)
+		}
+		checksum, err := umint.VerifyStakeModifiers(test.net, genesis)
+		if err != nil {
+			t.Errorf("%v genesis: %v", test.net.Name, err)
+		}
+		if checksum != umint.StakeModifierChecksum(genesis, 0xffffffff) {
+			t.Errorf("%v genesis checksum depends on previous checksum", test.net.Name)
+		}
+	}
+}
+
+func TestVerifyStakeModifiers(t *testing.T) {
+	net := umint.TestNet
+	genesis, _ := buildChain(t, net, 1000, 60, func(h int) uint32 { return uint32(h>>1) & 1 })
+	if _, err := umint.VerifyStakeModifiers(net, genesis); err != nil {
+		t.Fatalf("verify good chain: %v", err)
+	}
+
+	b := genesis
+	for b.BlockHeight < 700 || !b.GeneratedModifier {
+		b = b.NextNode
+	}
+	b.Modifier ^= 1
+	_, err := umint.VerifyStakeModifiers(net, genesis)
+	var merr *umint.ModifierMismatchError
+	if !errors.As(err, &merr) || merr.Height != b.BlockHeight {
+		t.Errorf("wrong error for corrupted modifier at %v: %v", b.BlockHeight, err)
+	}
+	b.Modifier ^= 1
+
+	v := umint.NewModifierVerifier(net)
+	v.Checkpoints = umint.ModifierCheckpoints{500: 0xdeadbeef}
+	for b = genesis; b != nil; b = b.NextNode {
+		if err = v.Add(b); err != nil {
+			break
+		}
+	}
+	var cerr *umint.ChecksumMismatchError
+	if !errors.As(err, &cerr) || cerr.Height != 500 || cerr.Want != 0xdeadbeef {
+		t.Errorf("wrong error for checkpoint mismatch: %v", err)
+	}
+}
+
+func TestVerifyStakeModifierFile(t *testing.T) {
+	net := umint.TestNet
+	genesis, _ := buildChain(t, net, 1000, 60, func(h int) uint32 { return uint32(h>>1) & 1 })
+	write := func() []byte {
+		var buf bytes.Buffer
+		for b := genesis; b != nil; b = b.NextNode {
+			if err := umint.WriteBlockIndex(&buf, b); err != nil {
+				t.Fatalf("write block index: %v", err)
+			}
+		}
+		return buf.Bytes()
+	}
+	want, _ := umint.VerifyStakeModifiers(net, genesis)
+	file := write()
+	height, checksum, err := umint.VerifyStakeModifierFile(net, bytes.NewReader(file))
+	if err != nil || height != 999 || checksum != want {
+		t.Fatalf("verified up to %d checksum %08x, want %08x: %v", height, checksum, want, err)
+	}
+
+	b := genesis
+	for b.BlockHeight < 700 || !b.GeneratedModifier {
+		b = b.NextNode
+	}
+	b.Modifier ^= 1
+	_, _, err = umint.VerifyStakeModifierFile(net, bytes.NewReader(write()))
+	var merr *umint.ModifierMismatchError
+	if !errors.As(err, &merr) || merr.Height != b.BlockHeight {
+		t.Errorf("wrong error for corrupted modifier at %v: %v", b.BlockHeight, err)
+	}
+	b.Modifier ^= 1
+
+	if height, _, err := umint.VerifyStakeModifierFile(net, bytes.NewReader(file[:len(file)-1])); err == nil || height != 998 {
+		t.Errorf("truncated file verified up to %d: %v", height, err)
+	}
+}
@@ -0,0 +1,117 @@
+package umint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcwire"
+	"strconv"
+	"time"
+)
+
+// ErrKernelTarget is returned by NewCoinStake when the kernel input doesn't
+// meet the target at the requested time.
+var ErrKernelTarget = errors.New("coinstake kernel doesn't meet target")
+
+// Output returns the output with index of the source transaction, its
+// Outputs are keyed by decimal output index.
+func (s *CoinStakeSource) Output(index uint32) (*TxOut, bool) {
+	out, ok := s.Outputs[strconv.FormatUint(uint64(index), 10)]
+	return out, ok
+}
+
+// OutPoint returns the outpoint of the source transaction's output index.
+func (s *CoinStakeSource) OutPoint(index uint32) (*btcwire.OutPoint, error) {
+	sha, err := btcwire.NewShaHash(s.TxSha)
+	if err != nil {
+		return nil, fmt.Errorf("source tx sha: %w", err)
+	}
+	return btcwire.NewOutPoint(sha, index), nil
+}
+
+// StakeInput selects an output of a CoinStakeSource to spend in a coinstake.
+type StakeInput struct {
+	Source *CoinStakeSource
+	Index  uint32
+}
+
+// template returns the kernel template of the input at txTime.
+func (in *StakeInput) template(net *Network, out *TxOut, txTime int64, bits uint32) *StakeKernelTemplate {
+	return &StakeKernelTemplate{
+		BlockFromTime:  in.Source.BlockTime,
+		StakeModifier:  in.Source.StakeModifier,
+		PrevTxOffset:   in.Source.TxOffset,
+		PrevTxTime:     in.Source.TxTime,
+		PrevTxOutIndex: in.Index,
+		PrevTxOutValue: out.Value,
+		Protocol:       net.ProtocolAt(txTime),
+		StakeMinAge:    net.StakeMinAge,
+		Bits:           bits,
+		TxTime:         txTime,
+	}
+}
+
+// NewCoinStake builds an unsigned coinstake with time txTime spending kernel
+// and extra, which must pay to the kernel's script. As in ppcoind the first
+// output is empty and the second pays the inputs' value plus the stake reward
+// back to the kernel's script. The kernel is checked against bits, a kernel
+// missing the target gives ErrKernelTarget.
+func NewCoinStake(net *Network, kernel StakeInput, extra []StakeInput,
+	txTime int64, bits uint32) (*btcwire.MsgTx, error) {
+	kernelOut, ok := kernel.Source.Output(kernel.Index)
+	if !ok {
+		return nil, fmt.Errorf("kernel output %d not in source", kernel.Index)
+	}
+	_, success, err, _ := CheckStakeKernelHash(kernel.template(net, kernelOut, txTime, bits))
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, ErrKernelTarget
+	}
+
+	tx := btcwire.NewMsgTx()
+	tx.Time = time.Unix(txTime, 0)
+	spent := make(map[btcwire.OutPoint]bool)
+	var value int64
+	var coins []*utxo.UTXO
+	for i, in := range append([]StakeInput{kernel}, extra...) {
+		out, ok := in.Source.Output(in.Index)
+		if !ok {
+			return nil, fmt.Errorf("input %d: output %d not in source", i, in.Index)
+		}
+		if !bytes.Equal(out.PkScript, kernelOut.PkScript) {
+			return nil, fmt.Errorf("input %d: script differs from kernel's", i)
+		}
+		if in.Source.TxTime > txTime {
+			return nil, fmt.Errorf("input %d: tx time %d after coinstake time %d", i, in.Source.TxTime, txTime)
+		}
+		outPoint, err := in.Source.OutPoint(in.Index)
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+		if spent[*outPoint] {
+			return nil, fmt.Errorf("input %d: %v:%d spent twice", i, outPoint.Hash, outPoint.Index)
+		}
+		spent[*outPoint] = true
+		tx.AddTxIn(btcwire.NewTxIn(outPoint, nil))
+		value += out.Value
+		coins = append(coins, &utxo.UTXO{
+			BlockTime: uint32(in.Source.BlockTime),
+			Time:      uint32(in.Source.TxTime),
+			Value:     uint64(out.Value),
+		})
+	}
+	coinAge, err := CoinAge(coins, txTime, net.StakeMinAge)
+	if err != nil {
+		return nil, err
+	}
+	reward := StakeReward(coinAge, net.ProtocolAt(txTime))
+	if value+reward > maxMoney {
+		return nil, &ValueError{Value: value + reward}
+	}
+	tx.AddTxOut(btcwire.NewTxOut(0, nil))
+	tx.AddTxOut(btcwire.NewTxOut(value+reward, kernelOut.PkScript))
+	return tx, nil
+}
@@ -0,0 +1,68 @@
+package umint_test
+
+import (
+	"errors"
+	"github.com/kac-/umint"
+	"testing"
+)
+
+func coinStakeSource(sha byte, blockTime int64, values ...int64) *umint.CoinStakeSource {
+	s := &umint.CoinStakeSource{
+		BlockTime:     blockTime,
+		StakeModifier: 0x0123456789abcdef,
+		TxOffset:      81,
+		TxTime:        blockTime - 10,
+		TxSha:         make([]byte, 32),
+		Outputs:       make(map[string]*umint.TxOut),
+	}
+	s.TxSha[0] = sha
+	for i, v := range values {
+		s.Outputs[string(rune('0'+i))] = &umint.TxOut{Value: v, PkScript: []byte{0x76, 0xa9, sha, byte(i)}}
+	}
+	return s
+}
+
+func TestNewCoinStake(t *testing.T) {
+	net := umint.MainNet
+	blockTime := int64(1420000000)
+	txTime := blockTime + 100*24*60*60
+	kernel := coinStakeSource(1, blockTime, 1000*1000000)
+	extra := coinStakeSource(2, blockTime+10*24*60*60, 0, 500*1000000)
+	extra.Outputs["1"].PkScript = kernel.Outputs["0"].PkScript
+
+	tx, err := umint.NewCoinStake(net, umint.StakeInput{Source: kernel},
+		[]umint.StakeInput{{Source: extra, Index: 1}}, txTime, 0x2000ffff)
+	if err != nil {
+		t.Fatalf("new coinstake: %v", err)
+	}
+	if tx.Time.Unix() != txTime {
+		t.Errorf("wrong time %v", tx.Time.Unix())
+	}
+	if len(tx.TxIn) != 2 || tx.TxIn[0].PreviousOutPoint.Hash[0] != 1 ||
+		tx.TxIn[1].PreviousOutPoint.Hash[0] != 2 || tx.TxIn[1].PreviousOutPoint.Index != 1 {
+		t.Fatalf("wrong inputs %+v", tx.TxIn)
+	}
+	if len(tx.TxOut) != 2 || tx.TxOut[0].Value != 0 || len(tx.TxOut[0].PkScript) != 0 {
+		t.Fatalf("first output not empty %+v", tx.TxOut)
+	}
+	// 100*1000 + 90*500 coin-days, 1% per year
+	reward := umint.StakeReward(145000, umint.ProtocolV05)
+	if have, want := tx.TxOut[1].Value, int64(1500*1000000)+reward; have != want {
+		t.Errorf("wrong stake output value %v want %v", have, want)
+	}
+
+	if _, err := umint.NewCoinStake(net, umint.StakeInput{Source: kernel}, nil, txTime, 0x0300ffff); !errors.Is(err, umint.ErrKernelTarget) {
+		t.Errorf("kernel missing target: %v", err)
+	}
+	if _, err := umint.NewCoinStake(net, umint.StakeInput{Source: kernel}, nil, blockTime+10, 0x2000ffff); !errors.Is(err, umint.ErrMinAgeViolation) {
+		t.Errorf("immature kernel: %v", err)
+	}
+	if _, err := umint.NewCoinStake(net, umint.StakeInput{Source: kernel},
+		[]umint.StakeInput{{Source: extra, Index: 0}}, txTime, 0x2000ffff); err == nil {
+		t.Errorf("extra input with another script accepted")
+	}
+	if _, err := umint.NewCoinStake(net, umint.StakeInput{Source: kernel},
+		[]umint.StakeInput{{Source: kernel}}, txTime, 0x2000ffff); err == nil {
+		t.Errorf("kernel spent twice")
+	}
+}
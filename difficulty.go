@@ -0,0 +1,101 @@
+package umint
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// diffOneTarget is the target of difficulty 1 (compact 0x1d00ffff).
+var diffOneTarget = new(big.Int).Lsh(big.NewInt(0x0000ffff), 8*(29-3))
+
+// Difficulty is the exact ratio of the difficulty 1 target to a target.
+// Unlike CompactToDiff and DiffToTarget it converts between compact bits,
+// targets and difficulties without loss. The zero value is not a valid
+// difficulty, use ParseDifficulty or one of the From functions.
+type Difficulty struct {
+	rat big.Rat
+}
+
+// DiffFromTarget returns the difficulty of target, nil if target isn't
+// positive.
+func DiffFromTarget(target *big.Int) *Difficulty {
+	if target.Sign() <= 0 {
+		return nil
+	}
+	d := new(Difficulty)
+	d.rat.SetFrac(diffOneTarget, target)
+	return d
+}
+
+// DiffFromBits returns the difficulty of the target encoded in bits, nil if
+// the target isn't positive or the encoding is negative or overflows.
+func DiffFromBits(bits uint32) *Difficulty {
+	target, negative, overflow := DecodeCompact(bits)
+	if negative || overflow {
+		return nil
+	}
+	return DiffFromTarget(target)
+}
+
+// ParseDifficulty parses a positive decimal ("10.5") or fraction ("21/2").
+func ParseDifficulty(s string) (*Difficulty, error) {
+	d := new(Difficulty)
+	if err := d.Set(s); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Set parses s into d, it makes *Difficulty a flag.Value.
+func (d *Difficulty) Set(s string) error {
+	var r big.Rat
+	if _, ok := r.SetString(strings.TrimSpace(s)); !ok {
+		return fmt.Errorf("invalid difficulty %q", s)
+	}
+	if r.Sign() <= 0 {
+		return fmt.Errorf("difficulty must be positive: %q", s)
+	}
+	d.rat.Set(&r)
+	return nil
+}
+
+// Target returns the target of d, rounded down to a whole number.
+func (d *Difficulty) Target() *big.Int {
+	// target = diffOneTarget / d
+	t := new(big.Int).Mul(diffOneTarget, d.rat.Denom())
+	return t.Quo(t, d.rat.Num())
+}
+
+// Bits returns the compact representation of d's target.
+func (d *Difficulty) Bits() uint32 {
+	return BigToCompact(d.Target())
+}
+
+// Rat returns d as a rational number.
+func (d *Difficulty) Rat() *big.Rat {
+	return new(big.Rat).Set(&d.rat)
+}
+
+// Float64 returns the nearest float64 to d.
+func (d *Difficulty) Float64() float64 {
+	f, _ := d.rat.Float64()
+	return f
+}
+
+// Cmp compares d and e, see big.Rat.Cmp.
+func (d *Difficulty) Cmp(e *Difficulty) int {
+	return d.rat.Cmp(&e.rat)
+}
+
+// String formats d as a decimal number with up to 8 fractional digits.
+func (d *Difficulty) String() string {
+	if d == nil {
+		return "<nil>"
+	}
+	s := d.rat.FloatString(8)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
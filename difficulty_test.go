@@ -0,0 +1,60 @@
+package umint_test
+
+import (
+	"github.com/kac-/umint"
+	"math/big"
+	"testing"
+)
+
+func TestDifficultyBitsRoundTrip(t *testing.T) {
+	for _, bits := range []uint32{0x1d00ffff, 0x1c147e17, 0x1c0d3142, 0x1b0404cb, 0x1e0fffff, 0x1d7fffff, 0x1f00ffff} {
+		d := umint.DiffFromBits(bits)
+		if d == nil {
+			t.Errorf("no difficulty for %08x", bits)
+			continue
+		}
+		if d.Bits() != bits {
+			t.Errorf("round trip of %08x (%v), have %08x", bits, d, d.Bits())
+		}
+		if d.Target().Cmp(umint.CompactToBig(bits)) != 0 {
+			t.Errorf("wrong target of %08x", bits)
+		}
+		d2, err := umint.ParseDifficulty(d.Rat().RatString())
+		if err != nil || d2.Cmp(d) != 0 {
+			t.Errorf("parse %v: have %v (err %v)", d.Rat().RatString(), d2, err)
+		}
+	}
+	if d := umint.DiffFromBits(0x1d00ffff); d.String() != "1" {
+		t.Errorf("wrong difficulty 1 format %v", d)
+	}
+	if umint.DiffFromBits(0) != nil || umint.DiffFromBits(0x1d80ffff) != nil {
+		t.Errorf("difficulty of non-positive target")
+	}
+}
+
+func TestDifficultyExact(t *testing.T) {
+	d0, err := umint.ParseDifficulty("10")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	d1, err := umint.ParseDifficulty("10.0000001")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if d0.Target().Cmp(d1.Target()) <= 0 {
+		t.Errorf("nearby difficulties collapse: %v %v", d0.Target(), d1.Target())
+	}
+	// difficulty 10 target is exactly a tenth of the difficulty 1 target
+	want := new(big.Int).Div(umint.CompactToBig(0x1d00ffff), big.NewInt(10))
+	if d0.Target().Cmp(want) != 0 {
+		t.Errorf("wrong target of difficulty 10, have %v want %v", d0.Target(), want)
+	}
+	if d, err := umint.ParseDifficulty("21/2"); err != nil || d.String() != "10.5" {
+		t.Errorf("wrong fraction parse: %v (err %v)", d, err)
+	}
+	for _, s := range []string{"", "abc", "0", "-1"} {
+		if _, err := umint.ParseDifficulty(s); err == nil {
+			t.Errorf("invalid difficulty %q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package umint
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxMoney is the maximum amount of money in satoshis (peercoin's MAX_MONEY).
+const maxMoney int64 = 2000000000 * coin
+
+// Sentinel errors of CheckStakeKernelHash, the errors it returns carry the
+// offending values and match these with errors.Is.
+var (
+	ErrTimeViolation   = errors.New("CheckStakeKernelHash() : nTime violation")
+	ErrMinAgeViolation = errors.New("CheckStakeKernelHash() : min age violation")
+	ErrValueOverflow   = errors.New("CheckStakeKernelHash() : value out of range")
+	ErrInvalidBits     = errors.New("CheckStakeKernelHash() : invalid bits")
+)
+
+// TimeViolationError is returned when the kernel's time precedes the time
+// of the staked output's transaction.
+type TimeViolationError struct {
+	TxTime     int64
+	PrevTxTime int64
+}
+
+func (e *TimeViolationError) Error() string {
+	return fmt.Sprintf("%v: tx time %d before prev tx time %d",
+		ErrTimeViolation, e.TxTime, e.PrevTxTime)
+}
+
+func (e *TimeViolationError) Is(target error) bool {
+	return target == ErrTimeViolation
+}
+
+// MinAgeViolationError is returned when the staked output did not reach
+// stake min age at the kernel's time.
+type MinAgeViolationError struct {
+	TxTime    int64
+	MaturesAt int64
+}
+
+// Remaining returns the number of seconds until the output matures.
+func (e *MinAgeViolationError) Remaining() int64 {
+	return e.MaturesAt - e.TxTime
+}
+
+func (e *MinAgeViolationError) Error() string {
+	return fmt.Sprintf("%v: matures at %d, %d seconds after tx time",
+		ErrMinAgeViolation, e.MaturesAt, e.Remaining())
+}
+
+func (e *MinAgeViolationError) Is(target error) bool {
+	return target == ErrMinAgeViolation
+}
+
+// ValueError is returned when the staked value is negative or exceeds
+// the money supply limit.
+type ValueError struct {
+	Value int64
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("%v: %d", ErrValueOverflow, e.Value)
+}
+
+func (e *ValueError) Is(target error) bool {
+	return target == ErrValueOverflow
+}
+
+// BitsError is returned when the template's Bits don't encode a positive
+// 256-bit target.
+type BitsError struct {
+	Bits     uint32
+	Negative bool
+	Overflow bool
+}
+
+func (e *BitsError) Error() string {
+	switch {
+	case e.Negative:
+		return fmt.Sprintf("%v: %08x is negative", ErrInvalidBits, e.Bits)
+	case e.Overflow:
+		return fmt.Sprintf("%v: %08x overflows", ErrInvalidBits, e.Bits)
+	}
+	return fmt.Sprintf("%v: %08x is zero", ErrInvalidBits, e.Bits)
+}
+
+func (e *BitsError) Is(target error) bool {
+	return target == ErrInvalidBits
+}
+
+// checkTemplate validates the template's TxTime independent fields.
+func checkTemplate(t *StakeKernelTemplate) error {
+	if t.PrevTxOutValue < 0 || t.PrevTxOutValue > maxMoney {
+		return &ValueError{Value: t.PrevTxOutValue}
+	}
+	if target, negative, overflow := DecodeCompact(t.Bits); negative || overflow || target.Sign() == 0 {
+		return &BitsError{Bits: t.Bits, Negative: negative, Overflow: overflow}
+	}
+	return nil
+}
+
+// checkTxTime validates the template's TxTime against the output's time and
+// stake min age.
+func checkTxTime(t *StakeKernelTemplate) error {
+	if t.TxTime < t.PrevTxTime { // Transaction timestamp violation
+		return &TimeViolationError{TxTime: t.TxTime, PrevTxTime: t.PrevTxTime}
+	}
+	if t.BlockFromTime+t.StakeMinAge > t.TxTime { // Min age requirement
+		return &MinAgeViolationError{TxTime: t.TxTime, MaturesAt: t.BlockFromTime + t.StakeMinAge}
+	}
+	return nil
+}
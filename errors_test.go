@@ -0,0 +1,60 @@
+package umint_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kac-/umint"
+	"testing"
+)
+
+func TestKernelErrors(t *testing.T) {
+	base := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &base)
+	if err != nil {
+		t.Errorf("unmarshalling: %v", err)
+		return
+	}
+
+	tpl := base
+	tpl.TxTime = tpl.PrevTxTime - 1
+	_, _, err, _ = umint.CheckStakeKernelHash(&tpl)
+	var timeErr *umint.TimeViolationError
+	if !errors.Is(err, umint.ErrTimeViolation) || !errors.As(err, &timeErr) ||
+		timeErr.TxTime != tpl.TxTime || timeErr.PrevTxTime != tpl.PrevTxTime {
+		t.Errorf("wrong time violation error: %v", err)
+	}
+
+	tpl = base
+	tpl.TxTime = tpl.BlockFromTime + tpl.StakeMinAge - 3*24*60*60 - 4*60*60
+	_, _, err, _ = umint.CheckStakeKernelHash(&tpl)
+	var minAgeErr *umint.MinAgeViolationError
+	if !errors.Is(err, umint.ErrMinAgeViolation) || !errors.As(err, &minAgeErr) {
+		t.Errorf("wrong min age violation error: %v", err)
+	} else if minAgeErr.Remaining() != 3*24*60*60+4*60*60 {
+		t.Errorf("wrong remaining time, have %v want %v", minAgeErr.Remaining(), 3*24*60*60+4*60*60)
+	}
+	if errors.Is(err, umint.ErrTimeViolation) {
+		t.Errorf("min age violation matches time violation")
+	}
+
+	tpl = base
+	tpl.PrevTxOutValue = -1
+	_, _, err, _ = umint.CheckStakeKernelHash(&tpl)
+	var valueErr *umint.ValueError
+	if !errors.Is(err, umint.ErrValueOverflow) || !errors.As(err, &valueErr) || valueErr.Value != -1 {
+		t.Errorf("wrong value error: %v", err)
+	}
+
+	for _, bits := range []uint32{0, 0x1c800000, 0x1c847e17} {
+		tpl = base
+		tpl.Bits = bits
+		_, _, err, _ = umint.CheckStakeKernelHash(&tpl)
+		var bitsErr *umint.BitsError
+		if !errors.Is(err, umint.ErrInvalidBits) || !errors.As(err, &bitsErr) || bitsErr.Bits != bits {
+			t.Errorf("wrong bits error for %08x: %v", bits, err)
+		}
+		if _, err = umint.FindStakes(&tpl, tpl.TxTime, tpl.TxTime+10); !errors.Is(err, umint.ErrInvalidBits) {
+			t.Errorf("wrong FindStakes error for bits %08x: %v", bits, err)
+		}
+	}
+}
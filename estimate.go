@@ -0,0 +1,108 @@
+package umint
+
+import (
+	"math"
+)
+
+const (
+	// targetPerDiffOne is the difficulty 1 target per coin-day divided by
+	// 2^256, the chance that a coin-day weighted kernel hash meets it.
+	targetPerDiffOne = float64(0x0000ffff) / (1 << 48)
+	// estimateStep is the integration step (in seconds) of the estimator.
+	estimateStep int64 = 10 * 60
+)
+
+// ConstantDifficulty is a difficulty curve for StakeEstimator.
+func ConstantDifficulty(diff float64) func(int64) float64 {
+	return func(int64) float64 {
+		return diff
+	}
+}
+
+// StakeEstimator estimates the chances of an output to mint. It uses the
+// coin-day weight of CheckStakeKernelHash and assumes kernel hashes are
+// uniformly distributed.
+type StakeEstimator struct {
+	Value       int64
+	PrevTxTime  int64
+	StakeMinAge int64
+	StakeMaxAge int64
+	Protocol    Protocol
+	// Difficulty returns the proof-of-stake difficulty at a given time.
+	Difficulty func(t int64) float64
+}
+
+// StakeEstimate is an estimation made by StakeEstimator.
+type StakeEstimate struct {
+	// PerSecond is the probability of a kernel at the start time.
+	PerSecond float64
+	// ExpectedWait is the expected number of seconds until the output mints.
+	ExpectedWait float64
+	// Within is the probability of minting within the requested window.
+	Within float64
+}
+
+// PerSecond returns the probability that a kernel with time t meets
+// the target.
+func (e *StakeEstimator) PerSecond(t int64) float64 {
+	if t < e.PrevTxTime+e.StakeMinAge {
+		return 0
+	}
+	timeWeight := t - e.PrevTxTime
+	if timeWeight > e.StakeMaxAge {
+		timeWeight = e.StakeMaxAge
+	}
+	timeWeight -= e.Protocol.timeWeightReduction(e.StakeMinAge)
+	weight := coinDayWeight(e.Value, timeWeight)
+	if weight.Sign() <= 0 {
+		return 0
+	}
+	p := float64(weight.Int64()) * targetPerDiffOne / e.Difficulty(t)
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
+
+// Estimate estimates minting of the output starting at from, Within is the
+// probability of minting in the next window seconds. Beyond both the window
+// and the output's max age, the difficulty is assumed to stay constant.
+func (e *StakeEstimator) Estimate(from, window int64) (est StakeEstimate) {
+	est.PerSecond = e.PerSecond(from)
+	end := from + window
+	if capTime := e.PrevTxTime + e.StakeMaxAge; capTime > end {
+		end = capTime
+	}
+	var logSurvival float64
+	for t := from; t < end; {
+		dt := estimateStep
+		if t < from+window && t+dt > from+window {
+			dt = from + window - t
+		}
+		if t+dt > end {
+			dt = end - t
+		}
+		rate := e.PerSecond(t + dt/2)
+		survival := math.Exp(logSurvival)
+		if rate > 0 {
+			est.ExpectedWait += survival * -math.Expm1(-rate*float64(dt)) / rate
+		} else {
+			est.ExpectedWait += survival * float64(dt)
+		}
+		logSurvival -= rate * float64(dt)
+		t += dt
+		if t == from+window {
+			est.Within = -math.Expm1(logSurvival)
+		}
+	}
+	if window <= 0 {
+		est.Within = 0
+	}
+	// constant rate after the end
+	if rate := e.PerSecond(end); rate > 0 {
+		est.ExpectedWait += math.Exp(logSurvival) / rate
+	} else {
+		est.ExpectedWait = math.Inf(1)
+	}
+	return
+}
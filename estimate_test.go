@@ -0,0 +1,72 @@
+package umint_test
+
+import (
+	"encoding/json"
+	"github.com/kac-/umint"
+	"math"
+	"testing"
+)
+
+func estimatorFor(tpl *umint.StakeKernelTemplate, diff float64) *umint.StakeEstimator {
+	return &umint.StakeEstimator{
+		Value:       tpl.PrevTxOutValue,
+		PrevTxTime:  tpl.PrevTxTime,
+		StakeMinAge: tpl.StakeMinAge,
+		StakeMaxAge: tpl.Protocol.StakeMaxAge(),
+		Protocol:    tpl.Protocol,
+		Difficulty:  umint.ConstantDifficulty(diff),
+	}
+}
+
+func TestEstimateConstantRate(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	if err := json.Unmarshal([]byte(stpl0), &tpl); err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	e := estimatorFor(&tpl, 10)
+	// past max age the per second probability is constant
+	from := tpl.PrevTxTime + tpl.Protocol.StakeMaxAge() + 1000
+	window := int64(7 * 24 * 60 * 60)
+	est := e.Estimate(from, window)
+	if est.PerSecond <= 0 || est.PerSecond != e.PerSecond(from+window) {
+		t.Fatalf("wrong per second probability %v", est.PerSecond)
+	}
+	if w := 1 / est.PerSecond; math.Abs(est.ExpectedWait-w)/w > 1e-9 {
+		t.Errorf("wrong expected wait, have %v want %v", est.ExpectedWait, w)
+	}
+	if p := -math.Expm1(-est.PerSecond * float64(window)); math.Abs(est.Within-p)/p > 1e-9 {
+		t.Errorf("wrong within probability, have %v want %v", est.Within, p)
+	}
+
+	immature := e.Estimate(tpl.PrevTxTime, window)
+	if immature.PerSecond != 0 || immature.Within != 0 || immature.ExpectedWait < float64(tpl.StakeMinAge) {
+		t.Errorf("wrong estimate for immature output: %+v", immature)
+	}
+}
+
+// The estimated number of hits must match the number of kernels found.
+func TestEstimateMatchesSearch(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	if err := json.Unmarshal([]byte(stpl0), &tpl); err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	tpl.Bits = umint.BigToCompact(umint.DiffToTarget(0.0001))
+	diff := float64(umint.CompactToDiff(tpl.Bits))
+	e := estimatorFor(&tpl, diff)
+	from := tpl.PrevTxTime + tpl.StakeMinAge
+	to := from + 200000
+	hits, err := umint.FindStakes(&tpl, from, to)
+	if err != nil {
+		t.Fatalf("find stakes: %v", err)
+	}
+	var expected float64
+	for txTime := from; txTime <= to; txTime++ {
+		expected += e.PerSecond(txTime)
+	}
+	if expected < 50 {
+		t.Fatalf("too few expected hits for a meaningful test: %v", expected)
+	}
+	if sigma := math.Sqrt(expected); math.Abs(float64(len(hits))-expected) > 5*sigma {
+		t.Errorf("found %v hits, estimated %v", len(hits), expected)
+	}
+}
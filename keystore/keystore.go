@@ -0,0 +1,394 @@
+// Package keystore keeps minting keys in a passphrase encrypted file.
+//
+// Addresses are stored in clear so a locked store can list them (and scan
+// their coins with utxo.Store.FetchCoins), private keys are sealed with AES-GCM
+// under a key derived from the passphrase with scrypt, authenticating the
+// public key hash of their entry.
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mably/btcec"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// fileVersion 1 sealed keys without their hash, its stores are upgraded
+	// when unlocked
+	fileVersion = 2
+	keyLen      = 32
+	saltLen     = 16
+	scryptN     = 1 << 15
+	scryptR     = 8
+	scryptP     = 1
+)
+
+var (
+	ErrLocked          = errors.New("keystore is locked")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrNotFound        = errors.New("key not found")
+	ErrExists          = errors.New("key already imported")
+	ErrKeyMismatch     = errors.New("sealed key doesn't match its address")
+)
+
+// checkPlaintext is sealed into every store to verify passphrases.
+var checkPlaintext = []byte("umint keystore")
+
+type fileKey struct {
+	Address    string `json:"address"`
+	Hash       string `json:"hash"`
+	Compressed bool   `json:"compressed"`
+	Sealed     string `json:"sealed"`
+}
+
+type file struct {
+	Version int       `json:"version"`
+	Net     string    `json:"net"`
+	Salt    string    `json:"salt"`
+	N       int       `json:"n"`
+	R       int       `json:"r"`
+	P       int       `json:"p"`
+	Check   string    `json:"check"`
+	Keys    []fileKey `json:"keys"`
+}
+
+// Store is a keystore file, it's locked after Open. Store satisfies
+// umint.KeyStore.
+type Store struct {
+	path   string
+	params *btcnet.Params
+	file   file
+
+	mu   sync.Mutex
+	aead cipher.AEAD // nil when locked
+	keys map[string]*btcutil.WIF
+}
+
+// Create creates a new empty store at path encrypted with passphrase, the
+// store is returned unlocked.
+func Create(path string, params *btcnet.Params, passphrase []byte) (*Store, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("keystore %v already exists", path)
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		path:   path,
+		params: params,
+		file: file{
+			Version: fileVersion,
+			Net:     params.Name,
+			Salt:    hex.EncodeToString(salt),
+			N:       scryptN,
+			R:       scryptR,
+			P:       scryptP,
+		},
+		keys: make(map[string]*btcutil.WIF),
+	}
+	aead, err := s.file.deriveAEAD(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	check, err := seal(aead, checkPlaintext, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.file.Check = check
+	s.aead = aead
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open reads the store at path, it must be for params' network.
+func Open(path string, params *btcnet.Params) (*Store, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keystore: %w", err)
+	}
+	s := &Store{path: path, params: params}
+	if err := json.Unmarshal(buf, &s.file); err != nil {
+		return nil, fmt.Errorf("parse keystore(%v): %w", path, err)
+	}
+	if s.file.Version < 1 || s.file.Version > fileVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", s.file.Version)
+	}
+	if s.file.Net != params.Name {
+		return nil, fmt.Errorf("keystore for %v, not %v", s.file.Net, params.Name)
+	}
+	return s, nil
+}
+
+func (f *file) deriveAEAD(passphrase []byte) (cipher.AEAD, error) {
+	salt, err := hex.DecodeString(f.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("keystore salt: %w", err)
+	}
+	key, err := scrypt.Key(passphrase, salt, f.N, f.R, f.P, keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext authenticating additionalData, the public key hash
+// of a key's entry.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+func open(aead cipher.AEAD, sealed string, additionalData []byte) ([]byte, error) {
+	buf, err := hex.DecodeString(sealed)
+	if err != nil || len(buf) < aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// Unlock decrypts the store's keys with passphrase, each must hash to the
+// public key hash of its entry. A store of an older version is saved
+// upgraded.
+func (s *Store) Unlock(passphrase []byte) error {
+	aead, err := s.file.deriveAEAD(passphrase)
+	if err != nil {
+		return err
+	}
+	if check, err := open(aead, s.file.Check, nil); err != nil || !bytes.Equal(check, checkPlaintext) {
+		return ErrWrongPassphrase
+	}
+	keys := make(map[string]*btcutil.WIF, len(s.file.Keys))
+	for _, k := range s.file.Keys {
+		hash, err := hex.DecodeString(k.Hash)
+		if err != nil {
+			return fmt.Errorf("key %v: %w", k.Address, err)
+		}
+		additionalData := hash
+		if s.file.Version < 2 {
+			additionalData = nil
+		}
+		privKey, err := open(aead, k.Sealed, additionalData)
+		if err != nil {
+			// the passphrase opened the check, the key was sealed for another entry
+			return fmt.Errorf("key %v: %w", k.Address, ErrKeyMismatch)
+		}
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), privKey)
+		wif, err := btcutil.NewWIF(priv, s.params, k.Compressed)
+		if err != nil {
+			return fmt.Errorf("key %v: %w", k.Address, err)
+		}
+		if !bytes.Equal(btcutil.Hash160(wif.SerializePubKey()), hash) {
+			return fmt.Errorf("key %v: %w", k.Address, ErrKeyMismatch)
+		}
+		keys[k.Hash] = wif
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file.Version < fileVersion {
+		f, err := reseal(s.file, aead, keys)
+		if err != nil {
+			return fmt.Errorf("upgrade keystore: %w", err)
+		}
+		if err := s.saveFile(f); err != nil {
+			return fmt.Errorf("upgrade keystore: %w", err)
+		}
+	}
+	s.aead, s.keys = aead, keys
+	return nil
+}
+
+// ChangePassphrase seals the keys of the unlocked store under passphrase,
+// with a new salt, and saves it.
+func (s *Store) ChangePassphrase(passphrase []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aead == nil {
+		return ErrLocked
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	f := s.file
+	f.Salt, f.N, f.R, f.P = hex.EncodeToString(salt), scryptN, scryptR, scryptP
+	aead, err := f.deriveAEAD(passphrase)
+	if err != nil {
+		return err
+	}
+	if f, err = reseal(f, aead, s.keys); err != nil {
+		return err
+	}
+	if err := s.saveFile(f); err != nil {
+		return err
+	}
+	s.aead = aead
+	return nil
+}
+
+// reseal returns f of the current version with the decrypted keys sealed
+// under aead, derived from f.
+func reseal(f file, aead cipher.AEAD, keys map[string]*btcutil.WIF) (file, error) {
+	entries := f.Keys
+	f.Version = fileVersion
+	var err error
+	if f.Check, err = seal(aead, checkPlaintext, nil); err != nil {
+		return f, err
+	}
+	f.Keys = make([]fileKey, len(entries))
+	for i, k := range entries {
+		hash, err := hex.DecodeString(k.Hash)
+		if err != nil {
+			return f, fmt.Errorf("key %v: %w", k.Address, err)
+		}
+		if k.Sealed, err = seal(aead, keys[k.Hash].PrivKey.Serialize(), hash); err != nil {
+			return f, err
+		}
+		f.Keys[i] = k
+	}
+	return f, nil
+}
+
+// Lock forgets the decrypted keys.
+func (s *Store) Lock() {
+	s.mu.Lock()
+	s.aead, s.keys = nil, nil
+	s.mu.Unlock()
+}
+
+// Locked tells if the store is locked.
+func (s *Store) Locked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aead == nil
+}
+
+// Addresses returns the addresses of the stored keys, locked or not.
+func (s *Store) Addresses() ([]*btcutil.AddressPubKeyHash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]*btcutil.AddressPubKeyHash, len(s.file.Keys))
+	for i, k := range s.file.Keys {
+		hash, err := hex.DecodeString(k.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %w", k.Address, err)
+		}
+		if addrs[i], err = btcutil.NewAddressPubKeyHash(hash, s.params); err != nil {
+			return nil, fmt.Errorf("key %v: %w", k.Address, err)
+		}
+	}
+	return addrs, nil
+}
+
+// Import adds key to the unlocked store and saves it, it returns the key's
+// address.
+func (s *Store) Import(key *btcutil.WIF) (*btcutil.AddressPubKeyHash, error) {
+	if !key.IsForNet(s.params) {
+		return nil, fmt.Errorf("key isn't for %v", s.params.Name)
+	}
+	hash := btcutil.Hash160(key.SerializePubKey())
+	addr, err := btcutil.NewAddressPubKeyHash(hash, s.params)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aead == nil {
+		return nil, ErrLocked
+	}
+	hashHex := hex.EncodeToString(hash)
+	if _, ok := s.keys[hashHex]; ok {
+		return nil, ErrExists
+	}
+	sealed, err := seal(s.aead, key.PrivKey.Serialize(), hash)
+	if err != nil {
+		return nil, err
+	}
+	s.file.Keys = append(s.file.Keys, fileKey{
+		Address:    addr.EncodeAddress(),
+		Hash:       hashHex,
+		Compressed: key.CompressPubKey,
+		Sealed:     sealed,
+	})
+	if err := s.save(); err != nil {
+		s.file.Keys = s.file.Keys[:len(s.file.Keys)-1]
+		return nil, err
+	}
+	s.keys[hashHex] = key
+	return addr, nil
+}
+
+// Export returns the key of addr from the unlocked store.
+func (s *Store) Export(addr *btcutil.AddressPubKeyHash) (*btcutil.WIF, error) {
+	return s.KeyForHash(addr.ScriptAddress())
+}
+
+// KeyForHash returns the key whose public key hashes to pubKeyHash.
+func (s *Store) KeyForHash(pubKeyHash []byte) (*btcutil.WIF, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aead == nil {
+		return nil, ErrLocked
+	}
+	key, ok := s.keys[hex.EncodeToString(pubKeyHash)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return key, nil
+}
+
+// save writes the store next to its path and renames it into place.
+func (s *Store) save() error {
+	return s.saveFile(s.file)
+}
+
+// saveFile saves f as the store's file.
+func (s *Store) saveFile(f file) error {
+	buf, err := json.MarshalIndent(&f, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("save keystore: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save keystore: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save keystore: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("save keystore: %w", err)
+	}
+	s.file = f
+	return nil
+}
@@ -0,0 +1,194 @@
+package keystore_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/kac-/umint/keystore"
+	"github.com/mably/btcec"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T, compress bool) *btcutil.WIF {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	key, err := btcutil.NewWIF(priv, &btcnet.MainNetParams, compress)
+	if err != nil {
+		t.Fatalf("new wif: %v", err)
+	}
+	return key
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	params := &btcnet.MainNetParams
+	s, err := keystore.Create(path, params, []byte("secret"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := keystore.Create(path, params, []byte("secret")); err == nil {
+		t.Errorf("existing store overwritten")
+	}
+	keys := []*btcutil.WIF{newKey(t, true), newKey(t, false)}
+	for _, key := range keys {
+		if _, err := s.Import(key); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+	}
+	if _, err := s.Import(keys[0]); !errors.Is(err, keystore.ErrExists) {
+		t.Errorf("duplicate import: %v", err)
+	}
+	s.Lock()
+	if _, err := s.KeyForHash(btcutil.Hash160(keys[0].SerializePubKey())); !errors.Is(err, keystore.ErrLocked) {
+		t.Errorf("key of locked store: %v", err)
+	}
+	if _, err := s.Import(newKey(t, true)); !errors.Is(err, keystore.ErrLocked) {
+		t.Errorf("import into locked store: %v", err)
+	}
+
+	if _, err := keystore.Open(path, &btcnet.TestNet3Params); err == nil {
+		t.Errorf("opened for another network")
+	}
+	s, err = keystore.Open(path, params)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !s.Locked() {
+		t.Errorf("opened unlocked")
+	}
+	addrs, err := s.Addresses()
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("addresses of locked store: %v %v", addrs, err)
+	}
+	if err := s.Unlock([]byte("wrong")); !errors.Is(err, keystore.ErrWrongPassphrase) {
+		t.Errorf("unlock with wrong passphrase: %v", err)
+	}
+	if err := s.Unlock([]byte("secret")); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	for i, key := range keys {
+		if !bytes.Equal(addrs[i].ScriptAddress(), btcutil.Hash160(key.SerializePubKey())) {
+			t.Errorf("wrong address %d", i)
+		}
+		exported, err := s.Export(addrs[i])
+		if err != nil {
+			t.Fatalf("export %d: %v", i, err)
+		}
+		if !bytes.Equal(exported.PrivKey.Serialize(), key.PrivKey.Serialize()) ||
+			exported.CompressPubKey != key.CompressPubKey {
+			t.Errorf("exported key %d differs", i)
+		}
+	}
+	if _, err := s.KeyForHash(make([]byte, 20)); !errors.Is(err, keystore.ErrNotFound) {
+		t.Errorf("unknown key: %v", err)
+	}
+}
+
+func TestStoreBinding(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	params := &btcnet.MainNetParams
+	s, err := keystore.Create(path, params, []byte("secret"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	keys := []*btcutil.WIF{newKey(t, true), newKey(t, true)}
+	for _, key := range keys {
+		if _, err := s.Import(key); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+	}
+	if err := s.ChangePassphrase([]byte("new secret")); err != nil {
+		t.Fatalf("change passphrase: %v", err)
+	}
+	s, err = keystore.Open(path, params)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := s.Unlock([]byte("secret")); !errors.Is(err, keystore.ErrWrongPassphrase) {
+		t.Errorf("unlock with the old passphrase: %v", err)
+	}
+	if err := s.Unlock([]byte("new secret")); err != nil {
+		t.Fatalf("unlock with the new passphrase: %v", err)
+	}
+
+	// a key moved to another entry doesn't unlock
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var f map[string]interface{}
+	if err := json.Unmarshal(buf, &f); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	entries := f["keys"].([]interface{})
+	first, second := entries[0].(map[string]interface{}), entries[1].(map[string]interface{})
+	first["sealed"], second["sealed"] = second["sealed"], first["sealed"]
+	if buf, err = json.Marshal(f); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s, err = keystore.Open(path, params)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := s.Unlock([]byte("new secret")); !errors.Is(err, keystore.ErrKeyMismatch) {
+		t.Errorf("unlock of swapped keys: %v", err)
+	}
+}
+
+func TestStoreUpgrade(t *testing.T) {
+	// a version 1 store sealed its key without additional data
+	key := newKey(t, true)
+	salt := make([]byte, 16)
+	derived, err := scrypt.Key([]byte("secret"), salt, 1<<10, 8, 1, 32)
+	if err != nil {
+		t.Fatalf("derive: %v", err)
+	}
+	block, _ := aes.NewCipher(derived)
+	aead, _ := cipher.NewGCM(block)
+	seal := func(plaintext []byte) string {
+		nonce := make([]byte, aead.NonceSize())
+		return hex.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil))
+	}
+	hash := btcutil.Hash160(key.SerializePubKey())
+	addr, _ := btcutil.NewAddressPubKeyHash(hash, &btcnet.MainNetParams)
+	buf, _ := json.Marshal(map[string]interface{}{
+		"version": 1, "net": btcnet.MainNetParams.Name, "salt": hex.EncodeToString(salt),
+		"n": 1 << 10, "r": 8, "p": 1, "check": seal([]byte("umint keystore")),
+		"keys": []interface{}{map[string]interface{}{
+			"address": addr.EncodeAddress(), "hash": hex.EncodeToString(hash), "compressed": true,
+			"sealed": seal(key.PrivKey.Serialize()),
+		}},
+	})
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		s, err := keystore.Open(path, &btcnet.MainNetParams)
+		if err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+		if err := s.Unlock([]byte("secret")); err != nil {
+			t.Fatalf("unlock %d: %v", i, err)
+		}
+		if exported, err := s.Export(addr); err != nil || !bytes.Equal(exported.PrivKey.Serialize(), key.PrivKey.Serialize()) {
+			t.Errorf("export %d: %v", i, err)
+		}
+	}
+	if buf, _ := ioutil.ReadFile(path); !bytes.Contains(buf, []byte(`"version": 2`)) {
+		t.Errorf("store not upgraded: %s", buf)
+	}
+}
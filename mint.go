@@ -24,9 +24,12 @@ type CoinStakeSource struct {
 // an unsigned 32-bit number.  The compact representation only provides 23 bits
 // of precision, so values larger than (2^23 - 1) only encode the most
 // significant digits of the number.  See CompactToBig for details.
+//
+// A nil n encodes as zero, numbers too large for the 8 bit exponent saturate
+// to 0xff7fffff which DecodeCompact reports as overflow.
 func BigToCompact(n *big.Int) uint32 {
 	// No need to do any work if it's zero.
-	if n.Sign() == 0 {
+	if n == nil || n.Sign() == 0 {
 		return 0
 	}
 
@@ -34,15 +37,14 @@ func BigToCompact(n *big.Int) uint32 {
 	// as the number of bytes.  So, shift the number right or left
 	// accordingly.  This is equivalent to:
 	// mantissa = mantissa / 256^(exponent-3)
+	b := n.Bytes() // absolute value, big-endian
+	exponent := uint(len(b))
 	var mantissa uint32
-	exponent := uint(len(n.Bytes()))
-	if exponent <= 3 {
-		mantissa = uint32(n.Bits()[0])
-		mantissa <<= 8 * (3 - exponent)
-	} else {
-		// Use a copy to avoid modifying the caller's original number.
-		tn := new(big.Int).Set(n)
-		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	for i := uint(0); i < 3; i++ {
+		mantissa <<= 8
+		if i < exponent {
+			mantissa |= uint32(b[i])
+		}
 	}
 
 	// When the mantissa already has the sign bit set, the number is too
@@ -52,11 +54,14 @@ func BigToCompact(n *big.Int) uint32 {
 		mantissa >>= 8
 		exponent++
 	}
+	if exponent > 0xff {
+		return 0xff7fffff
+	}
 
 	// Pack the exponent, sign bit, and mantissa into an unsigned 32-bit
 	// int and return it.
 	compact := uint32(exponent<<24) | mantissa
-	if n.Sign() < 0 {
+	if n.Sign() < 0 && mantissa != 0 {
 		compact |= 0x00800000
 	}
 	return compact
@@ -74,6 +79,19 @@ func CompactToDiff(bits uint32) (diff float32) {
 	return
 }
 
+// compactToDiff64 is CompactToDiff in double precision.
+func compactToDiff64(bits uint32) (diff float64) {
+	nShift := (bits >> 24) & 0xff
+	diff = float64(0x0000ffff) / float64(bits&0x00ffffff)
+	for ; nShift < 29; nShift++ {
+		diff *= 256.0
+	}
+	for ; nShift > 29; nShift-- {
+		diff /= 256.0
+	}
+	return
+}
+
 func IncCompact(compact uint32) uint32 {
 	mantissa := compact & 0x007fffff
 	neg := compact & 0x00800000
@@ -106,3 +124,53 @@ func DiffToTarget(diff float32) (target *big.Int) {
 	target = new(big.Int).Lsh(big.NewInt(int64(mantissa)), uint(26-exp)*8)
 	return
 }
+
+// oneLsh256 is 2^256.
+var oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// BlockTrust returns the trust a block with target bits adds to its chain.
+// A proof-of-stake block is worth 2^256/(target+1), the expected number of
+// hashes to meet its target, while proof-of-work blocks count 1 so that chain
+// selection is driven by stake. Invalid bits carry no trust. protocol is the
+// protocol of the block: no protocol up to v0.5 changes the rule, so it's
+// unused.
+func BlockTrust(bits uint32, isProofOfStake bool, protocol Protocol) *big.Int {
+	target, negative, overflow := DecodeCompact(bits)
+	if negative || overflow || target.Sign() == 0 {
+		return new(big.Int)
+	}
+	if !isProofOfStake {
+		return big.NewInt(1)
+	}
+	return target.Quo(oneLsh256, target.Add(target, big.NewInt(1)))
+}
+
+// ChainTrust accumulates the trust of a sequence of blocks, the zero value
+// is an empty chain.
+type ChainTrust struct {
+	total  big.Int
+	blocks int
+}
+
+// Add adds the trust of the next block, see BlockTrust, and returns it.
+func (c *ChainTrust) Add(bits uint32, isProofOfStake bool, protocol Protocol) *big.Int {
+	trust := BlockTrust(bits, isProofOfStake, protocol)
+	c.total.Add(&c.total, trust)
+	c.blocks++
+	return trust
+}
+
+// Total returns the trust accumulated so far.
+func (c *ChainTrust) Total() *big.Int {
+	return new(big.Int).Set(&c.total)
+}
+
+// Blocks returns the number of blocks added.
+func (c *ChainTrust) Blocks() int {
+	return c.blocks
+}
+
+// Cmp compares the accumulated trust of c and d, see big.Int.Cmp.
+func (c *ChainTrust) Cmp(d *ChainTrust) int {
+	return c.total.Cmp(&d.total)
+}
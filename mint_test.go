@@ -114,3 +114,109 @@ func OffTestPrintDiffToTarget(t *testing.T) {
 	}
 
 }
+
+func TestDecodeCompact(t *testing.T) {
+	tests := []struct {
+		compact  uint32
+		value    string
+		negative bool
+		overflow bool
+		encoded  uint32
+	}{
+		{0x00000000, "0", false, false, 0},
+		{0x00123456, "0", false, false, 0},
+		{0x01003456, "0", false, false, 0},
+		{0x02000056, "0", false, false, 0},
+		{0x03000000, "0", false, false, 0},
+		{0x04000000, "0", false, false, 0},
+		{0x00923456, "0", false, false, 0},
+		{0x01803456, "0", false, false, 0},
+		{0x02800056, "0", false, false, 0},
+		{0x03800000, "0", false, false, 0},
+		{0x04800000, "0", false, false, 0},
+		{0x01123456, "12", false, false, 0x01120000},
+		{0x01fedcba, "7e", true, false, 0x01fe0000},
+		{0x02123456, "1234", false, false, 0x02123400},
+		{0x03123456, "123456", false, false, 0x03123456},
+		{0x04123456, "12345600", false, false, 0x04123456},
+		{0x04923456, "12345600", true, false, 0x04923456},
+		{0x05009234, "92340000", false, false, 0x05009234},
+		{0x20123456, "1234560000000000000000000000000000000000000000000000000000000000", false, false, 0x20123456},
+		{0xff123456, "", false, true, 0},
+		{0x23000001, "", false, true, 0},
+		{0x22000100, "", false, true, 0},
+		{0x21010000, "", false, true, 0},
+		{0x22000001, "100000000000000000000000000000000000000000000000000000000000000", false, false, 0x20010000},
+	}
+	for _, test := range tests {
+		n, negative, overflow := umint.DecodeCompact(test.compact)
+		if negative != test.negative || overflow != test.overflow {
+			t.Errorf("%08x: wrong flags, have %v %v want %v %v",
+				test.compact, negative, overflow, test.negative, test.overflow)
+			continue
+		}
+		if overflow {
+			if n.BitLen() > 256 {
+				t.Errorf("%08x: overflowing value not truncated", test.compact)
+			}
+			continue
+		}
+		if n.Text(16) != test.value {
+			t.Errorf("%08x: wrong value, have %v want %v", test.compact, n.Text(16), test.value)
+			continue
+		}
+		if negative {
+			n.Neg(n)
+		}
+		if c := umint.BigToCompact(n); c != test.encoded {
+			t.Errorf("%08x: wrong encoding, have %08x want %08x", test.compact, c, test.encoded)
+		}
+	}
+}
+
+func TestBigToCompactNoPanic(t *testing.T) {
+	inputs := []*big.Int{
+		nil,
+		big.NewInt(-1),
+		big.NewInt(-0x800000),
+		new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 255)),
+		new(big.Int).Lsh(big.NewInt(1), 8*300),
+	}
+	for _, n := range inputs {
+		c := umint.BigToCompact(n)
+		if n != nil && n.BitLen() > 8*255 {
+			if _, _, overflow := umint.DecodeCompact(c); !overflow {
+				t.Errorf("huge number encoded without overflow: %08x", c)
+			}
+		}
+	}
+}
+
+func TestBlockTrust(t *testing.T) {
+	if trust := umint.BlockTrust(0x1d00ffff, true, umint.ProtocolV05); trust.Cmp(big.NewInt(0x100010001)) != 0 {
+		t.Errorf("difficulty 1 stake trust: have %x", trust)
+	}
+	if trust := umint.BlockTrust(0x1c00ffff, false, umint.ProtocolV05); trust.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("work trust: have %v", trust)
+	}
+	for _, bits := range []uint32{0, 0x1d80ffff, 0xff7fffff} {
+		if trust := umint.BlockTrust(bits, true, umint.ProtocolV05); trust.Sign() != 0 {
+			t.Errorf("trust of invalid bits %08x: %v", bits, trust)
+		}
+	}
+
+	var a, b umint.ChainTrust
+	a.Add(0x1d00ffff, true, umint.ProtocolV05)
+	a.Add(0x1c00ffff, false, umint.ProtocolV05)
+	b.Add(0x1c00ffff, true, umint.ProtocolV05)
+	if a.Blocks() != 2 || b.Blocks() != 1 {
+		t.Errorf("wrong block counts %v %v", a.Blocks(), b.Blocks())
+	}
+	if a.Total().Cmp(big.NewInt(0x100010002)) != 0 {
+		t.Errorf("wrong total %x", a.Total())
+	}
+	// a single harder stake block outweighs more blocks
+	if a.Cmp(&b) >= 0 {
+		t.Errorf("chain %x not below %x", a.Total(), b.Total())
+	}
+}
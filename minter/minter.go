@@ -0,0 +1,386 @@
+// Package minter is the minting loop of umintd: it follows a node's best
+// block, schedules the kernels of its candidate outputs ahead of time,
+// rechecks them at their seconds and submits the signed blocks it finds.
+package minter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcwire"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CoinSource returns the candidate outputs, as utxo.Store.FetchCoins does.
+type CoinSource func() ([]*btcwire.OutPoint, []*utxo.UTXO, error)
+
+// Config configures a Minter.
+type Config struct {
+	Net    *umint.Network
+	Policy umint.StakePolicy
+	Keys   umint.KeyStore
+	Coins  CoinSource
+	Node   Node
+	// BlockVersion is the version of minted blocks.
+	BlockVersion int32
+	// StatePath is the file the minter's state persists to, AttemptLog
+	// the file attempts are appended to. Empty paths disable them.
+	StatePath  string
+	AttemptLog string
+	// RefreshInterval is the time between candidate refreshes.
+	RefreshInterval time.Duration
+	// MaxCatchUp limits the past seconds checked after a pause.
+	MaxCatchUp int64
+	// ScheduleHorizon is the number of seconds kernels are scheduled ahead.
+	ScheduleHorizon int64
+	// PollInterval is the longest Run sleeps between two steps.
+	PollInterval time.Duration
+}
+
+// State is the part of the minter surviving restarts.
+type State struct {
+	// LastChecked is the last kernel time checked.
+	LastChecked int64 `json:"lastChecked"`
+	// Spent are the outpoints ("hash:index") spent by submitted blocks.
+	Spent map[string]int64 `json:"spent"`
+	// Attempts and Submitted count blocks built and accepted by the node.
+	Attempts  int `json:"attempts"`
+	Submitted int `json:"submitted"`
+}
+
+// Attempt is a minting attempt as logged to Config.AttemptLog.
+type Attempt struct {
+	Time     int64  `json:"time"`
+	OutPoint string `json:"outPoint"`
+	TxTime   int64  `json:"txTime"`
+	Height   int64  `json:"height"`
+	Block    string `json:"block,omitempty"`
+	Reward   int64  `json:"reward"`
+	Outcome  string `json:"outcome"`
+}
+
+// Minter mints blocks staking the candidate outputs.
+type Minter struct {
+	cfg   Config
+	state State
+
+	tip         *Tip
+	outPoints   []*btcwire.OutPoint
+	utxos       []*utxo.UTXO
+	index       map[string]int
+	refreshedAt time.Time
+	schedule    *Schedule
+
+	// OnAttempt, if set, is called with every attempt.
+	OnAttempt func(*Attempt)
+	// OnError, if set, is called with the errors of the steps of Run.
+	OnError func(error)
+}
+
+func outPointKey(o *btcwire.OutPoint) string {
+	return fmt.Sprintf("%v:%d", o.Hash, o.Index)
+}
+
+// New returns a minter loading its state from cfg.StatePath if it exists.
+func New(cfg Config) (*Minter, error) {
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = 10 * time.Minute
+	}
+	if cfg.MaxCatchUp == 0 {
+		cfg.MaxCatchUp = 60
+	}
+	if cfg.ScheduleHorizon == 0 {
+		cfg.ScheduleHorizon = 6 * 60 * 60
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Minute
+	}
+	m := &Minter{
+		cfg:      cfg,
+		state:    State{Spent: make(map[string]int64)},
+		schedule: NewSchedule(cfg.Net, cfg.ScheduleHorizon),
+	}
+	if cfg.StatePath != "" {
+		buf, err := ioutil.ReadFile(cfg.StatePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("read state: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(buf, &m.state); err != nil {
+				return nil, fmt.Errorf("parse state(%v): %w", cfg.StatePath, err)
+			}
+			if m.state.Spent == nil {
+				m.state.Spent = make(map[string]int64)
+			}
+		}
+	}
+	return m, nil
+}
+
+// State returns a copy of the minter's state.
+func (m *Minter) State() State {
+	s := m.state
+	s.Spent = make(map[string]int64, len(m.state.Spent))
+	for k, v := range m.state.Spent {
+		s.Spent[k] = v
+	}
+	return s
+}
+
+// Run steps until ctx is done, then saves the state. Between steps it sleeps
+// until the next scheduled kernel, at least a second and at most
+// PollInterval.
+func (m *Minter) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return m.saveState()
+		case now := <-timer.C:
+			if err := m.Step(ctx, now); err != nil && m.OnError != nil {
+				m.OnError(err)
+			}
+			wait := m.cfg.PollInterval
+			if e := m.schedule.Next(); e != nil {
+				if d := time.Until(time.Unix(e.Time, 0)); d < wait {
+					wait = d
+				}
+			}
+			// entries left in the past, by a failed step or a tip ahead of
+			// the clock, mustn't spin the loop
+			if wait < time.Second {
+				wait = time.Second
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// refresh fetches the node's tip and, when due, the candidates.
+func (m *Minter) refresh(now time.Time) error {
+	tip, err := m.cfg.Node.Tip()
+	if err != nil {
+		return fmt.Errorf("tip: %w", err)
+	}
+	m.tip = tip
+	if m.utxos != nil && now.Sub(m.refreshedAt) < m.cfg.RefreshInterval {
+		return nil
+	}
+	outPoints, utxos, err := m.cfg.Coins()
+	if err != nil {
+		return fmt.Errorf("coins: %w", err)
+	}
+	m.outPoints, m.utxos = nil, nil
+	m.index = make(map[string]int)
+	for i, o := range outPoints {
+		key := outPointKey(o)
+		if _, spent := m.state.Spent[key]; !spent {
+			m.index[key] = len(m.outPoints)
+			m.outPoints = append(m.outPoints, o)
+			m.utxos = append(m.utxos, utxos[i])
+		}
+	}
+	if m.utxos == nil {
+		m.utxos = []*utxo.UTXO{}
+	}
+	m.refreshedAt = now
+	return nil
+}
+
+// window returns the seconds to check at now, from after the last checked
+// one and the tip.
+func (m *Minter) window(now time.Time) (from, to int64) {
+	to = now.Unix()
+	from = m.state.LastChecked + 1
+	if from < to-m.cfg.MaxCatchUp {
+		from = to - m.cfg.MaxCatchUp
+	}
+	if from <= m.tip.Time {
+		from = m.tip.Time + 1
+	}
+	return from, to
+}
+
+// Schedule refreshes the candidates and the schedule at now, and returns
+// the scheduled kernels.
+func (m *Minter) Schedule(ctx context.Context, now time.Time) ([]Entry, error) {
+	if err := m.refresh(now); err != nil {
+		return nil, err
+	}
+	from, _ := m.window(now)
+	if _, err := m.schedule.Refresh(ctx, m.outPoints, m.utxos, m.tip.StakeBits, m.tip.Index, from); err != nil {
+		return nil, fmt.Errorf("schedule: %w", err)
+	}
+	return m.schedule.Entries(), nil
+}
+
+// ScheduleWindow returns the seconds scheduled and the difficulty they were
+// searched at, see Schedule.Window.
+func (m *Minter) ScheduleWindow() (from, to int64, diff *umint.Difficulty) {
+	return m.schedule.Window()
+}
+
+// Step rechecks the kernels scheduled in the seconds since the last step up
+// to now against the tip's target and submits a block for the first hit,
+// trying the following hits while minting fails.
+func (m *Minter) Step(ctx context.Context, now time.Time) error {
+	if err := m.refresh(now); err != nil {
+		return err
+	}
+	from, to := m.window(now)
+	if from > to {
+		return nil
+	}
+	if _, err := m.schedule.Refresh(ctx, m.outPoints, m.utxos, m.tip.StakeBits, m.tip.Index, from); err != nil {
+		return fmt.Errorf("schedule: %w", err)
+	}
+	var checkErr error
+	for e := m.schedule.Next(); e != nil && e.Time <= to; e = m.schedule.Next() {
+		m.schedule.Pop()
+		i, ok := m.index[outPointKey(e.OutPoint)]
+		if !ok || e.Time < from {
+			continue
+		}
+		windows, err := m.cfg.Net.KernelWindows(m.tip.Index, e.Time, e.Time)
+		if err != nil {
+			checkErr = fmt.Errorf("check %v: %w", outPointKey(e.OutPoint), err)
+			continue
+		}
+		tpl := windows[0].Template(kernelTemplate(m.cfg.Net, e.OutPoint, m.utxos[i], m.tip.StakeBits))
+		hits, err := umint.FindStakes(&tpl, e.Time, e.Time)
+		if err != nil {
+			checkErr = fmt.Errorf("check %v: %w", outPointKey(e.OutPoint), err)
+			continue
+		}
+		if len(hits) > 0 && m.mint(i, &windows[0], now) {
+			break
+		}
+	}
+	m.state.LastChecked = to
+	if err := m.saveState(); err != nil {
+		return err
+	}
+	return checkErr
+}
+
+// mint builds, signs and submits the block staking candidate i at the first
+// second of w, it tells if the node accepted it.
+func (m *Minter) mint(i int, w *umint.KernelWindow, now time.Time) bool {
+	txTime := w.From
+	a := &Attempt{
+		Time:     now.Unix(),
+		OutPoint: outPointKey(m.outPoints[i]),
+		TxTime:   txTime,
+		Height:   m.tip.Height + 1,
+	}
+	defer m.logAttempt(a)
+	m.state.Attempts++
+	block, plan, err := m.build(i, w)
+	if err != nil {
+		a.Outcome = "build: " + err.Error()
+		return false
+	}
+	a.Reward = plan.Reward
+	sha, _ := block.BlockSha()
+	a.Block = sha.String()
+	var buf bytes.Buffer
+	if err := block.Serialize(&buf); err != nil {
+		a.Outcome = "serialize: " + err.Error()
+		return false
+	}
+	if err := m.cfg.Node.SubmitBlock(buf.Bytes()); err != nil {
+		a.Outcome = "rejected: " + err.Error()
+		return false
+	}
+	a.Outcome = "submitted"
+	m.state.Submitted++
+	for _, in := range block.Transactions[1].TxIn {
+		m.state.Spent[outPointKey(&in.PreviousOutPoint)] = txTime
+	}
+	m.utxos = nil // refresh candidates
+	return true
+}
+
+func (m *Minter) build(i int, w *umint.KernelWindow) (*btcwire.MsgBlock, *umint.StakePlan, error) {
+	utxos := m.utxos
+	if w.Protocol >= umint.ProtocolV05 {
+		// the kernel hashes the stake modifier selected for the window
+		kernel := *utxos[i]
+		kernel.StakeModifier = w.Modifier
+		utxos = append([]*utxo.UTXO(nil), utxos...)
+		utxos[i] = &kernel
+	}
+	plan, err := m.cfg.Policy.Plan(m.cfg.Net, m.outPoints, utxos, i, w.From)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := plan.NewCoinStake(m.cfg.Net, m.tip.StakeBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := umint.SignCoinStake(tx, plan.PrevScripts(), m.cfg.Keys); err != nil {
+		return nil, nil, err
+	}
+	block, err := umint.NewStakeBlock(&umint.StakeBlockTemplate{
+		Version:   m.cfg.BlockVersion,
+		PrevBlock: m.tip.Hash,
+		Bits:      m.tip.StakeBits,
+	}, tx, m.cfg.Keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, plan, nil
+}
+
+func (m *Minter) logAttempt(a *Attempt) {
+	if m.OnAttempt != nil {
+		m.OnAttempt(a)
+	}
+	if m.cfg.AttemptLog == "" {
+		return
+	}
+	line, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(m.cfg.AttemptLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// saveState writes the state next to its path and renames it into place.
+func (m *Minter) saveState() error {
+	if m.cfg.StatePath == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(&m.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.cfg.StatePath), filepath.Base(m.cfg.StatePath)+".tmp")
+	if err != nil {
+		return fmt.Errorf("save state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.cfg.StatePath); err != nil {
+		return fmt.Errorf("save state: %w", err)
+	}
+	return nil
+}
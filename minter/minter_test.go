@@ -0,0 +1,425 @@
+package minter_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/minter"
+	"github.com/kac-/umint/rpc"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcec"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type keyStore map[string]*btcutil.WIF
+
+func (s keyStore) KeyForHash(pubKeyHash []byte) (*btcutil.WIF, error) {
+	if key, ok := s[string(pubKeyHash)]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key for %x", pubKeyHash)
+}
+
+type stubNode struct {
+	tip       minter.Tip
+	submitted [][]byte
+	reject    error
+}
+
+func (n *stubNode) Tip() (*minter.Tip, error) {
+	tip := n.tip
+	return &tip, nil
+}
+
+func (n *stubNode) SubmitBlock(block []byte) error {
+	if n.reject != nil {
+		return n.reject
+	}
+	n.submitted = append(n.submitted, block)
+	return nil
+}
+
+// testIndex returns a block index of a tip at tipTime selecting modifier for
+// the v0.5 kernels of the next day.
+func testIndex(tipTime int64, modifier uint64) umint.BlockIndex {
+	generated := &umint.BlockNode{BlockHeight: 1, BlockTime: tipTime - 40*24*60*60, GeneratedModifier: true, Modifier: modifier}
+	tip := &umint.BlockNode{BlockHeight: 2, BlockTime: tipTime, PrevNode: generated}
+	generated.NextNode = tip
+	return tip
+}
+
+func newTestConfig(t *testing.T, node minter.Node) minter.Config {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	key, _ := btcutil.NewWIF(priv, &btcnet.MainNetParams, true)
+	hash := btcutil.Hash160(key.SerializePubKey())
+	script := append(append([]byte{0x76, 0xa9, 20}, hash...), 0x88, 0xac)
+	now := time.Now().Unix()
+	coins := func() ([]*btcwire.OutPoint, []*utxo.UTXO, error) {
+		var outPoints []*btcwire.OutPoint
+		var utxos []*utxo.UTXO
+		for i := byte(1); i <= 2; i++ {
+			outPoints = append(outPoints, btcwire.NewOutPoint(&btcwire.ShaHash{i}, 0))
+			utxos = append(utxos, &utxo.UTXO{
+				BlockTime:     uint32(now - 100*24*60*60),
+				StakeModifier: 1,
+				OffsetInBlock: 81,
+				Time:          uint32(now - 100*24*60*60 - 10),
+				Value:         1000e6,
+				PkScript:      script,
+			})
+		}
+		return outPoints, utxos, nil
+	}
+	dir := t.TempDir()
+	return minter.Config{
+		Net:          umint.MainNet,
+		Keys:         keyStore{string(hash): key},
+		Coins:        coins,
+		Node:         node,
+		BlockVersion: 1,
+		StatePath:    filepath.Join(dir, "state.json"),
+		AttemptLog:   filepath.Join(dir, "attempts.log"),
+	}
+}
+
+func TestMinterStep(t *testing.T) {
+	now := time.Now()
+	node := &stubNode{tip: minter.Tip{Hash: btcwire.ShaHash{9}, Height: 100, Time: now.Unix() - 30, StakeBits: 0x2000ffff,
+		Index: testIndex(now.Unix()-30, 7)}}
+	cfg := newTestConfig(t, node)
+	m, err := minter.New(cfg)
+	if err != nil {
+		t.Fatalf("new minter: %v", err)
+	}
+	var attempts []*minter.Attempt
+	m.OnAttempt = func(a *minter.Attempt) { attempts = append(attempts, a) }
+	if err := m.Step(context.Background(), now); err != nil {
+		t.Fatalf("step: %v", err)
+	}
+	if len(node.submitted) != 1 || len(attempts) != 1 || attempts[0].Outcome != "submitted" {
+		t.Fatalf("no block submitted: %+v", attempts)
+	}
+	if attempts[0].TxTime != node.tip.Time+1 || attempts[0].Height != 101 || attempts[0].Reward == 0 {
+		t.Errorf("wrong attempt %+v", attempts[0])
+	}
+	state := m.State()
+	if state.LastChecked != now.Unix() || state.Submitted != 1 || len(state.Spent) != 1 {
+		t.Errorf("wrong state %+v", state)
+	}
+
+	// the spent output isn't staked again, the other one is
+	if err := m.Step(context.Background(), now.Add(time.Second)); err != nil {
+		t.Fatalf("step: %v", err)
+	}
+	if len(attempts) != 2 || attempts[1].OutPoint == attempts[0].OutPoint {
+		t.Fatalf("wrong second attempt %+v", attempts)
+	}
+	node.reject = errors.New("bad-blk")
+	if err := m.Step(context.Background(), now.Add(2*time.Second)); err != nil {
+		t.Fatalf("step: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Errorf("all outputs spent, still attempted %+v", attempts[2:])
+	}
+
+	// restart from the persisted state
+	m, err = minter.New(cfg)
+	if err != nil {
+		t.Fatalf("reload minter: %v", err)
+	}
+	if state := m.State(); state.LastChecked != now.Unix()+2 || state.Submitted != 2 || len(state.Spent) != 2 {
+		t.Errorf("wrong reloaded state %+v", state)
+	}
+	f, err := os.Open(cfg.AttemptLog)
+	if err != nil {
+		t.Fatalf("open attempt log: %v", err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		var a minter.Attempt
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil || a.Outcome != "submitted" {
+			t.Errorf("wrong logged attempt %q: %v", scanner.Text(), err)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("%d attempts logged", lines)
+	}
+}
+
+func TestMinterRejected(t *testing.T) {
+	now := time.Now()
+	node := &stubNode{
+		tip: minter.Tip{Height: 100, Time: now.Unix() - 30, StakeBits: 0x2000ffff,
+			Index: testIndex(now.Unix()-30, 7)},
+		reject: errors.New("bad-blk"),
+	}
+	m, err := minter.New(newTestConfig(t, node))
+	if err != nil {
+		t.Fatalf("new minter: %v", err)
+	}
+	var attempts []*minter.Attempt
+	m.OnAttempt = func(a *minter.Attempt) { attempts = append(attempts, a) }
+	if err := m.Step(context.Background(), now); err != nil {
+		t.Fatalf("step: %v", err)
+	}
+	// every hit of the window is tried, of both outputs
+	outPoints := make(map[string]bool)
+	for _, a := range attempts {
+		if a.Outcome != "rejected: bad-blk" {
+			t.Fatalf("wrong attempt %+v", a)
+		}
+		outPoints[a.OutPoint] = true
+	}
+	if len(outPoints) != 2 {
+		t.Errorf("attempts staked %v", outPoints)
+	}
+	if state := m.State(); len(state.Spent) != 0 || state.Attempts != len(attempts) || state.Submitted != 0 {
+		t.Errorf("rejected block changed state %+v", state)
+	}
+}
+
+func TestRPCNodeTip(t *testing.T) {
+	block := func(height int64, hash, prev string, time int64, stake bool) rpc.Recording {
+		flags := "proof-of-work"
+		if stake {
+			flags = "proof-of-stake"
+		}
+		if prev == "" {
+			flags += " stake-modifier"
+		}
+		result, _ := json.Marshal(&rpc.Block{Hash: hash, Height: height, Time: time, Bits: "1c00ffff",
+			PreviousBlockHash: prev, Flags: flags, Modifier: fmt.Sprintf("%x", height)})
+		params, _ := json.Marshal([]string{hash})
+		return rpc.Recording{Method: "getblock", Params: params, Result: result}
+	}
+	h := func(i int) string { return fmt.Sprintf("%064x", i) }
+	s := rpc.NewMockServer([]rpc.Recording{
+		{Method: "getblockcount", Result: json.RawMessage("5")},
+		{Method: "getblockhash", Result: json.RawMessage(`"` + h(5) + `"`)},
+		block(5, h(5), h(4), 1400003000, false),
+		block(4, h(4), h(3), 1400002400, true),
+		block(3, h(3), h(2), 1400001800, false),
+		block(2, h(2), h(1), 1400000600, true),
+		block(1, h(1), "", 1400000000, false),
+	})
+	defer s.Close()
+	node := minter.NewRPCNode(s.Client(), umint.MainNet)
+	tip, err := node.Tip()
+	if err != nil {
+		t.Fatalf("tip: %v", err)
+	}
+	// stake blocks 1200 seconds apart ease the target
+	want := umint.Retarget(0x1c00ffff, 1800, umint.StakeTargetSpacing, umint.MainNet.PowLimit)
+	if tip.Height != 5 || tip.Time != 1400003000 || tip.StakeBits != want {
+		t.Errorf("wrong tip %+v, want bits %08x", tip, want)
+	}
+	// the index reaches down to the genesis block
+	var heights []int32
+	for b := tip.Index; b != nil; b = b.Prev() {
+		heights = append(heights, b.Height())
+	}
+	if len(heights) != 5 || heights[0] != 5 || heights[4] != 1 {
+		t.Errorf("wrong block index %v", heights)
+	}
+	calls := len(s.Calls())
+	if _, err := node.Tip(); err != nil || len(s.Calls()) != calls+2 {
+		t.Errorf("unchanged tip refetched: %v", err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	outPoints, utxos, _ := cfg.Coins()
+	now := time.Now().Unix()
+	// the horizon straddles a protocol switch
+	net := *umint.MainNet
+	net.ProtocolV05SwitchTime = now + 30*60
+	s := minter.NewSchedule(&net, 60*60)
+	index := testIndex(now, 7)
+	const bits = 0x1e0fffff
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Refresh(ctx, outPoints, utxos, bits, index, now); err == nil || s.Next() != nil {
+		t.Fatalf("cancelled refresh scheduled %v: %v", s.Entries(), err)
+	}
+	if _, err := s.Refresh(context.Background(), outPoints, utxos, bits, nil, now); !errors.Is(err, umint.ErrNoBlockIndex) {
+		t.Fatalf("v0.5 refreshed without a block index: %v", err)
+	}
+	if ok, err := s.Refresh(context.Background(), outPoints, utxos, bits, index, now); !ok || err != nil {
+		t.Fatalf("refresh: %v %v", ok, err)
+	}
+	entries := s.Entries()
+	if len(entries) == 0 {
+		t.Fatalf("nothing scheduled")
+	}
+	for i, e := range entries {
+		if e.Time < now || e.Time > now+60*60 || (i > 0 && e.Time < entries[i-1].Time) {
+			t.Errorf("entry %d out of order %+v", i, e)
+		}
+		tpl := umint.StakeKernelTemplate{
+			BlockFromTime:  int64(utxos[0].BlockTime),
+			StakeModifier:  utxos[0].StakeModifier,
+			PrevTxOffset:   utxos[0].OffsetInBlock,
+			PrevTxTime:     int64(utxos[0].Time),
+			PrevTxOutIndex: e.OutPoint.Index,
+			PrevTxOutValue: int64(utxos[0].Value),
+			Protocol:       net.ProtocolAt(e.Time),
+			StakeMinAge:    umint.MainNet.StakeMinAge,
+			Bits:           e.MaxBits,
+			TxTime:         e.Time,
+		}
+		if tpl.Protocol >= umint.ProtocolV05 {
+			tpl.StakeModifier = 7
+		}
+		if res, err := umint.CheckStakeKernel(&tpl); err != nil || !res.Success {
+			t.Errorf("entry %d misses its max bits: %v", i, err)
+		}
+	}
+
+	// a harder target is covered, an easier one or other outputs aren't
+	if ok, _ := s.Refresh(context.Background(), outPoints, utxos, 0x1e07ffff, index, now+10); ok {
+		t.Errorf("refreshed for a harder target")
+	}
+	if ok, _ := s.Refresh(context.Background(), outPoints, utxos, 0x1e1fffff, index, now+10); !ok {
+		t.Errorf("not refreshed for an easier target")
+	}
+	if ok, _ := s.Refresh(context.Background(), outPoints[:1], utxos[:1], 0x1e1fffff, index, now+10); !ok {
+		t.Errorf("not refreshed for other outputs")
+	}
+	if ok, _ := s.Refresh(context.Background(), outPoints[:1], utxos[:1], 0x1e1fffff, index, now+40*60); !ok {
+		t.Errorf("not refreshed past half the horizon")
+	}
+
+	last := int64(0)
+	for n := len(s.Entries()); n > 0; n-- {
+		e := s.Pop()
+		if e.Time < last || *e.OutPoint != *outPoints[0] {
+			t.Errorf("wrong entry popped %+v", e)
+		}
+		last = e.Time
+	}
+	if s.Next() != nil || s.Pop() != nil {
+		t.Errorf("schedule not empty")
+	}
+}
+
+func TestDBSync(t *testing.T) {
+	pay := func(b byte) []byte {
+		return append(append([]byte{0x76, 0xa9, 20}, bytes.Repeat([]byte{b}, 20)...), 0x88, 0xac)
+	}
+	newBlock := func(prev *btcwire.MsgBlock, blockTime int64, txs ...*btcwire.MsgTx) *btcwire.MsgBlock {
+		var prevHash btcwire.ShaHash
+		if prev != nil {
+			prevHash, _ = prev.BlockSha()
+		}
+		block := btcwire.NewMsgBlock(btcwire.NewBlockHeader(&prevHash, &btcwire.ShaHash{}, 0x1d00ffff, 0))
+		block.Header.Timestamp = time.Unix(blockTime, 0)
+		for _, tx := range txs {
+			block.AddTransaction(tx)
+		}
+		return block
+	}
+	coinbase := func(blockTime int64, hashes ...byte) *btcwire.MsgTx {
+		tx := btcwire.NewMsgTx()
+		tx.Time = time.Unix(blockTime, 0)
+		tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{}, 0xffffffff), []byte{byte(blockTime)}))
+		for _, h := range hashes {
+			tx.AddTxOut(btcwire.NewTxOut(50e6, pay(h)))
+		}
+		return tx
+	}
+	// the db has blocks 0, 1 and 2a, the node 0, 1, 2b and 3 generating the
+	// stake modifier of block 0's outputs
+	net := umint.TestNet
+	t0 := int64(1400000000)
+	tx0 := coinbase(t0, 0xa, 0xb)
+	b0 := newBlock(nil, t0, tx0)
+	b1 := newBlock(b0, t0+60, coinbase(t0+60, 0xc))
+	b2a := newBlock(b1, t0+120, coinbase(t0+120, 0xd))
+	b2b := newBlock(b1, t0+121, coinbase(t0+121, 0xe))
+	sha0, _ := tx0.TxSha()
+	spend := btcwire.NewMsgTx()
+	spend.Time = time.Unix(t0+200, 0)
+	spend.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&sha0, 1), nil))
+	spend.AddTxOut(btcwire.NewTxOut(49e6, pay(0xf)))
+	t3 := t0 + umint.StakeModifierSelectionInterval(net) + 1
+	b3 := newBlock(b2b, t3, coinbase(t3, 0xf), spend)
+
+	db := utxo.NewMemStore()
+	for h, b := range []*btcwire.MsgBlock{b0, b1, b2a} {
+		if err := utxo.ConnectBlock(db, b, uint32(h)); err != nil {
+			t.Fatalf("connect block %d: %v", h, err)
+		}
+	}
+	var recordings []rpc.Recording
+	record := func(method string, param, result interface{}) {
+		params, _ := json.Marshal([]interface{}{param})
+		raw, _ := json.Marshal(result)
+		recordings = append(recordings, rpc.Recording{Method: method, Params: params, Result: raw})
+	}
+	for h, b := range []*btcwire.MsgBlock{b0, b1, b2b, b3} {
+		hash, _ := b.BlockSha()
+		record("getblockhash", h, hash.String())
+		block := &rpc.Block{Hash: hash.String(), Height: int64(h), Version: b.Header.Version,
+			MerkleRoot: b.Header.MerkleRoot.String(), Time: b.Header.Timestamp.Unix(), Bits: "1d00ffff",
+			Flags: "proof-of-work", Modifier: "0"}
+		if h > 0 {
+			block.PreviousBlockHash = b.Header.PrevBlock.String()
+		}
+		if h == 0 || h == 3 {
+			block.Flags, block.Modifier = "proof-of-work stake-modifier", fmt.Sprintf("%x", 40+h)
+		}
+		for _, tx := range b.Transactions {
+			sha, _ := tx.TxSha()
+			var buf bytes.Buffer
+			tx.Serialize(&buf)
+			block.Tx = append(block.Tx, sha.String())
+			record("getrawtransaction", sha.String(), hex.EncodeToString(buf.Bytes()))
+		}
+		record("getblock", hash.String(), block)
+	}
+	recordings = append(recordings, rpc.Recording{Method: "getblockcount", Result: json.RawMessage("3")})
+	s := rpc.NewMockServer(recordings)
+	defer s.Close()
+
+	sync := &minter.DBSync{Client: s.Client(), Net: net, DB: db}
+	if n, err := sync.Sync(); err != nil || n != 2 {
+		t.Fatalf("sync connected %d blocks: %v", n, err)
+	}
+	if top, _, err := db.FetchHeight(); err != nil || top != 3 {
+		t.Fatalf("db top %d: %v", top, err)
+	}
+	sha2a, _ := b2a.Transactions[0].TxSha()
+	if _, err := db.FetchUTXO(btcwire.NewOutPoint(&sha2a, 0)); !errors.Is(err, utxo.ErrNotFound) {
+		t.Errorf("output of the disconnected block left: %v", err)
+	}
+	if _, err := db.FetchUTXO(btcwire.NewOutPoint(&sha0, 1)); !errors.Is(err, utxo.ErrNotFound) {
+		t.Errorf("spent output left: %v", err)
+	}
+	addr, _ := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{0xa}, 20), &btcnet.TestNet3Params)
+	if _, utxos, err := db.FetchCoins(addr); err != nil || len(utxos) != 1 || utxos[0].StakeModifier != 43 {
+		t.Errorf("block 0's output didn't get block 3's stake modifier: %v", err)
+	}
+	addr, _ = btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{0xe}, 20), &btcnet.TestNet3Params)
+	if outPoints, _, err := db.FetchCoins(addr); err != nil || len(outPoints) != 0 {
+		t.Errorf("block 2b's output isn't waiting for its stake modifier: %v", err)
+	}
+	if n, err := sync.Sync(); err != nil || n != 0 {
+		t.Errorf("synced db connected %d blocks: %v", n, err)
+	}
+}
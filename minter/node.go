@@ -0,0 +1,218 @@
+package minter
+
+import (
+	"fmt"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/rpc"
+	"github.com/mably/btcwire"
+)
+
+// Tip is the best block of the node and the target of the block minted on
+// top of it.
+type Tip struct {
+	Hash   btcwire.ShaHash
+	Height int64
+	Time   int64
+	// StakeBits is the target of the next proof-of-stake block.
+	StakeBits uint32
+	// Index is the best block linked back far enough to select the v0.5
+	// kernel stake modifiers of the seconds after it (see
+	// umint.Network.KernelWindows), nil if the node has none.
+	Index umint.BlockIndex
+}
+
+// Node is the peercoin node the minter follows and submits blocks to.
+type Node interface {
+	Tip() (*Tip, error)
+	SubmitBlock(block []byte) error
+}
+
+// rpcBlock is a block fetched from ppcoind, linked toward genesis as far as
+// it was fetched.
+type rpcBlock struct {
+	block *rpc.Block
+	bits  uint32
+	prev  *rpcBlock
+}
+
+func (b *rpcBlock) Height() int32        { return int32(b.block.Height) }
+func (b *rpcBlock) Time() int64          { return b.block.Time }
+func (b *rpcBlock) Bits() uint32         { return b.bits }
+func (b *rpcBlock) IsProofOfStake() bool { return b.block.IsProofOfStake() }
+func (b *rpcBlock) Prev() umint.RetargetBlock {
+	if b.prev == nil {
+		return nil
+	}
+	return b.prev
+}
+
+// RPCNode is a Node backed by ppcoind's JSON-RPC.
+type RPCNode struct {
+	Client *rpc.Client
+	Net    *umint.Network
+	// MaxDepth limits the blocks fetched looking for the last two
+	// proof-of-stake blocks, MaxIndexDepth the blocks of the index.
+	MaxDepth      int
+	MaxIndexDepth int
+
+	tip *Tip
+	// nodes are the indexed blocks by hash
+	nodes map[btcwire.ShaHash]*umint.BlockNode
+}
+
+// NewRPCNode returns a node calling client.
+func NewRPCNode(client *rpc.Client, net *umint.Network) *RPCNode {
+	return &RPCNode{Client: client, Net: net, MaxDepth: 1000, MaxIndexDepth: 20000}
+}
+
+// Tip returns the best block, the next target is computed with
+// NextTargetRequired from the blocks down to the second last proof-of-stake
+// one. The index of the blocks from the best one back a stake min age is
+// fetched once, then extended with the new blocks.
+func (n *RPCNode) Tip() (*Tip, error) {
+	height, err := n.Client.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := n.Client.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	if n.tip != nil && n.tip.Height == height && n.tip.Hash.String() == hash {
+		return n.tip, nil
+	}
+
+	// fetch down to the block before the second last stake block, or genesis
+	var fetched []*rpc.Block
+	var best, last *rpcBlock
+	stakeBlocks, complete := 0, false
+	for depth := 0; !complete && depth < n.MaxDepth; depth++ {
+		block, err := n.Client.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		bits, err := block.CompactBits()
+		if err != nil {
+			return nil, fmt.Errorf("block %v bits %q: %w", hash, block.Bits, err)
+		}
+		fetched = append(fetched, block)
+		b := &rpcBlock{block: block, bits: bits}
+		if best == nil {
+			best = b
+		} else {
+			last.prev = b
+		}
+		last = b
+		if stakeBlocks == 2 || block.PreviousBlockHash == "" {
+			complete = true
+		}
+		if block.IsProofOfStake() {
+			stakeBlocks++
+		}
+		hash = block.PreviousBlockHash
+	}
+	if !complete {
+		return nil, fmt.Errorf("less than two stake blocks in %d blocks", n.MaxDepth)
+	}
+	sha, err := btcwire.NewShaHashFromStr(best.block.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("best block hash: %w", err)
+	}
+	index, err := n.updateIndex(fetched)
+	if err != nil {
+		return nil, fmt.Errorf("block index: %w", err)
+	}
+	n.tip = &Tip{
+		Hash:      *sha,
+		Height:    height,
+		Time:      best.block.Time,
+		StakeBits: umint.NextTargetRequired(n.Net, best, true),
+		Index:     index,
+	}
+	return n.tip, nil
+}
+
+// indexNode returns the index node of block, without its proof-of-stake
+// hash.
+func indexNode(block *rpc.Block) (*umint.BlockNode, error) {
+	hash, err := btcwire.NewShaHashFromStr(block.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("block hash %q: %w", block.Hash, err)
+	}
+	modifier, err := block.StakeModifier()
+	if err != nil {
+		return nil, fmt.Errorf("block %v modifier %q: %w", block.Hash, block.Modifier, err)
+	}
+	return &umint.BlockNode{
+		BlockHeight:       int32(block.Height),
+		BlockTime:         block.Time,
+		BlockHash:         *hash,
+		ProofOfStake:      block.IsProofOfStake(),
+		EntropyBit:        block.EntropyBit,
+		GeneratedModifier: block.GeneratedStakeModifier(),
+		Modifier:          modifier,
+	}, nil
+}
+
+// updateIndex links the blocks fetched from the best one down into the
+// index, fetching more until they join the indexed blocks, reach genesis or
+// a generation selected for the v0.5 kernels after the best block. Blocks
+// below that generation are dropped from the index.
+func (n *RPCNode) updateIndex(fetched []*rpc.Block) (*umint.BlockNode, error) {
+	if n.nodes == nil {
+		n.nodes = make(map[btcwire.ShaHash]*umint.BlockNode)
+	}
+	reach := n.Net.StakeMinAge - umint.StakeModifierSelectionInterval(n.Net)
+	// selected tells if b's generation is selected for the kernels after best
+	selected := func(best, b *umint.BlockNode) bool {
+		return b != best && b.GeneratedModifier && b.BlockTime+reach <= best.BlockTime
+	}
+	var best, last *umint.BlockNode
+	for depth := 0; ; depth++ {
+		var block *rpc.Block
+		if depth < len(fetched) {
+			block = fetched[depth]
+		} else {
+			if depth >= n.MaxIndexDepth {
+				return nil, fmt.Errorf("no selected stake modifier in %d blocks", n.MaxIndexDepth)
+			}
+			var err error
+			if block, err = n.Client.GetBlock(fetched[len(fetched)-1].PreviousBlockHash); err != nil {
+				return nil, err
+			}
+			fetched = append(fetched, block)
+		}
+		node, err := indexNode(block)
+		if err != nil {
+			return nil, err
+		}
+		known := n.nodes[node.BlockHash]
+		if known != nil {
+			node = known
+		}
+		if last == nil {
+			best = node
+		} else {
+			last.PrevNode, node.NextNode = node, last
+		}
+		last = node
+		if known != nil || block.PreviousBlockHash == "" || selected(best, node) {
+			break
+		}
+	}
+
+	nodes := make(map[btcwire.ShaHash]*umint.BlockNode)
+	for b := best; b != nil; b = b.PrevNode {
+		nodes[b.BlockHash] = b
+		if selected(best, b) {
+			b.PrevNode = nil
+		}
+	}
+	n.nodes = nodes
+	return best, nil
+}
+
+// SubmitBlock submits block with submitblock.
+func (n *RPCNode) SubmitBlock(block []byte) error {
+	return n.Client.SubmitBlock(block)
+}
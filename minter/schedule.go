@@ -0,0 +1,179 @@
+package minter
+
+import (
+	"container/heap"
+	"context"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcwire"
+	"sort"
+)
+
+// Entry is a scheduled kernel: at Time the kernel of OutPoint meets targets
+// up to MaxDiff (MaxBits).
+type Entry struct {
+	Time     int64             `json:"time"`
+	OutPoint *btcwire.OutPoint `json:"outPoint"`
+	MaxBits  uint32            `json:"maxBits"`
+	MaxDiff  *umint.Difficulty `json:"maxDiff"`
+}
+
+type entryHeap []*Entry
+
+func (h entryHeap) Len() int { return len(h) }
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].Time != h[j].Time {
+		return h[i].Time < h[j].Time
+	}
+	// prefer the kernel meeting the harder target
+	return h[i].MaxDiff.Cmp(h[j].MaxDiff) > 0
+}
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(*Entry)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Schedule is a priority queue of the kernels of a set of outputs, searched
+// ahead of time at a given target. Kernels only depend on known data and
+// time, so the minter just wakes up at the scheduled seconds and rechecks
+// them against the actual target.
+type Schedule struct {
+	Net *umint.Network
+	// Horizon is the number of seconds searched ahead.
+	Horizon int64
+	// Scanner searches the kernels.
+	Scanner umint.Scanner
+
+	entries  entryHeap
+	outputs  map[string]bool
+	diff     *umint.Difficulty
+	from, to int64
+}
+
+// NewSchedule returns an empty schedule searching horizon seconds ahead.
+func NewSchedule(net *umint.Network, horizon int64) *Schedule {
+	return &Schedule{Net: net, Horizon: horizon}
+}
+
+// stale tells if the schedule must be searched again to cover the outputs
+// from now at bits: the outputs changed, the target got easier or less than
+// half of the horizon is left.
+func (s *Schedule) stale(outPoints []*btcwire.OutPoint, diff *umint.Difficulty, now int64) bool {
+	if s.diff == nil || diff.Cmp(s.diff) < 0 || now < s.from || now+s.Horizon/2 > s.to {
+		return true
+	}
+	if len(outPoints) != len(s.outputs) {
+		return true
+	}
+	for _, o := range outPoints {
+		if !s.outputs[outPointKey(o)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh searches the kernels of the outputs in the Horizon seconds from
+// now at bits, under the protocol in force at each second and, from v0.5,
+// hashing the stake modifier selected from index, unless the schedule
+// already covers them. It tells if the schedule was searched again.
+// Cancelling ctx stops the search and leaves the schedule unchanged.
+func (s *Schedule) Refresh(ctx context.Context, outPoints []*btcwire.OutPoint, utxos []*utxo.UTXO, bits uint32,
+	index umint.BlockIndex, now int64) (bool, error) {
+	diff := umint.DiffFromBits(bits)
+	if !s.stale(outPoints, diff, now) {
+		return false, nil
+	}
+	to := now + s.Horizon
+	windows, err := s.Net.KernelWindows(index, now, to)
+	if err != nil {
+		return false, err
+	}
+	var jobs []umint.ScanJob
+	// jobOutput maps the scan jobs to their outputs
+	var jobOutput []int
+	for _, w := range windows {
+		for i, o := range outPoints {
+			jobs = append(jobs, umint.ScanJob{Template: w.Template(kernelTemplate(s.Net, o, utxos[i], bits)), From: w.From, To: w.To})
+			jobOutput = append(jobOutput, i)
+		}
+	}
+	var entries entryHeap
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for r := range s.Scanner.Scan(ctx, jobs) {
+		if r.Err != nil {
+			return false, r.Err
+		}
+		entries = append(entries, &Entry{
+			Time:     r.Hit.TxTime,
+			OutPoint: outPoints[jobOutput[r.Job]],
+			MaxBits:  r.Hit.MaxBits,
+			MaxDiff:  r.Hit.MaxDiff,
+		})
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	heap.Init(&entries)
+	s.entries = entries
+	s.outputs = make(map[string]bool, len(outPoints))
+	for _, o := range outPoints {
+		s.outputs[outPointKey(o)] = true
+	}
+	s.diff, s.from, s.to = diff, now, to
+	return true, nil
+}
+
+// Next returns the earliest entry, nil if the schedule is empty.
+func (s *Schedule) Next() *Entry {
+	if len(s.entries) == 0 {
+		return nil
+	}
+	return s.entries[0]
+}
+
+// Pop removes and returns the earliest entry.
+func (s *Schedule) Pop() *Entry {
+	if len(s.entries) == 0 {
+		return nil
+	}
+	return heap.Pop(&s.entries).(*Entry)
+}
+
+// Entries returns the scheduled entries in time order.
+func (s *Schedule) Entries() []Entry {
+	entries := make(entryHeap, len(s.entries))
+	copy(entries, s.entries)
+	sort.Sort(entries)
+	list := make([]Entry, len(entries))
+	for i, e := range entries {
+		list[i] = *e
+	}
+	return list
+}
+
+// Window returns the searched seconds and the difficulty they were searched
+// at, nil if the schedule was never refreshed.
+func (s *Schedule) Window() (from, to int64, diff *umint.Difficulty) {
+	return s.from, s.to, s.diff
+}
+
+// kernelTemplate returns the kernel template of the output, see
+// umint.KernelWindow.Template for its time, protocol and stake modifier.
+func kernelTemplate(net *umint.Network, o *btcwire.OutPoint, u *utxo.UTXO, bits uint32) umint.StakeKernelTemplate {
+	return umint.StakeKernelTemplate{
+		BlockFromTime:  int64(u.BlockTime),
+		StakeModifier:  u.StakeModifier,
+		PrevTxOffset:   u.OffsetInBlock,
+		PrevTxTime:     int64(u.Time),
+		PrevTxOutIndex: o.Index,
+		PrevTxOutValue: int64(u.Value),
+		StakeMinAge:    net.StakeMinAge,
+		Bits:           bits,
+	}
+}
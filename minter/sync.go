@@ -0,0 +1,241 @@
+package minter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/rpc"
+	"github.com/kac-/umint/utxo"
+	"github.com/kac-/umint/utxo/build"
+	"github.com/mably/btcwire"
+	"time"
+)
+
+// DBSync keeps an unspent outputs database built by package utxo/build on
+// the node's best chain: it disconnects the top blocks that left the chain
+// and connects the new ones, rebuilt from getblock and getrawtransaction
+// (ppcoind indexes all transactions). As while building, new outputs wait
+// for the stake modifier generated a selection interval after their block.
+type DBSync struct {
+	Client *rpc.Client
+	Net    *umint.Network
+	DB     utxo.Store
+	// KeepUndo is the number of top blocks whose undo records are kept for
+	// reorganizations, build.DefaultKeepUndo if 0.
+	KeepUndo int32
+
+	// tip is the database's top block, linked back to the oldest block with
+	// outputs waiting for their stake modifier
+	tip     *umint.BlockNode
+	pending []*pendingBlock
+}
+
+type pendingBlock struct {
+	node      *umint.BlockNode
+	outPoints []*btcwire.OutPoint
+}
+
+// Sync connects the blocks of the node's best chain above the database's top
+// and returns how many it connected. Top blocks left out of the chain are
+// disconnected first, as far as their undo records go.
+func (s *DBSync) Sync() (int, error) {
+	height, err := s.Client.GetBlockCount()
+	if err != nil {
+		return 0, err
+	}
+	top, err := s.disconnectStale(height)
+	if err != nil {
+		return 0, err
+	}
+	if s.tip == nil {
+		if err := s.load(top); err != nil {
+			return 0, fmt.Errorf("load blocks waiting for stake modifiers: %w", err)
+		}
+	}
+	connected := 0
+	for h := int64(top) + 1; h <= height; h++ {
+		if err := s.connect(h); err != nil {
+			// reload the pending blocks from the database at the next sync
+			s.tip, s.pending = nil, nil
+			return connected, fmt.Errorf("connect block at height %d: %w", h, err)
+		}
+		connected++
+	}
+	return connected, nil
+}
+
+// disconnectStale disconnects the top blocks of the database missing from
+// the node's chain of height and returns the new top height. A node behind
+// the database is left to catch up.
+func (s *DBSync) disconnectStale(height int64) (uint32, error) {
+	for {
+		top, _, err := s.DB.FetchHeight()
+		if err != nil {
+			return 0, fmt.Errorf("db top: %w", err)
+		}
+		undo, err := utxo.FetchUndo(s.DB, top)
+		if err != nil {
+			return 0, fmt.Errorf("db top block at height %d: %w", top, err)
+		}
+		if int64(top) > height {
+			return top, nil // the node is behind, wait for it
+		}
+		hash, err := s.Client.GetBlockHash(int64(top))
+		if err != nil {
+			return 0, err
+		}
+		if hash == undo.Hash.String() {
+			return top, nil
+		}
+		if _, err := utxo.DisconnectBlock(s.DB); err != nil {
+			return 0, fmt.Errorf("disconnect block %v: %w", undo.Hash, err)
+		}
+		s.tip, s.pending = nil, nil
+	}
+}
+
+// load indexes the top blocks of the database back from top, as far as
+// their outputs may wait for their stake modifier.
+func (s *DBSync) load(top uint32) error {
+	selectionInterval := umint.StakeModifierSelectionInterval(s.Net)
+	var tip, last *umint.BlockNode
+	var pending []*pendingBlock
+	for h := int64(top); h >= 0; h-- {
+		undo, err := utxo.FetchUndo(s.DB, uint32(h))
+		if errors.Is(err, utxo.ErrNoUndo) {
+			break // pruned, its outputs got their modifier long ago
+		}
+		if err != nil {
+			return err
+		}
+		block, err := s.Client.GetBlock(undo.Hash.String())
+		if err != nil {
+			return err
+		}
+		node, err := indexNode(block)
+		if err != nil {
+			return err
+		}
+		if last == nil {
+			tip = node
+		} else {
+			last.PrevNode, node.NextNode = node, last
+		}
+		last = node
+		pending = append([]*pendingBlock{{node: node, outPoints: undo.Created}}, pending...)
+		if node.BlockTime+selectionInterval+2*s.Net.ModifierInterval < tip.BlockTime {
+			break
+		}
+	}
+	s.tip, s.pending = tip, pending
+	return nil
+}
+
+// resolveModifiers pops the pending blocks whose kernel stake modifier is
+// known at the tip and returns the updates setting them.
+func (s *DBSync) resolveModifiers() []utxo.ModifierUpdate {
+	var updates []utxo.ModifierUpdate
+	for len(s.pending) > 0 {
+		p := s.pending[0]
+		modifier, _, _, err := umint.KernelStakeModifier(s.Net, p.node)
+		if err != nil {
+			break // not generated yet
+		}
+		updates = append(updates, utxo.ModifierUpdate{OutPoints: p.outPoints, Modifier: modifier})
+		s.pending = s.pending[1:]
+	}
+	return updates
+}
+
+// connect connects the node's block at height on top of the database.
+func (s *DBSync) connect(height int64) error {
+	hash, err := s.Client.GetBlockHash(height)
+	if err != nil {
+		return err
+	}
+	block, err := s.Client.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+	msg, err := s.msgBlock(block)
+	if err != nil {
+		return err
+	}
+	node, err := indexNode(block)
+	if err != nil {
+		return err
+	}
+	if s.tip != nil {
+		s.tip.NextNode, node.PrevNode = node, s.tip
+	}
+	s.tip = node
+	if err := utxo.ConnectBlock(s.DB, msg, uint32(height), s.resolveModifiers()...); err != nil {
+		return err
+	}
+	p := &pendingBlock{node: node}
+	for _, tx := range msg.Transactions {
+		txSha, _ := tx.TxSha()
+		for idx, out := range tx.TxOut {
+			if len(out.PkScript) > 0 {
+				p.outPoints = append(p.outPoints, btcwire.NewOutPoint(&txSha, uint32(idx)))
+			}
+		}
+	}
+	s.pending = append(s.pending, p)
+	// the index starts at the oldest pending block
+	s.pending[0].node.PrevNode = nil
+
+	keepUndo := s.KeepUndo
+	if keepUndo <= 0 {
+		keepUndo = build.DefaultKeepUndo
+	}
+	if h := int32(height); h >= keepUndo && h%keepUndo == 0 {
+		if err := utxo.PruneUndo(s.DB, uint32(h-keepUndo+1)); err != nil {
+			return fmt.Errorf("prune undo records: %w", err)
+		}
+	}
+	return nil
+}
+
+// msgBlock rebuilds block with its transactions, checking their hashes.
+func (s *DBSync) msgBlock(block *rpc.Block) (*btcwire.MsgBlock, error) {
+	bits, err := block.CompactBits()
+	if err != nil {
+		return nil, fmt.Errorf("block %v bits %q: %w", block.Hash, block.Bits, err)
+	}
+	merkleRoot, err := btcwire.NewShaHashFromStr(block.MerkleRoot)
+	if err != nil {
+		return nil, fmt.Errorf("block %v merkle root %q: %w", block.Hash, block.MerkleRoot, err)
+	}
+	prevBlock, err := btcwire.NewShaHashFromStr(block.PreviousBlockHash)
+	if err != nil {
+		return nil, fmt.Errorf("block %v previous block %q: %w", block.Hash, block.PreviousBlockHash, err)
+	}
+	msg := btcwire.NewMsgBlock(&btcwire.BlockHeader{
+		Version:    block.Version,
+		PrevBlock:  *prevBlock,
+		MerkleRoot: *merkleRoot,
+		Timestamp:  time.Unix(block.Time, 0),
+		Bits:       bits,
+		Nonce:      block.Nonce,
+	})
+	if sha, _ := msg.BlockSha(); sha.String() != block.Hash {
+		return nil, fmt.Errorf("block %v header hashes to %v", block.Hash, sha)
+	}
+	for _, txid := range block.Tx {
+		raw, err := s.Client.GetRawTransaction(txid)
+		if err != nil {
+			return nil, fmt.Errorf("block %v transaction %v: %w", block.Hash, txid, err)
+		}
+		tx := new(btcwire.MsgTx)
+		if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+			return nil, fmt.Errorf("block %v transaction %v: %w", block.Hash, txid, err)
+		}
+		if sha, _ := tx.TxSha(); sha.String() != txid {
+			return nil, fmt.Errorf("block %v transaction %v hashes to %v", block.Hash, txid, sha)
+		}
+		msg.AddTransaction(tx)
+	}
+	return msg, nil
+}
@@ -0,0 +1,373 @@
+package umint
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"math/big"
+	"sort"
+)
+
+const (
+	// ratio of group interval length between the last group and the first group
+	modifierIntervalRatio int64 = 3
+	// number of blocks selected into a stake modifier
+	modifierSelectionRounds = 64
+)
+
+// BlockIndex is a main chain block as seen by the stake modifier computation.
+// Prev and Next must return an untyped nil at the ends of the chain.
+type BlockIndex interface {
+	Height() int32
+	Time() int64
+	Hash() *btcwire.ShaHash
+	IsProofOfStake() bool
+	// ProofOfStakeHash is the kernel hash of a proof-of-stake block.
+	ProofOfStakeHash() *btcwire.ShaHash
+	StakeEntropyBit() uint32
+	GeneratedStakeModifier() bool
+	StakeModifier() uint64
+	Prev() BlockIndex
+	Next() BlockIndex
+}
+
+// BlockNode is a linked list BlockIndex implementation.
+type BlockNode struct {
+	BlockHeight        int32
+	BlockTime          int64
+	BlockHash          btcwire.ShaHash
+	ProofOfStake       bool
+	HashProofOfStake   btcwire.ShaHash
+	EntropyBit         uint32
+	GeneratedModifier  bool
+	Modifier           uint64
+	PrevNode, NextNode *BlockNode
+}
+
+func (n *BlockNode) Height() int32                      { return n.BlockHeight }
+func (n *BlockNode) Time() int64                        { return n.BlockTime }
+func (n *BlockNode) Hash() *btcwire.ShaHash             { return &n.BlockHash }
+func (n *BlockNode) IsProofOfStake() bool               { return n.ProofOfStake }
+func (n *BlockNode) ProofOfStakeHash() *btcwire.ShaHash { return &n.HashProofOfStake }
+func (n *BlockNode) StakeEntropyBit() uint32            { return n.EntropyBit }
+func (n *BlockNode) GeneratedStakeModifier() bool       { return n.GeneratedModifier }
+func (n *BlockNode) StakeModifier() uint64              { return n.Modifier }
+
+func (n *BlockNode) Prev() BlockIndex {
+	if n.PrevNode == nil {
+		return nil
+	}
+	return n.PrevNode
+}
+
+func (n *BlockNode) Next() BlockIndex {
+	if n.NextNode == nil {
+		return nil
+	}
+	return n.NextNode
+}
+
+// Append links a new block after n, computes its stake modifier and
+// returns it. n may be nil for the genesis block.
+func (n *BlockNode) Append(net *Network, b *BlockNode) (*BlockNode, error) {
+	var prev BlockIndex
+	if n != nil {
+		prev = n
+		b.BlockHeight = n.BlockHeight + 1
+	}
+	modifier, generated, err := ComputeNextStakeModifier(net, prev, b.BlockTime)
+	if err != nil {
+		return nil, err
+	}
+	b.Modifier, b.GeneratedModifier = modifier, generated
+	b.PrevNode = n
+	if n != nil {
+		n.NextNode = b
+	}
+	return b, nil
+}
+
+// StakeEntropyBit returns the stake entropy bit of the block at height with
+// hash and signature sig: the last bit of the hash or, below the network's
+// StakeEntropySwitchHeight, the first bit of the signature's hash160.
+func (n *Network) StakeEntropyBit(height int32, hash *btcwire.ShaHash, sig []byte) uint32 {
+	if height >= n.StakeEntropySwitchHeight {
+		return uint32(hash[0] & 1)
+	}
+	return uint32(btcutil.Hash160(sig)[19] >> 7)
+}
+
+// stakeModifierSelectionIntervalSection returns the length of the section
+// of the selection interval (in seconds) in which round's block is selected.
+func stakeModifierSelectionIntervalSection(net *Network, section int) int64 {
+	return net.ModifierInterval * 63 / (63 + (63-int64(section))*(modifierIntervalRatio-1))
+}
+
+// StakeModifierSelectionInterval returns the length of the time window (in
+// seconds) from which blocks are selected into a new stake modifier.
+func StakeModifierSelectionInterval(net *Network) (interval int64) {
+	for section := 0; section < modifierSelectionRounds; section++ {
+		interval += stakeModifierSelectionIntervalSection(net, section)
+	}
+	return
+}
+
+// lastStakeModifier returns the last modifier generated at or before b.
+func lastStakeModifier(b BlockIndex) (modifier uint64, modifierTime int64, err error) {
+	for !b.GeneratedStakeModifier() {
+		prev := b.Prev()
+		if prev == nil {
+			err = errors.New("GetLastStakeModifier() : no generation at genesis block")
+			return
+		}
+		b = prev
+	}
+	return b.StakeModifier(), b.Time(), nil
+}
+
+// hashLess compares hashes as 256-bit little-endian numbers.
+func hashLess(a, b *btcwire.ShaHash) bool {
+	for i := btcwire.HashSize - 1; i >= 0; i-- {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func hashToBig(hash []byte) *big.Int {
+	buf := make([]byte, len(hash))
+	for i := range hash {
+		buf[len(hash)-1-i] = hash[i]
+	}
+	return new(big.Int).SetBytes(buf)
+}
+
+type blocksByTime []BlockIndex
+
+func (s blocksByTime) Len() int      { return len(s) }
+func (s blocksByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s blocksByTime) Less(i, j int) bool {
+	if s[i].Time() != s[j].Time() {
+		return s[i].Time() < s[j].Time()
+	}
+	return hashLess(s[i].Hash(), s[j].Hash())
+}
+
+// selectBlockFromCandidates picks the block with the lowest selection hash
+// among not yet selected candidates with time up to selectionIntervalStop.
+func selectBlockFromCandidates(candidates []BlockIndex, selected map[btcwire.ShaHash]bool,
+	selectionIntervalStop int64, stakeModifierPrev uint64) (best BlockIndex) {
+	var hashBest *big.Int
+	buf := make([]byte, btcwire.HashSize+8)
+	for _, b := range candidates {
+		if best != nil && b.Time() > selectionIntervalStop {
+			break
+		}
+		if selected[*b.Hash()] {
+			continue
+		}
+		// compute the selection hash by hashing its proof-hash and the
+		// previous proof-of-stake modifier
+		hashProof := b.Hash()
+		if b.IsProofOfStake() {
+			hashProof = b.ProofOfStakeHash()
+		}
+		copy(buf, hashProof[:])
+		binary.LittleEndian.PutUint64(buf[btcwire.HashSize:], stakeModifierPrev)
+		hashSelection := hashToBig(doubleSha256(buf))
+		// the selection hash is divided by 2**32 so that proof-of-stake block
+		// is always favored over proof-of-work block
+		if b.IsProofOfStake() {
+			hashSelection.Rsh(hashSelection, 32)
+		}
+		if best == nil || hashSelection.Cmp(hashBest) < 0 {
+			best, hashBest = b, hashSelection
+		}
+	}
+	return
+}
+
+// ComputeNextStakeModifier computes the stake modifier of the block with
+// time currentTime following prev, prev is nil for the genesis block. Unless
+// a modifier interval passed since the last generated modifier, the last one
+// is returned with generated set to false.
+func ComputeNextStakeModifier(net *Network, prev BlockIndex, currentTime int64) (modifier uint64, generated bool, err error) {
+	if prev == nil {
+		return 0, true, nil // genesis block's modifier is 0
+	}
+	// First find current stake modifier and its generation block time
+	// if it's not old enough, return the same stake modifier
+	var modifierTime int64
+	modifier, modifierTime, err = lastStakeModifier(prev)
+	if err != nil {
+		err = fmt.Errorf("ComputeNextStakeModifier() : unable to get last modifier: %v", err)
+		return
+	}
+	if modifierTime/net.ModifierInterval >= prev.Time()/net.ModifierInterval {
+		return
+	}
+	// v0.4+ requires current block timestamp also be in a different modifier interval
+	if modifierTime/net.ModifierInterval >= currentTime/net.ModifierInterval &&
+		net.ProtocolAt(currentTime) >= ProtocolV04 {
+		return
+	}
+
+	// Sort candidate blocks by timestamp
+	selectionInterval := StakeModifierSelectionInterval(net)
+	selectionIntervalStart := (prev.Time()/net.ModifierInterval)*net.ModifierInterval - selectionInterval
+	var candidates []BlockIndex
+	for b := prev; b != nil && b.Time() >= selectionIntervalStart; b = b.Prev() {
+		candidates = append(candidates, b)
+	}
+	for i, l := 0, len(candidates); i < l/2; i++ {
+		candidates[i], candidates[l-1-i] = candidates[l-1-i], candidates[i]
+	}
+	sort.Sort(blocksByTime(candidates))
+
+	// Select 64 blocks from candidate blocks to generate stake modifier
+	var modifierNew uint64
+	selectionIntervalStop := selectionIntervalStart
+	selected := make(map[btcwire.ShaHash]bool)
+	for round := 0; round < modifierSelectionRounds && round < len(candidates); round++ {
+		// add an interval section to the current selection round
+		selectionIntervalStop += stakeModifierSelectionIntervalSection(net, round)
+		b := selectBlockFromCandidates(candidates, selected, selectionIntervalStop, modifier)
+		if b == nil {
+			err = fmt.Errorf("ComputeNextStakeModifier() : unable to select block at round %d", round)
+			return
+		}
+		// write the entropy bit of the selected block
+		modifierNew |= uint64(b.StakeEntropyBit()) << uint(round)
+		selected[*b.Hash()] = true
+	}
+	return modifierNew, true, nil
+}
+
+// KernelStakeModifier returns the stake modifier hashed into kernels of
+// outputs from blockFrom under protocols before v0.5: the first modifier
+// generated at least a selection interval after blockFrom.
+func KernelStakeModifier(net *Network, blockFrom BlockIndex) (modifier uint64, height int32, modifierTime int64, err error) {
+	height, modifierTime = blockFrom.Height(), blockFrom.Time()
+	selectionInterval := StakeModifierSelectionInterval(net)
+	b := blockFrom
+	// loop to find the stake modifier later by a selection interval
+	for modifierTime < blockFrom.Time()+selectionInterval {
+		next := b.Next()
+		if next == nil {
+			err = fmt.Errorf("GetKernelStakeModifier() : reached best block %v at height %d from block %v",
+				b.Hash(), b.Height(), blockFrom.Hash())
+			return
+		}
+		b = next
+		if b.GeneratedStakeModifier() {
+			height, modifierTime = b.Height(), b.Time()
+		}
+	}
+	return b.StakeModifier(), height, modifierTime, nil
+}
+
+// KernelStakeModifierV05 returns the stake modifier hashed into kernels
+// with time txTime under protocol v0.5: the last modifier generated at least
+// (stake min age - selection interval) before txTime, searched back from best.
+func KernelStakeModifierV05(net *Network, best BlockIndex, txTime int64) (modifier uint64, height int32, modifierTime int64, err error) {
+	height, modifierTime = best.Height(), best.Time()
+	selectionInterval := StakeModifierSelectionInterval(net)
+	if modifierTime+net.StakeMinAge-selectionInterval <= txTime {
+		// best block is still more than
+		// (stake min age - selection interval) older than kernel timestamp
+		err = fmt.Errorf("GetKernelStakeModifierV05() : best block %v at height %d too old for stake",
+			best.Hash(), best.Height())
+		return
+	}
+	b := best
+	// loop to find the stake modifier earlier by
+	// (stake min age - selection interval)
+	for modifierTime+net.StakeMinAge-selectionInterval > txTime {
+		prev := b.Prev()
+		if prev == nil {
+			err = errors.New("GetKernelStakeModifierV05() : reached genesis block")
+			return
+		}
+		b = prev
+		if b.GeneratedStakeModifier() {
+			height, modifierTime = b.Height(), b.Time()
+		}
+	}
+	return b.StakeModifier(), height, modifierTime, nil
+}
+
+// ErrNoBlockIndex is returned by Network.KernelWindows for v0.5 kernel times
+// without a block index to select their stake modifier from.
+var ErrNoBlockIndex = errors.New("no block index to select v0.5 kernel stake modifiers from")
+
+// KernelWindow is a window of kernel times [From, To] sharing a protocol
+// and, from v0.5, the kernel stake modifier.
+type KernelWindow struct {
+	From, To int64
+	Protocol Protocol
+	// Modifier is the v0.5 kernel stake modifier of the window, kernels of
+	// earlier protocols hash the modifier of their output.
+	Modifier uint64
+}
+
+// Template returns tpl at the window's first second: under its protocol
+// and, from v0.5, hashing its stake modifier.
+func (w *KernelWindow) Template(tpl StakeKernelTemplate) StakeKernelTemplate {
+	tpl.Protocol, tpl.TxTime = w.Protocol, w.From
+	if w.Protocol >= ProtocolV05 {
+		tpl.StakeModifier = w.Modifier
+	}
+	return tpl
+}
+
+// KernelWindows splits the kernel times [from, to] at the protocol switches
+// and, from v0.5, where the stake modifier selected back from best changes
+// (see KernelStakeModifierV05). best may be nil if no window is v0.5, it
+// must reach back a stake min age otherwise.
+func (n *Network) KernelWindows(best BlockIndex, from, to int64) ([]KernelWindow, error) {
+	var windows []KernelWindow
+	for _, pw := range n.ProtocolWindows(from, to) {
+		if pw.Protocol < ProtocolV05 {
+			windows = append(windows, KernelWindow{From: pw.From, To: pw.To, Protocol: pw.Protocol})
+			continue
+		}
+		if best == nil {
+			return nil, ErrNoBlockIndex
+		}
+		if _, _, _, err := KernelStakeModifierV05(n, best, pw.To); err != nil {
+			return nil, err
+		}
+		modifier, height, _, err := KernelStakeModifierV05(n, best, pw.From)
+		if err != nil {
+			return nil, err
+		}
+		// the modifier changes when a later generation gets old enough
+		reach := n.StakeMinAge - StakeModifierSelectionInterval(n)
+		var changes []int64
+		for b := best.Prev(); b != nil && b.Height() > height; b = b.Prev() {
+			if t := b.Time() + reach; b.GeneratedStakeModifier() && t > pw.From && t <= pw.To {
+				changes = append(changes, t)
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i] < changes[j] })
+		windows = append(windows, KernelWindow{From: pw.From, To: pw.To, Protocol: pw.Protocol, Modifier: modifier})
+		for _, t := range changes {
+			last := &windows[len(windows)-1]
+			if t == last.From {
+				continue
+			}
+			if modifier, _, _, err = KernelStakeModifierV05(n, best, t); err != nil {
+				return nil, err
+			}
+			if modifier == last.Modifier {
+				continue
+			}
+			last.To = t - 1
+			windows = append(windows, KernelWindow{From: t, To: pw.To, Protocol: pw.Protocol, Modifier: modifier})
+		}
+	}
+	return windows, nil
+}
@@ -0,0 +1,235 @@
+package umint_test
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/kac-/umint"
+	"github.com/mably/btcwire"
+	"testing"
+)
+
+// buildChain links count blocks spaced by spacing seconds, entropy returns
+// the entropy bit of a block at height.
+func buildChain(t *testing.T, net *umint.Network, count int, spacing int64,
+	entropy func(height int) uint32) (genesis, tip *umint.BlockNode) {
+	start := int64(1400000000)
+	for i := 0; i < count; i++ {
+		var h [4]byte
+		binary.LittleEndian.PutUint32(h[:], uint32(i))
+		b := &umint.BlockNode{
+			BlockTime:    start + int64(i)*spacing,
+			BlockHash:    sha256.Sum256(h[:]),
+			ProofOfStake: i%2 == 1,
+			EntropyBit:   entropy(i),
+		}
+		b.HashProofOfStake = sha256.Sum256(b.BlockHash[:])
+		var err error
+		tip, err = tip.Append(net, b)
+		if err != nil {
+			t.Fatalf("append block %v: %v", i, err)
+		}
+		if genesis == nil {
+			genesis = tip
+		}
+	}
+	return
+}
+
+func TestComputeNextStakeModifier(t *testing.T) {
+	net := umint.MainNet
+	genesis, tip := buildChain(t, net, 3000, 600, func(int) uint32 { return 1 })
+	if genesis.Modifier != 0 || !genesis.GeneratedModifier {
+		t.Errorf("wrong genesis modifier %x (generated %v)", genesis.Modifier, genesis.GeneratedModifier)
+	}
+	generated := 0
+	for b := genesis.NextNode; b != nil; b = b.NextNode {
+		if !b.GeneratedModifier {
+			if b.Modifier != b.PrevNode.Modifier {
+				t.Fatalf("modifier changed without generation at %v", b.BlockHeight)
+			}
+			continue
+		}
+		generated++
+		last := b.PrevNode
+		for !last.GeneratedModifier {
+			last = last.PrevNode
+		}
+		if last.BlockTime/net.ModifierInterval >= b.PrevNode.BlockTime/net.ModifierInterval {
+			t.Fatalf("modifier generated too early at %v", b.BlockHeight)
+		}
+		// with all entropy bits set and enough candidates every bit is set
+		if b.BlockHeight > 2000 && b.Modifier != ^uint64(0) {
+			t.Fatalf("wrong modifier at %v: %x", b.BlockHeight, b.Modifier)
+		}
+	}
+	if want := int(3000 * 600 / net.ModifierInterval); generated < want-1 || generated > want+1 {
+		t.Errorf("wrong number of generated modifiers, have %v want ~%v", generated, want)
+	}
+	_ = tip
+}
+
+func TestComputeNextStakeModifierV04(t *testing.T) {
+	net := *umint.TestNet
+	net.ProtocolV04SwitchTime, net.ProtocolV05SwitchTime = 1<<40, 1<<40
+	genesis, _ := buildChain(t, &net, 200, 60, func(h int) uint32 { return uint32(h) & 1 })
+	// a block generating a modifier, its predecessor and the last generation
+	g := genesis.NextNode
+	for !g.GeneratedModifier {
+		g = g.NextNode
+	}
+	g = g.NextNode
+	for !g.GeneratedModifier {
+		g = g.NextNode
+	}
+	last := g.PrevNode
+	for !last.GeneratedModifier {
+		last = last.PrevNode
+	}
+	// a block back in the last generation's interval generates a modifier
+	// before v0.4 only
+	currentTime := last.BlockTime
+	for _, test := range []struct {
+		switchTime int64
+		generated  bool
+	}{
+		{currentTime + 1, true},
+		{currentTime, false},
+	} {
+		net.ProtocolV04SwitchTime = test.switchTime
+		modifier, generated, err := umint.ComputeNextStakeModifier(&net, g.PrevNode, currentTime)
+		if err != nil {
+			t.Fatalf("compute stake modifier: %v", err)
+		}
+		want := last.Modifier
+		if test.generated {
+			want = g.Modifier
+		}
+		if generated != test.generated || modifier != want {
+			t.Errorf("v0.4 switch at %d: modifier %x generated %v, want %x %v",
+				test.switchTime, modifier, generated, want, test.generated)
+		}
+	}
+}
+
+func TestModifierSelectsBlockOnce(t *testing.T) {
+	net := umint.TestNet
+	_, tip := buildChain(t, net, 2000, 60, func(h int) uint32 {
+		if h == 1500 {
+			return 1
+		}
+		return 0
+	})
+	for b := tip; b != nil; b = b.PrevNode {
+		m := b.Modifier
+		if m&(m-1) != 0 {
+			t.Fatalf("block selected more than once in modifier at %v: %x", b.BlockHeight, m)
+		}
+	}
+}
+
+func TestKernelStakeModifier(t *testing.T) {
+	net := umint.TestNet
+	genesis, tip := buildChain(t, net, 2000, 60, func(h int) uint32 { return uint32(h) & 1 })
+	interval := umint.StakeModifierSelectionInterval(net)
+	if interval <= net.ModifierInterval*64/3 || interval >= net.ModifierInterval*64 {
+		t.Errorf("selection interval out of range: %v", interval)
+	}
+	from := genesis
+	for i := 0; i < 100; i++ {
+		from = from.NextNode
+	}
+	modifier, height, modifierTime, err := umint.KernelStakeModifier(net, from)
+	if err != nil {
+		t.Fatalf("kernel stake modifier: %v", err)
+	}
+	if modifierTime < from.BlockTime+interval {
+		t.Errorf("modifier too early: %v < %v", modifierTime, from.BlockTime+interval)
+	}
+	b := from
+	for b.BlockHeight != height {
+		b = b.NextNode
+	}
+	if !b.GeneratedModifier || b.Modifier != modifier {
+		t.Errorf("modifier %x not generated at height %v", modifier, height)
+	}
+	if _, _, _, err = umint.KernelStakeModifier(net, tip.PrevNode); err == nil {
+		t.Errorf("expected error near best block")
+	}
+
+	txTime := tip.BlockTime - net.StakeMinAge/2
+	modifier, height, modifierTime, err = umint.KernelStakeModifierV05(net, tip, txTime)
+	if err != nil {
+		t.Fatalf("kernel stake modifier v0.5: %v", err)
+	}
+	if modifierTime+net.StakeMinAge-interval > txTime {
+		t.Errorf("v0.5 modifier too late: %v", modifierTime)
+	}
+}
+
+func TestKernelWindows(t *testing.T) {
+	net := *umint.TestNet
+	_, tip := buildChain(t, &net, 3000, 60, func(h int) uint32 { return uint32(h*2654435761) >> 31 })
+	// v0.4 up to the switch, v0.5 after
+	net.ProtocolV05SwitchTime = tip.BlockTime - 12*60*60
+	from, to := net.ProtocolV05SwitchTime-60, tip.BlockTime+60*60
+	if _, err := net.KernelWindows(nil, from, to); !errors.Is(err, umint.ErrNoBlockIndex) {
+		t.Errorf("v0.5 windows without block index: %v", err)
+	}
+	windows, err := net.KernelWindows(tip, from, to)
+	if err != nil {
+		t.Fatalf("kernel windows: %v", err)
+	}
+	if len(windows) < 3 || windows[0].Protocol != umint.ProtocolV04 || windows[0].To != net.ProtocolV05SwitchTime-1 {
+		t.Fatalf("wrong windows %+v", windows)
+	}
+	next := from
+	for i, w := range windows {
+		if w.From != next || w.To < w.From {
+			t.Fatalf("window %d %+v doesn't follow %d", i, w, next-1)
+		}
+		next = w.To + 1
+		if w.Protocol < umint.ProtocolV05 {
+			continue
+		}
+		if i > 1 && w.Modifier == windows[i-1].Modifier {
+			t.Errorf("windows %d and %d share modifier %x", i-1, i, w.Modifier)
+		}
+		for _, txTime := range []int64{w.From, (w.From + w.To) / 2, w.To} {
+			if modifier, _, _, err := umint.KernelStakeModifierV05(&net, tip, txTime); err != nil || modifier != w.Modifier {
+				t.Errorf("window %d modifier %x, %x at %d: %v", i, w.Modifier, modifier, txTime, err)
+			}
+		}
+		tpl := w.Template(umint.StakeKernelTemplate{StakeModifier: 1})
+		if tpl.StakeModifier != w.Modifier || tpl.TxTime != w.From || tpl.Protocol != umint.ProtocolV05 {
+			t.Errorf("window %d template %+v", i, tpl)
+		}
+	}
+	if next != to+1 {
+		t.Errorf("windows end at %d, want %d", next-1, to)
+	}
+	// a best block too old for the kernel times
+	if _, err := net.KernelWindows(tip, tip.BlockTime+net.StakeMinAge, tip.BlockTime+net.StakeMinAge); err == nil {
+		t.Errorf("windows past the best block's reach")
+	}
+}
+
+func TestStakeEntropyBit(t *testing.T) {
+	hash := btcwire.ShaHash{0x02}
+	// hash160 of the signature is b472a266d0bd89c13706a4132ccfb16f7c3b9fcb
+	sig := []byte{}
+	tests := []struct {
+		net    *umint.Network
+		height int32
+		want   uint32
+	}{
+		{umint.MainNet, 9688, 1},
+		{umint.MainNet, 9689, 0},
+		{umint.TestNet, 0, 0},
+	}
+	for _, test := range tests {
+		if bit := test.net.StakeEntropyBit(test.height, &hash, sig); bit != test.want {
+			t.Errorf("%v entropy bit at %d = %d, want %d", test.net.Name, test.height, bit, test.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package umint
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcwire"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrReserveBalance is returned by StakePolicy.Plan when staking the kernel
+// would dip into the reserve balance.
+var ErrReserveBalance = errors.New("kernel exceeds balance above reserve")
+
+// StakePolicy shapes the coinstakes built for an address's outputs, it
+// follows ppcoind's CreateCoinStake. Zero values disable the respective rule.
+type StakePolicy struct {
+	// SplitThreshold is the minimum kernel value whose stake output is
+	// split into two.
+	SplitThreshold int64
+	// SplitAge limits splitting to kernels whose block is younger than
+	// SplitAge seconds at the coinstake's time.
+	SplitAge int64
+	// CombineThreshold stops combining extra inputs once the coinstake's
+	// value exceeds it, outputs above it aren't combined at all.
+	CombineThreshold int64
+	// MaxInputs limits the number of coinstake inputs, kernel included.
+	MaxInputs int
+	// ReserveBalance is the part of the address's balance never staked.
+	ReserveBalance int64
+}
+
+// NewCoinStakeSource returns a source holding the output of outPoint as
+// stored in the utxo database.
+func NewCoinStakeSource(outPoint *btcwire.OutPoint, u *utxo.UTXO) *CoinStakeSource {
+	return &CoinStakeSource{
+		BlockTime:     int64(u.BlockTime),
+		StakeModifier: u.StakeModifier,
+		TxOffset:      u.OffsetInBlock,
+		TxTime:        int64(u.Time),
+		TxSha:         outPoint.Hash.Bytes(),
+		Outputs: map[string]*TxOut{
+			strconv.FormatUint(uint64(outPoint.Index), 10): {Value: int64(u.Value), PkScript: u.PkScript},
+		},
+	}
+}
+
+// StakePlan is the coinstake a StakePolicy would build.
+type StakePlan struct {
+	TxTime int64
+	Kernel StakeInput
+	Extra  []StakeInput
+	// Value is the inputs' value.
+	Value   int64
+	CoinAge uint64
+	Reward  int64
+	// Outputs are the values of the stake outputs, two if split.
+	Outputs []int64
+	// Balance is the candidates' value and Available the part of it
+	// above the reserve balance.
+	Balance   int64
+	Available int64
+}
+
+// Split tells if the plan splits the stake output.
+func (p *StakePlan) Split() bool {
+	return len(p.Outputs) > 1
+}
+
+// Plan decides the coinstake with time txTime staking candidate kernel.
+// The candidates are an address's outputs as returned by utxo.Store.FetchCoins.
+func (p *StakePolicy) Plan(net *Network, outPoints []*btcwire.OutPoint, utxos []*utxo.UTXO,
+	kernel int, txTime int64) (*StakePlan, error) {
+	if len(outPoints) != len(utxos) {
+		return nil, fmt.Errorf("%d outpoints for %d utxos", len(outPoints), len(utxos))
+	}
+	if kernel < 0 || kernel >= len(utxos) {
+		return nil, fmt.Errorf("kernel %d out of %d candidates", kernel, len(utxos))
+	}
+	plan := &StakePlan{
+		TxTime: txTime,
+		Kernel: StakeInput{Source: NewCoinStakeSource(outPoints[kernel], utxos[kernel]), Index: outPoints[kernel].Index},
+		Value:  int64(utxos[kernel].Value),
+	}
+	for _, u := range utxos {
+		plan.Balance += int64(u.Value)
+	}
+	plan.Available = plan.Balance - p.ReserveBalance
+	if plan.Value > plan.Available {
+		return nil, ErrReserveBalance
+	}
+	coins := []*utxo.UTXO{utxos[kernel]}
+	protocol := net.ProtocolAt(txTime)
+	kernelUTXO := utxos[kernel]
+
+	split := p.SplitThreshold > 0 && int64(kernelUTXO.Value) >= p.SplitThreshold &&
+		(p.SplitAge == 0 || int64(kernelUTXO.BlockTime)+p.SplitAge > txTime)
+	candidates := utxos
+	if split || p.CombineThreshold <= 0 {
+		candidates = nil // a split coinstake doesn't combine
+	}
+	for i, u := range candidates {
+		if i == kernel || string(u.PkScript) != string(kernelUTXO.PkScript) ||
+			outPoints[i].Hash == outPoints[kernel].Hash {
+			continue
+		}
+		if p.MaxInputs > 0 && 1+len(plan.Extra) >= p.MaxInputs {
+			break // too many inputs
+		}
+		if plan.Value > p.CombineThreshold {
+			break // value already significant
+		}
+		if plan.Value+int64(u.Value) > plan.Available {
+			break // reserve reached
+		}
+		if int64(u.Value) > p.CombineThreshold {
+			continue // significant on its own
+		}
+		if int64(u.Time)+protocol.StakeMaxAge() > txTime {
+			continue // would lose coin age
+		}
+		plan.Extra = append(plan.Extra, StakeInput{Source: NewCoinStakeSource(outPoints[i], u), Index: outPoints[i].Index})
+		plan.Value += int64(u.Value)
+		coins = append(coins, u)
+	}
+	var err error
+	if plan.CoinAge, err = CoinAge(coins, txTime, net.StakeMinAge); err != nil {
+		return nil, err
+	}
+	plan.Reward = StakeReward(plan.CoinAge, protocol)
+	credit := plan.Value + plan.Reward
+	if split {
+		half := credit / 2 / cent * cent
+		plan.Outputs = []int64{half, credit - half}
+	} else {
+		plan.Outputs = []int64{credit}
+	}
+	return plan, nil
+}
+
+// PrevScripts returns the scripts of the planned inputs, see SignCoinStake.
+func (p *StakePlan) PrevScripts() [][]byte {
+	var scripts [][]byte
+	for _, in := range append([]StakeInput{p.Kernel}, p.Extra...) {
+		out, _ := in.Source.Output(in.Index)
+		scripts = append(scripts, out.PkScript)
+	}
+	return scripts
+}
+
+// NewCoinStake builds the planned coinstake, see NewCoinStake.
+func (p *StakePlan) NewCoinStake(net *Network, bits uint32) (*btcwire.MsgTx, error) {
+	tx, err := NewCoinStake(net, p.Kernel, p.Extra, p.TxTime, bits)
+	if err != nil {
+		return nil, err
+	}
+	stake := tx.TxOut[1]
+	var total int64
+	for _, v := range p.Outputs {
+		total += v
+	}
+	if stake.Value != total {
+		return nil, fmt.Errorf("planned %d, coinstake pays %d", total, stake.Value)
+	}
+	tx.TxOut = tx.TxOut[:1]
+	for _, v := range p.Outputs {
+		tx.AddTxOut(btcwire.NewTxOut(v, stake.PkScript))
+	}
+	return tx, nil
+}
+
+// String is the dry-run report of the plan.
+func (p *StakePlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "coinstake at %v\n", time.Unix(p.TxTime, 0).UTC().Format("2006-01-02 15:04:05"))
+	for i, in := range append([]StakeInput{p.Kernel}, p.Extra...) {
+		role := "combine"
+		if i == 0 {
+			role = "kernel"
+		}
+		out, _ := in.Source.Output(in.Index)
+		sha, _ := btcwire.NewShaHash(in.Source.TxSha)
+		fmt.Fprintf(&b, "  in  %-7s %v:%v %v\n", role, sha, in.Index, formatCoins(out.Value))
+	}
+	fmt.Fprintf(&b, "  coin age %v coin-days, reward %v\n", p.CoinAge, formatCoins(p.Reward))
+	for _, v := range p.Outputs {
+		fmt.Fprintf(&b, "  out %v\n", formatCoins(v))
+	}
+	if p.Split() {
+		b.WriteString("  stake split\n")
+	}
+	fmt.Fprintf(&b, "  balance %v, available %v", formatCoins(p.Balance), formatCoins(p.Available))
+	return b.String()
+}
+
+// formatCoins formats satoshis as coins.
+func formatCoins(value int64) string {
+	return strconv.FormatFloat(float64(value)/float64(coin), 'f', -1, 64)
+}
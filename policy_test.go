@@ -0,0 +1,95 @@
+package umint_test
+
+import (
+	"errors"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcwire"
+	"strings"
+	"testing"
+)
+
+func TestStakePolicy(t *testing.T) {
+	net := umint.MainNet
+	txTime := int64(1420000000)
+	old, young := uint32(txTime-200*24*60*60), uint32(txTime-40*24*60*60)
+	script := []byte{0x76, 0xa9, 1}
+	coin := func(sha byte, index uint32, value uint64, time uint32, pkScript []byte) (*btcwire.OutPoint, *utxo.UTXO) {
+		var h btcwire.ShaHash
+		h[0] = sha
+		return btcwire.NewOutPoint(&h, index), &utxo.UTXO{
+			BlockTime: time + 10, StakeModifier: 1, OffsetInBlock: 81, Time: time, Value: value, PkScript: pkScript}
+	}
+	var outPoints []*btcwire.OutPoint
+	var utxos []*utxo.UTXO
+	for _, c := range []struct {
+		sha    byte
+		index  uint32
+		value  uint64
+		time   uint32
+		script []byte
+	}{
+		{1, 0, 1000e6, old, script},           // kernel
+		{2, 0, 10e6, old, script},             // combined
+		{3, 0, 20e6, young, script},           // too young to combine
+		{4, 0, 5000e6, old, script},           // too large to combine
+		{5, 0, 10e6, old, []byte{0x76, 0xa9}}, // other script
+		{1, 1, 10e6, old, script},             // kernel's tx
+		{6, 2, 30e6, old, script},             // combined
+	} {
+		o, u := coin(c.sha, c.index, c.value, c.time, c.script)
+		outPoints, utxos = append(outPoints, o), append(utxos, u)
+	}
+
+	policy := umint.StakePolicy{CombineThreshold: 2000e6, MaxInputs: 100}
+	plan, err := policy.Plan(net, outPoints, utxos, 0, txTime)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(plan.Extra) != 2 || plan.Extra[0].Source.TxSha[0] != 2 || plan.Extra[1].Index != 2 {
+		t.Fatalf("wrong combined inputs %+v", plan.Extra)
+	}
+	if plan.Value != 1040e6 || plan.Split() || plan.Outputs[0] != plan.Value+plan.Reward {
+		t.Errorf("wrong plan value %v outputs %v", plan.Value, plan.Outputs)
+	}
+	if plan.Reward != umint.StakeReward(plan.CoinAge, umint.ProtocolV04) || plan.Reward == 0 {
+		t.Errorf("wrong reward %v for %v coin-days", plan.Reward, plan.CoinAge)
+	}
+
+	policy.MaxInputs = 2
+	if plan, err = policy.Plan(net, outPoints, utxos, 0, txTime); err != nil || len(plan.Extra) != 1 {
+		t.Errorf("max inputs ignored: %v", err)
+	}
+	policy.ReserveBalance = plan.Balance - 1005e6
+	if plan, err = policy.Plan(net, outPoints, utxos, 0, txTime); err != nil || len(plan.Extra) != 0 {
+		t.Errorf("combined into reserve: %v", err)
+	}
+	policy.ReserveBalance = plan.Balance - 999e6
+	if _, err = policy.Plan(net, outPoints, utxos, 0, txTime); !errors.Is(err, umint.ErrReserveBalance) {
+		t.Errorf("kernel staked from reserve: %v", err)
+	}
+
+	policy = umint.StakePolicy{SplitThreshold: 500e6, CombineThreshold: 2000e6}
+	plan, err = policy.Plan(net, outPoints, utxos, 0, txTime)
+	if err != nil {
+		t.Fatalf("plan split: %v", err)
+	}
+	if !plan.Split() || len(plan.Extra) != 0 || plan.Outputs[0]%10000 != 0 ||
+		plan.Outputs[0]+plan.Outputs[1] != plan.Value+plan.Reward {
+		t.Fatalf("wrong split %v", plan.Outputs)
+	}
+	if !strings.Contains(plan.String(), "stake split") {
+		t.Errorf("report doesn't mention split:\n%v", plan)
+	}
+	tx, err := plan.NewCoinStake(net, 0x2000ffff)
+	if err != nil {
+		t.Fatalf("build split coinstake: %v", err)
+	}
+	if len(tx.TxOut) != 3 || tx.TxOut[1].Value != plan.Outputs[0] || tx.TxOut[2].Value != plan.Outputs[1] {
+		t.Errorf("wrong split outputs %+v", tx.TxOut)
+	}
+	policy.SplitAge = 30 * 24 * 60 * 60
+	if plan, err = policy.Plan(net, outPoints, utxos, 0, txTime); err != nil || plan.Split() {
+		t.Errorf("old kernel split: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package umint
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Protocol identifies a revision of the peercoin kernel protocol.
+type Protocol int
+
+const (
+	// ProtocolV02 hashes the block bits into the kernel and weights coins
+	// from the output's creation.
+	ProtocolV02 Protocol = iota
+	// ProtocolV03 replaces bits with the stake modifier and starts the
+	// time weight at the stake min age.
+	ProtocolV03
+	// ProtocolV04 enforces coinstake time equal to block time and adds
+	// stake modifier checksums, the kernel itself is hashed as in v0.3.
+	ProtocolV04
+	// ProtocolV05 selects the stake modifier relative to the coinstake
+	// time instead of the time of the block holding the staked output.
+	ProtocolV05
+)
+
+var protocolNames = []string{"v0.2", "v0.3", "v0.4", "v0.5"}
+
+func (p Protocol) String() string {
+	if p >= 0 && int(p) < len(protocolNames) {
+		return protocolNames[p]
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+func (p Protocol) MarshalText() ([]byte, error) {
+	if p < 0 || int(p) >= len(protocolNames) {
+		return nil, fmt.Errorf("unknown protocol %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+func (p *Protocol) UnmarshalText(text []byte) error {
+	for i, name := range protocolNames {
+		if name == string(text) {
+			*p = Protocol(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown protocol %q", text)
+}
+
+// StakeMaxAge is the age after which an output's coin-day weight stops growing.
+func (p Protocol) StakeMaxAge() int64 {
+	return stakeMaxAge
+}
+
+// hashesStakeModifier tells if the kernel preimage starts with the stake
+// modifier (v0.3+) or with the block bits (v0.2).
+func (p Protocol) hashesStakeModifier() bool {
+	return p >= ProtocolV03
+}
+
+// timeWeightReduction is subtracted from the output's age when computing
+// its coin-day weight.
+func (p Protocol) timeWeightReduction(stakeMinAge int64) int64 {
+	if p >= ProtocolV03 {
+		return stakeMinAge
+	}
+	return 0
+}
+
+// Network holds consensus parameters which differ between peercoin networks.
+type Network struct {
+	Name        string
+	StakeMinAge int64
+	// ModifierInterval is the time to elapse before a new stake modifier
+	// is computed.
+	ModifierInterval    int64
+	ModifierCheckpoints ModifierCheckpoints
+	// PowLimit is the easiest target of any block.
+	PowLimit *big.Int
+	// InitialHashTarget is the target of the first two blocks of each kind.
+	InitialHashTarget *big.Int
+	// StakeEntropySwitchHeight is the first block taking its stake entropy
+	// bit from its hash instead of its signature.
+	StakeEntropySwitchHeight int32
+
+	ProtocolV03SwitchTime int64
+	ProtocolV04SwitchTime int64
+	ProtocolV05SwitchTime int64
+}
+
+var (
+	MainNet = &Network{
+		Name:                  "mainnet",
+		StakeMinAge:           30 * int64(day),
+		ModifierInterval:      6 * 60 * 60,
+		ModifierCheckpoints:   MainNetModifierCheckpoints,
+		PowLimit:              targetLimit(32),
+		InitialHashTarget:     targetLimit(40),
+		ProtocolV03SwitchTime: 1363800000,
+		ProtocolV04SwitchTime: 1399300000,
+		ProtocolV05SwitchTime: 1461700000,
+
+		// switch to support p2pool
+		StakeEntropySwitchHeight: 9689,
+	}
+	TestNet = &Network{
+		Name:                  "testnet",
+		StakeMinAge:           int64(day),
+		ModifierInterval:      20 * 60,
+		ModifierCheckpoints:   TestNetModifierCheckpoints,
+		PowLimit:              targetLimit(28),
+		InitialHashTarget:     targetLimit(29),
+		ProtocolV03SwitchTime: 1359781000,
+		ProtocolV04SwitchTime: 1395700000,
+		ProtocolV05SwitchTime: 1447700000,
+	}
+)
+
+// targetLimit returns ~uint256(0) >> shift.
+func targetLimit(shift uint) *big.Int {
+	n := new(big.Int).Lsh(big.NewInt(1), 256-shift)
+	return n.Sub(n, big.NewInt(1))
+}
+
+// ProtocolAt returns the protocol in force on the network at txTime.
+func (n *Network) ProtocolAt(txTime int64) Protocol {
+	switch {
+	case txTime >= n.ProtocolV05SwitchTime:
+		return ProtocolV05
+	case txTime >= n.ProtocolV04SwitchTime:
+		return ProtocolV04
+	case txTime >= n.ProtocolV03SwitchTime:
+		return ProtocolV03
+	}
+	return ProtocolV02
+}
+
+// ProtocolWindow is a window of kernel times [From, To] under Protocol.
+type ProtocolWindow struct {
+	From, To int64
+	Protocol Protocol
+}
+
+// ProtocolWindows splits the kernel times [from, to] at the network's
+// protocol switches.
+func (n *Network) ProtocolWindows(from, to int64) (windows []ProtocolWindow) {
+	for _, switchTime := range []int64{n.ProtocolV03SwitchTime, n.ProtocolV04SwitchTime, n.ProtocolV05SwitchTime} {
+		if switchTime > from && switchTime <= to {
+			windows = append(windows, ProtocolWindow{From: from, To: switchTime - 1, Protocol: n.ProtocolAt(from)})
+			from = switchTime
+		}
+	}
+	return append(windows, ProtocolWindow{From: from, To: to, Protocol: n.ProtocolAt(from)})
+}
@@ -0,0 +1,94 @@
+package umint_test
+
+import (
+	"encoding/json"
+	"github.com/kac-/umint"
+	"reflect"
+	"testing"
+)
+
+func TestProtocolAt(t *testing.T) {
+	tests := []struct {
+		net    *umint.Network
+		time   int64
+		expect umint.Protocol
+	}{
+		{umint.MainNet, 1345083810, umint.ProtocolV02},
+		{umint.MainNet, 1363800000 - 1, umint.ProtocolV02},
+		{umint.MainNet, 1363800000, umint.ProtocolV03},
+		{umint.MainNet, 1399300000, umint.ProtocolV04},
+		{umint.MainNet, 1411634680, umint.ProtocolV04},
+		{umint.MainNet, 1461700000, umint.ProtocolV05},
+		{umint.TestNet, 1363800000, umint.ProtocolV03},
+		{umint.TestNet, 1399300000, umint.ProtocolV04},
+	}
+	for _, test := range tests {
+		if p := test.net.ProtocolAt(test.time); p != test.expect {
+			t.Errorf("%v protocol at %v, have %v want %v", test.net.Name, test.time, p, test.expect)
+		}
+	}
+}
+
+func TestProtocolWindows(t *testing.T) {
+	net := umint.MainNet
+	v04, v05 := net.ProtocolV04SwitchTime, net.ProtocolV05SwitchTime
+	tests := []struct {
+		from, to int64
+		want     []umint.ProtocolWindow
+	}{
+		{v05, v05 + 100, []umint.ProtocolWindow{{v05, v05 + 100, umint.ProtocolV05}}},
+		{v05 - 10, v05 + 10, []umint.ProtocolWindow{
+			{v05 - 10, v05 - 1, umint.ProtocolV04}, {v05, v05 + 10, umint.ProtocolV05}}},
+		{v04 - 1, v05, []umint.ProtocolWindow{
+			{v04 - 1, v04 - 1, umint.ProtocolV03}, {v04, v05 - 1, umint.ProtocolV04}, {v05, v05, umint.ProtocolV05}}},
+	}
+	for _, test := range tests {
+		if windows := net.ProtocolWindows(test.from, test.to); !reflect.DeepEqual(windows, test.want) {
+			t.Errorf("windows of [%d, %d]: have %v want %v", test.from, test.to, windows, test.want)
+		}
+	}
+}
+
+func TestProtocolText(t *testing.T) {
+	for p := umint.ProtocolV02; p <= umint.ProtocolV05; p++ {
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Errorf("marshal %v: %v", p, err)
+			continue
+		}
+		var p2 umint.Protocol
+		if err = json.Unmarshal(b, &p2); err != nil || p2 != p {
+			t.Errorf("round trip %s, have %v want %v (err %v)", b, p2, p, err)
+		}
+	}
+	var p umint.Protocol
+	if err := json.Unmarshal([]byte(`"v9.9"`), &p); err == nil {
+		t.Errorf("unknown protocol accepted")
+	}
+}
+
+func TestProtocolV02Kernel(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &tpl)
+	if err != nil {
+		t.Errorf("unmarshalling: %v", err)
+		return
+	}
+	tpl.Protocol = umint.ProtocolV02
+	_, success, err, _ := umint.CheckStakeKernelHash(&tpl)
+	if err != nil {
+		t.Errorf("checking v0.2 template: %v", err)
+		return
+	}
+	if success {
+		t.Errorf("v0.3 kernel accepted under v0.2 rules")
+	}
+	// v0.2 hashes bits, the modifier must not matter
+	tpl.Bits = umint.BigToCompact(umint.DiffToTarget(0.01))
+	hash0, _, _, _ := umint.CheckStakeKernelHash(&tpl)
+	tpl.StakeModifier++
+	hash1, _, _, _ := umint.CheckStakeKernelHash(&tpl)
+	if string(hash0) != string(hash1) {
+		t.Errorf("v0.2 kernel depends on stake modifier")
+	}
+}
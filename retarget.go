@@ -0,0 +1,79 @@
+package umint
+
+import (
+	"math/big"
+)
+
+const (
+	// StakeTargetSpacing is the targeted time between proof-of-stake blocks.
+	StakeTargetSpacing int64 = 10 * 60
+	// targetSpacingWorkMax caps the proof-of-work target spacing.
+	targetSpacingWorkMax = 12 * StakeTargetSpacing
+	// targetTimespan is the time over which the exponential moving
+	// adjustment averages.
+	targetTimespan int64 = 7 * 24 * 60 * 60
+)
+
+// RetargetBlock is a main chain block as seen by the difficulty retargeting.
+// Prev must return an untyped nil for the genesis block.
+type RetargetBlock interface {
+	Height() int32
+	Time() int64
+	Bits() uint32
+	IsProofOfStake() bool
+	Prev() RetargetBlock
+}
+
+// lastRetargetBlock returns the last block of the requested kind up to b,
+// or the genesis block if there is none.
+func lastRetargetBlock(b RetargetBlock, proofOfStake bool) RetargetBlock {
+	for b.IsProofOfStake() != proofOfStake {
+		prev := b.Prev()
+		if prev == nil {
+			break
+		}
+		b = prev
+	}
+	return b
+}
+
+// Retarget moves bits toward the target spacing given the spacing
+// actually observed between the last two blocks of the kind, as ppcoind does
+// on every block.
+func Retarget(bits uint32, actualSpacing, targetSpacing int64, limit *big.Int) uint32 {
+	interval := targetTimespan / targetSpacing
+	bnNew := CompactToBig(bits)
+	bnNew.Mul(bnNew, big.NewInt((interval-1)*targetSpacing+actualSpacing+actualSpacing))
+	bnNew.Div(bnNew, big.NewInt((interval+1)*targetSpacing))
+	if bnNew.Cmp(limit) > 0 {
+		bnNew.Set(limit)
+	}
+	return BigToCompact(bnNew)
+}
+
+// NextTargetRequired returns the compact target of the next proof-of-stake
+// (or proof-of-work) block following last, last is nil for the genesis block.
+func NextTargetRequired(net *Network, last RetargetBlock, proofOfStake bool) uint32 {
+	if last == nil {
+		return BigToCompact(net.PowLimit) // genesis block
+	}
+	prev := lastRetargetBlock(last, proofOfStake)
+	if prev.Prev() == nil {
+		return BigToCompact(net.InitialHashTarget) // first block
+	}
+	prevPrev := lastRetargetBlock(prev.Prev(), proofOfStake)
+	if prevPrev.Prev() == nil {
+		return BigToCompact(net.InitialHashTarget) // second block
+	}
+	actualSpacing := prev.Time() - prevPrev.Time()
+
+	targetSpacing := StakeTargetSpacing
+	if !proofOfStake {
+		targetSpacing = StakeTargetSpacing * int64(1+last.Height()-prev.Height())
+		if targetSpacing > targetSpacingWorkMax {
+			targetSpacing = targetSpacingWorkMax
+		}
+	}
+	// ppcoind caps both kinds at the proof-of-work limit
+	return Retarget(prev.Bits(), actualSpacing, targetSpacing, net.PowLimit)
+}
@@ -0,0 +1,74 @@
+package umint_test
+
+import (
+	"github.com/kac-/umint"
+	"math/big"
+	"testing"
+)
+
+type retargetBlock struct {
+	height int32
+	time   int64
+	bits   uint32
+	pos    bool
+	prev   *retargetBlock
+}
+
+func (b *retargetBlock) Height() int32        { return b.height }
+func (b *retargetBlock) Time() int64          { return b.time }
+func (b *retargetBlock) Bits() uint32         { return b.bits }
+func (b *retargetBlock) IsProofOfStake() bool { return b.pos }
+func (b *retargetBlock) Prev() umint.RetargetBlock {
+	if b.prev == nil {
+		return nil
+	}
+	return b.prev
+}
+
+func (b *retargetBlock) next(spacing int64, pos bool, bits uint32) *retargetBlock {
+	return &retargetBlock{height: b.height + 1, time: b.time + spacing, bits: bits, pos: pos, prev: b}
+}
+
+func TestNextTargetRequired(t *testing.T) {
+	net := umint.MainNet
+	if bits := umint.NextTargetRequired(net, nil, true); bits != 0x1d00ffff {
+		t.Errorf("genesis: have %08x", bits)
+	}
+	tip := &retargetBlock{time: 1400000000, bits: 0x1d00ffff}
+	// first and second stake blocks use the initial target
+	for i := 0; i < 2; i++ {
+		bits := umint.NextTargetRequired(net, tip, true)
+		if bits != 0x1c00ffff {
+			t.Errorf("stake block %v: have %08x", i, bits)
+		}
+		tip = tip.next(600, true, bits)
+	}
+	// at target spacing the target stays
+	bits := umint.NextTargetRequired(net, tip, true)
+	if bits != 0x1c00ffff {
+		t.Errorf("on spacing: have %08x", bits)
+	}
+	// proof-of-work blocks in between are skipped
+	tip = tip.next(1200, false, 0x1d00ffff).next(1200, true, 0x1c00ffff)
+	slow := umint.NextTargetRequired(net, tip, true)
+	if umint.CompactToBig(slow).Cmp(umint.CompactToBig(0x1c00ffff)) <= 0 {
+		t.Errorf("slow blocks didn't ease the target: %08x", slow)
+	}
+	// target *= (1007*600 + 2*2400) / (1009*600)
+	want := umint.CompactToBig(0x1c00ffff)
+	want.Mul(want, big.NewInt(1007*600+2*2400))
+	want.Div(want, big.NewInt(1009*600))
+	if slow != umint.BigToCompact(want) {
+		t.Errorf("slow: have %08x want %08x", slow, umint.BigToCompact(want))
+	}
+	tip = tip.next(10, true, slow)
+	if fast := umint.NextTargetRequired(net, tip, true); umint.CompactToBig(fast).Cmp(umint.CompactToBig(slow)) >= 0 {
+		t.Errorf("fast blocks didn't harden the target: %08x", fast)
+	}
+}
+
+func TestRetargetLimit(t *testing.T) {
+	if bits := umint.Retarget(0x1d00ffff, 100*24*60*60, umint.StakeTargetSpacing, umint.MainNet.PowLimit); bits != 0x1d00ffff {
+		t.Errorf("target above limit: %08x", bits)
+	}
+}
@@ -0,0 +1,47 @@
+package umint
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kac-/umint/utxo"
+	"math/big"
+)
+
+// ErrTxTime is returned by CoinAge for an input from after the coinstake.
+var ErrTxTime = errors.New("GetCoinAge() : transaction timestamp violation")
+
+const (
+	cent int64 = 10000
+	// rewardCoinYear is the creation amount per coin-year (1%).
+	rewardCoinYear = cent
+)
+
+// StakeReward returns the amount (in satoshis) minted by a coinstake spending
+// coinAge coin-days. The reward is 1% per coin-year with leap years averaged
+// into 365+8/33 days, rounded down to a whole cent. protocol is the protocol
+// of the coinstake: no protocol up to v0.5 changes the rule, so it's unused.
+func StakeReward(coinAge uint64, protocol Protocol) int64 {
+	return int64(coinAge*33/(365*33+8)) * rewardCoinYear
+}
+
+// CoinAge returns the coin age, in coin-days, of a coinstake with time txTime
+// spending inputs. As in ppcoind, inputs younger than stakeMinAge don't count,
+// an input from after txTime fails with ErrTxTime, and the sum is computed in
+// cent-seconds before being rounded down to coin-days.
+func CoinAge(inputs []*utxo.UTXO, txTime int64, stakeMinAge int64) (uint64, error) {
+	centSeconds := new(big.Int)
+	for i, in := range inputs {
+		if txTime < int64(in.Time) {
+			return 0, fmt.Errorf("%w: input %d time %d after tx time %d", ErrTxTime, i, in.Time, txTime)
+		}
+		if int64(in.BlockTime)+stakeMinAge > txTime {
+			continue // only count coins meeting min age requirement
+		}
+		centSeconds.Add(centSeconds, new(big.Int).Div(
+			new(big.Int).Mul(new(big.Int).SetUint64(in.Value), big.NewInt(txTime-int64(in.Time))),
+			big.NewInt(cent)))
+	}
+	coinDays := centSeconds.Mul(centSeconds, big.NewInt(cent))
+	coinDays.Div(coinDays, big.NewInt(coinDay))
+	return coinDays.Uint64(), nil
+}
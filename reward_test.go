@@ -0,0 +1,51 @@
+package umint_test
+
+import (
+	"errors"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"testing"
+)
+
+func TestStakeReward(t *testing.T) {
+	tests := []struct {
+		coinAge uint64
+		reward  int64
+	}{
+		{0, 0},
+		{365, 0}, // a coin-year is 365+8/33 days
+		{366, 10000},
+		{10000, 270000},
+		{1000000, 27370000},
+	}
+	for _, test := range tests {
+		if r := umint.StakeReward(test.coinAge, umint.ProtocolV04); r != test.reward {
+			t.Errorf("wrong reward for %v coin-days, have %v want %v", test.coinAge, r, test.reward)
+		}
+	}
+}
+
+func TestCoinAge(t *testing.T) {
+	const day = 24 * 60 * 60
+	t0 := uint32(1400000000)
+	minAge := int64(30 * day)
+	txTime := int64(t0) + 100*day
+	inputs := []*utxo.UTXO{
+		{BlockTime: t0, Time: t0, Value: 100000000},                   // 100 PPC, 100 days
+		{BlockTime: t0 + 50*day, Time: t0 + 50*day, Value: 50000000},  // 50 PPC, 50 days
+		{BlockTime: t0 + 90*day, Time: t0 + 90*day, Value: 900000000}, // immature
+	}
+	if age, err := umint.CoinAge(inputs, txTime, minAge); err != nil || age != 100*100+50*50 {
+		t.Errorf("wrong coin age, have %v want %v: %v", age, 100*100+50*50, err)
+	}
+	// an input after tx time invalidates the coinstake
+	late := append(inputs, &utxo.UTXO{BlockTime: t0, Time: uint32(txTime) + 1, Value: 900000000})
+	if _, err := umint.CoinAge(late, txTime, minAge); !errors.Is(err, umint.ErrTxTime) {
+		t.Errorf("input after tx time: %v", err)
+	}
+	// cent-second rounding of tiny inputs
+	tiny := []*utxo.UTXO{{BlockTime: t0, Time: t0, Value: 9999}}
+	if age, err := umint.CoinAge(tiny, txTime, minAge); err != nil || age != 0 {
+		t.Errorf("wrong coin age of sub-cent input, have %v want 0: %v", age, err)
+	}
+}
@@ -0,0 +1,283 @@
+// Package rpc is a ppcoind JSON-RPC client.
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Error is an error returned by ppcoind.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ppcoind error %d: %v", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+	ID     uint64          `json:"id"`
+}
+
+// Client calls a ppcoind's JSON-RPC interface.
+type Client struct {
+	URL      string
+	User     string
+	Password string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Record, if set, receives every call and its response as a Recording
+	// line, replayable by MockServer.
+	Record io.Writer
+
+	mu     sync.Mutex
+	lastID uint64
+}
+
+// NewClient returns a client of the ppcoind listening at url.
+func NewClient(url, user, password string) *Client {
+	return &Client{URL: url, User: user, Password: password}
+}
+
+// Call calls method with params and unmarshals its result into result.
+func (c *Client) Call(method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	c.mu.Lock()
+	c.lastID++
+	id := c.lastID
+	c.mu.Unlock()
+	body, err := json.Marshal(&request{JSONRPC: "1.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("%v: %w", method, err)
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%v: %w", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.User != "" || c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%v: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var r response
+	// ppcoind answers errors with status 500 and a JSON body
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%v: %v: %w", method, resp.Status, err)
+	}
+	if c.Record != nil {
+		if err := writeRecording(c.Record, method, params, &r); err != nil {
+			return fmt.Errorf("%v: record: %w", method, err)
+		}
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	if result != nil {
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return fmt.Errorf("%v: result: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// Difficulty is the result of getdifficulty.
+type Difficulty struct {
+	ProofOfWork    float64 `json:"proof-of-work"`
+	ProofOfStake   float64 `json:"proof-of-stake"`
+	SearchInterval int64   `json:"search-interval"`
+}
+
+// Info is the result of getinfo.
+type Info struct {
+	Version         string     `json:"version"`
+	ProtocolVersion int        `json:"protocolversion"`
+	WalletVersion   int        `json:"walletversion"`
+	Balance         float64    `json:"balance"`
+	NewMint         float64    `json:"newmint"`
+	Stake           float64    `json:"stake"`
+	Blocks          int64      `json:"blocks"`
+	MoneySupply     float64    `json:"moneysupply"`
+	Connections     int        `json:"connections"`
+	Proxy           string     `json:"proxy"`
+	IP              string     `json:"ip"`
+	Difficulty      Difficulty `json:"difficulty"`
+	Testnet         bool       `json:"testnet"`
+	KeyPoolOldest   int64      `json:"keypoololdest"`
+	KeyPoolSize     int        `json:"keypoolsize"`
+	PayTxFee        float64    `json:"paytxfee"`
+	Errors          string     `json:"errors"`
+}
+
+// Block is the result of getblock.
+type Block struct {
+	Hash              string   `json:"hash"`
+	Confirmations     int64    `json:"confirmations"`
+	Size              int      `json:"size"`
+	Height            int64    `json:"height"`
+	Version           int32    `json:"version"`
+	MerkleRoot        string   `json:"merkleroot"`
+	Mint              float64  `json:"mint"`
+	Time              int64    `json:"time"`
+	Nonce             uint32   `json:"nonce"`
+	Bits              string   `json:"bits"`
+	Difficulty        float64  `json:"difficulty"`
+	PreviousBlockHash string   `json:"previousblockhash"`
+	NextBlockHash     string   `json:"nextblockhash"`
+	Flags             string   `json:"flags"`
+	ProofHash         string   `json:"proofhash"`
+	EntropyBit        uint32   `json:"entropybit"`
+	Modifier          string   `json:"modifier"`
+	ModifierChecksum  string   `json:"modifierchecksum"`
+	Tx                []string `json:"tx"`
+}
+
+// IsProofOfStake tells if the block is flagged proof-of-stake.
+func (b *Block) IsProofOfStake() bool {
+	return len(b.Flags) >= 14 && b.Flags[:14] == "proof-of-stake"
+}
+
+// GeneratedStakeModifier tells if the block is flagged as generating a stake
+// modifier.
+func (b *Block) GeneratedStakeModifier() bool {
+	return strings.Contains(b.Flags, "stake-modifier")
+}
+
+// CompactBits returns the block's bits.
+func (b *Block) CompactBits() (uint32, error) {
+	bits, err := strconv.ParseUint(b.Bits, 16, 32)
+	return uint32(bits), err
+}
+
+// StakeModifier returns the block's stake modifier.
+func (b *Block) StakeModifier() (uint64, error) {
+	return strconv.ParseUint(b.Modifier, 16, 64)
+}
+
+// Unspent is an output listed by listunspent.
+type Unspent struct {
+	TxID          string  `json:"txid"`
+	Vout          uint32  `json:"vout"`
+	Address       string  `json:"address"`
+	Account       string  `json:"account"`
+	ScriptPubKey  string  `json:"scriptPubKey"`
+	Amount        float64 `json:"amount"`
+	Confirmations int64   `json:"confirmations"`
+}
+
+// GetInfo calls getinfo.
+func (c *Client) GetInfo() (*Info, error) {
+	var info Info
+	if err := c.Call("getinfo", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// GetDifficulty calls getdifficulty.
+func (c *Client) GetDifficulty() (*Difficulty, error) {
+	var diff Difficulty
+	if err := c.Call("getdifficulty", &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// GetBlockCount returns the height of the best block.
+func (c *Client) GetBlockCount() (int64, error) {
+	var count int64
+	err := c.Call("getblockcount", &count)
+	return count, err
+}
+
+// GetBlockHash returns the hash of the main chain block at height.
+func (c *Client) GetBlockHash(height int64) (string, error) {
+	var hash string
+	err := c.Call("getblockhash", &hash, height)
+	return hash, err
+}
+
+// GetBlock returns the block with hash.
+func (c *Client) GetBlock(hash string) (*Block, error) {
+	var block Block
+	if err := c.Call("getblock", &block, hash); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// GetStakeModifier returns the stake modifier of the block with hash.
+// ppcoind has no dedicated call, the modifier is read from getblock.
+func (c *Client) GetStakeModifier(hash string) (uint64, error) {
+	block, err := c.GetBlock(hash)
+	if err != nil {
+		return 0, err
+	}
+	modifier, err := block.StakeModifier()
+	if err != nil {
+		return 0, fmt.Errorf("block %v modifier %q: %w", hash, block.Modifier, err)
+	}
+	return modifier, nil
+}
+
+// ListUnspent lists the wallet's outputs with confirmations between
+// minConf and maxConf, paying to addrs if any.
+func (c *Client) ListUnspent(minConf, maxConf int, addrs ...string) ([]Unspent, error) {
+	var unspent []Unspent
+	params := []interface{}{minConf, maxConf}
+	if len(addrs) > 0 {
+		params = append(params, addrs)
+	}
+	if err := c.Call("listunspent", &unspent, params...); err != nil {
+		return nil, err
+	}
+	return unspent, nil
+}
+
+// GetRawTransaction returns the serialized transaction with txid.
+func (c *Client) GetRawTransaction(txid string) ([]byte, error) {
+	var raw string
+	if err := c.Call("getrawtransaction", &raw, txid); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(raw)
+}
+
+// SubmitBlock submits a serialized block, a rejection is returned as an
+// error.
+func (c *Client) SubmitBlock(block []byte) error {
+	var result *string
+	if err := c.Call("submitblock", &result, hex.EncodeToString(block)); err != nil {
+		return err
+	}
+	if result != nil {
+		return fmt.Errorf("submitblock: %v", *result)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Recording is a call and ppcoind's response to it, as written by
+// Client.Record one per line.
+type Recording struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// key returns the key a recording is replayed for, recordings without
+// params answer any call of their method.
+func (r *Recording) key() string {
+	if len(r.Params) == 0 {
+		return r.Method
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, r.Params); err != nil {
+		return r.Method + " " + string(r.Params)
+	}
+	return r.Method + " " + buf.String()
+}
+
+func writeRecording(w io.Writer, method string, params []interface{}, resp *response) error {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(&Recording{Method: method, Params: rawParams, Result: resp.Result, Error: resp.Error})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// LoadRecordings reads recordings written by Client.Record.
+func LoadRecordings(r io.Reader) ([]Recording, error) {
+	var recordings []Recording
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Recording
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+		recordings = append(recordings, rec)
+	}
+	return recordings, scanner.Err()
+}
+
+// MockServer is an in-process ppcoind replaying recorded responses. Calls
+// matching several recordings get them in order, the last one repeating.
+type MockServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	replies map[string][]Recording
+	calls   []string
+}
+
+// NewMockServer starts a server replaying recordings, Close it when done.
+func NewMockServer(recordings []Recording) *MockServer {
+	s := &MockServer{replies: make(map[string][]Recording)}
+	for _, rec := range recordings {
+		s.Add(rec)
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Add queues a recording.
+func (s *MockServer) Add(rec Recording) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := rec.key()
+	s.replies[key] = append(s.replies[key], rec)
+}
+
+// Calls returns the methods called so far.
+func (s *MockServer) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// Client returns a client of s.
+func (s *MockServer) Client() *Client {
+	return NewClient(s.URL, "", "")
+}
+
+func (s *MockServer) reply(rec *Recording) (*Recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, rec.Method)
+	for _, key := range []string{rec.key(), rec.Method} {
+		queue := s.replies[key]
+		if len(queue) == 0 {
+			continue
+		}
+		if len(queue) > 1 {
+			s.replies[key] = queue[1:]
+		}
+		return &queue[0], true
+	}
+	return nil, false
+}
+
+func (s *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+		ID     json.RawMessage `json:"id"`
+	}{Result: json.RawMessage("null"), ID: req.ID}
+	rec, ok := s.reply(&Recording{Method: req.Method, Params: req.Params})
+	switch {
+	case !ok:
+		resp.Error = &Error{Code: -32601, Message: "Method not found"}
+	case rec.Error != nil:
+		resp.Error = rec.Error
+	case len(rec.Result) > 0:
+		resp.Result = rec.Result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,194 @@
+package umint
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+const defaultScanChunk int64 = 6 * 60 * 60
+
+// ScanJob is a single kernel template scanned over the [From, To] window.
+// Template's TxTime is ignored.
+type ScanJob struct {
+	Template StakeKernelTemplate
+	From     int64
+	To       int64
+}
+
+// ScanResult is a hit (or an error) for the job at index Job.
+type ScanResult struct {
+	Job int
+	Hit *KernelHit
+	Err error
+}
+
+// Scanner runs FindStakes for many jobs on a pool of workers. Each job's
+// window is split into chunks of ChunkSize seconds which are scanned
+// concurrently, results are nevertheless delivered in job order and, within
+// a job, in time order.
+type Scanner struct {
+	// Workers is the number of scanning goroutines, runtime.NumCPU() if <= 0.
+	Workers int
+	// ChunkSize is the number of seconds scanned by a single work unit.
+	ChunkSize int64
+	// Progress, if set, is called after every chunk with the number of
+	// seconds scanned so far and the total number of seconds to scan.
+	Progress func(done, total int64)
+}
+
+type scanChunk struct {
+	job      int
+	from, to int64
+	// resolved chunks need no scanning, their results are known upfront
+	resolved bool
+	results  chan []ScanResult
+}
+
+func newScanChunk(job int, from, to int64) *scanChunk {
+	return &scanChunk{job: job, from: from, to: to, results: make(chan []ScanResult, 1)}
+}
+
+func resolvedScanChunk(job int, from, to int64, results []ScanResult) *scanChunk {
+	c := newScanChunk(job, from, to)
+	c.resolved = true
+	c.results <- results
+	return c
+}
+
+// stakeWindow narrows [from, to] to seconds at which the template's output
+// may stake at all.
+func stakeWindow(t *StakeKernelTemplate, from, to int64) (int64, int64) {
+	if from < t.PrevTxTime {
+		from = t.PrevTxTime
+	}
+	if from < t.BlockFromTime+t.StakeMinAge {
+		from = t.BlockFromTime + t.StakeMinAge
+	}
+	return from, to
+}
+
+// Scan starts scanning jobs and returns the channel on which results are
+// streamed. The channel is closed when all jobs are done or ctx is cancelled,
+// callers should check ctx.Err() to tell the two apart.
+func (s *Scanner) Scan(ctx context.Context, jobs []ScanJob) <-chan ScanResult {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultScanChunk
+	}
+
+	var (
+		chunks []*scanChunk
+		total  int64
+	)
+	for i := range jobs {
+		if jobs[i].From > jobs[i].To {
+			chunks = append(chunks, resolvedScanChunk(i, 1, 0,
+				[]ScanResult{{Job: i, Err: errFromAfterTo}}))
+			continue
+		}
+		total += jobs[i].To - jobs[i].From + 1
+		if err := checkTemplate(&jobs[i].Template); err != nil {
+			chunks = append(chunks, resolvedScanChunk(i, jobs[i].From, jobs[i].To,
+				[]ScanResult{{Job: i, Err: err}}))
+			continue
+		}
+		from, to := stakeWindow(&jobs[i].Template, jobs[i].From, jobs[i].To)
+		if from > jobs[i].From { // skipped part counts as done
+			skipTo := from - 1
+			if skipTo > to {
+				skipTo = to
+			}
+			chunks = append(chunks, resolvedScanChunk(i, jobs[i].From, skipTo, nil))
+		}
+		for ; from <= to; from += chunkSize {
+			c := newScanChunk(i, from, from+chunkSize-1)
+			if c.to > to {
+				c.to = to
+			}
+			chunks = append(chunks, c)
+		}
+	}
+
+	out := make(chan ScanResult)
+	work := make(chan *scanChunk)
+	// limits how far workers may run ahead of the slowest pending chunk
+	window := make(chan struct{}, 4*workers)
+
+	go func() { // feeder
+		defer close(work)
+		for _, c := range chunks {
+			if c.resolved {
+				continue
+			}
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case work <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				if ctx.Err() != nil {
+					return
+				}
+				ks := newKernelSearch(&jobs[c.job].Template)
+				var results []ScanResult
+				for txTime := c.from; txTime <= c.to; txTime++ {
+					if hit := ks.check(txTime); hit != nil {
+						results = append(results, ScanResult{Job: c.job, Hit: hit})
+					}
+				}
+				c.results <- results
+			}
+		}()
+	}
+
+	go func() { // emitter, restores chunk order
+		defer close(out)
+		var done int64
+		for _, c := range chunks {
+			var results []ScanResult
+			select {
+			case results = <-c.results:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+			if !c.resolved {
+				<-window
+			}
+			if c.from <= c.to {
+				done += c.to - c.from + 1
+			}
+			for _, r := range results {
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					wg.Wait()
+					return
+				}
+			}
+			if s.Progress != nil {
+				s.Progress(done, total)
+			}
+		}
+		wg.Wait()
+	}()
+	return out
+}
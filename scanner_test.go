@@ -0,0 +1,82 @@
+package umint_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/kac-/umint"
+	"testing"
+)
+
+func scanJobs(t *testing.T) []umint.ScanJob {
+	tpl := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &tpl)
+	if err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	tpl.Bits = umint.BigToCompact(umint.DiffToTarget(0.1))
+	var jobs []umint.ScanJob
+	for i := uint32(0); i < 5; i++ {
+		job := umint.ScanJob{Template: tpl, From: tpl.TxTime - 5000, To: tpl.TxTime + 5000}
+		job.Template.PrevTxOutIndex = i
+		jobs = append(jobs, job)
+	}
+	// partially immature window
+	matures := tpl.BlockFromTime + tpl.StakeMinAge
+	jobs = append(jobs, umint.ScanJob{Template: tpl, From: matures - 3000, To: matures + 3000})
+	return jobs
+}
+
+func TestScannerOrder(t *testing.T) {
+	jobs := scanJobs(t)
+	var want []*umint.KernelHit
+	var wantJob []int
+	for i := range jobs {
+		hits, err := umint.FindStakes(&jobs[i].Template, jobs[i].From, jobs[i].To)
+		if err != nil {
+			t.Fatalf("find stakes: %v", err)
+		}
+		for _, hit := range hits {
+			want = append(want, hit)
+			wantJob = append(wantJob, i)
+		}
+	}
+	var lastDone, lastTotal int64
+	scanner := umint.Scanner{Workers: 4, ChunkSize: 777, Progress: func(done, total int64) {
+		lastDone, lastTotal = done, total
+	}}
+	i := 0
+	for r := range scanner.Scan(context.Background(), jobs) {
+		if r.Err != nil {
+			t.Fatalf("scan error: %v", r.Err)
+		}
+		if i >= len(want) {
+			t.Fatalf("too many results")
+		}
+		if r.Job != wantJob[i] || r.Hit.TxTime != want[i].TxTime || !bytes.Equal(r.Hit.Hash, want[i].Hash) {
+			t.Fatalf("result %v out of order, have %v@%v want %v@%v",
+				i, r.Job, r.Hit.TxTime, wantJob[i], want[i].TxTime)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("wrong number of results, have %v want %v", i, len(want))
+	}
+	if lastDone != lastTotal || lastTotal != 5*10001+6001 {
+		t.Errorf("wrong progress, have %v/%v want %v", lastDone, lastTotal, 5*10001+6001)
+	}
+}
+
+func TestScannerCancel(t *testing.T) {
+	jobs := scanJobs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	scanner := umint.Scanner{Workers: 2, ChunkSize: 100}
+	results := scanner.Scan(ctx, jobs)
+	<-results
+	cancel()
+	for range results {
+	}
+	if ctx.Err() == nil {
+		t.Errorf("context not cancelled")
+	}
+}
@@ -0,0 +1,182 @@
+package umint
+
+import (
+	"errors"
+	"github.com/btcsuite/fastsha256"
+	"hash"
+	"math/big"
+)
+
+var errFromAfterTo = errors.New("FindStakes() : from after to")
+
+// KernelHit is a single successful kernel found by FindStakes.
+type KernelHit struct {
+	TxTime int64
+	// Hash is the kernel hash in the same (big-endian) byte order
+	// as returned by CheckStakeKernelHash.
+	Hash      []byte
+	MinTarget *big.Int
+	// MaxBits and MaxDiff are the highest compact bits and difficulty
+	// at which this kernel still succeeds.
+	MaxBits uint32
+	MaxDiff *Difficulty
+}
+
+// kernelSearch holds everything CheckStakeKernelHash computes which does not
+// depend on the template's TxTime, so scanning a time window only has to
+// rewrite the last 4 bytes of the preimage and hash it.
+type kernelSearch struct {
+	tpl              StakeKernelTemplate
+	preimage         []byte
+	hasher           hash.Hash
+	sum              []byte
+	targetPerCoinDay *big.Int
+	timeReduction    int64
+	maxAge           int64
+	// cappedWeight and cappedTarget are valid once TxTime-PrevTxTime
+	// reaches maxAge and the coin-day weight stops growing.
+	cappedWeight *big.Int
+	cappedTarget *big.Int
+
+	weight  *big.Int
+	target  *big.Int
+	hashInt *big.Int
+	// coin-day weight and target of the last hashed time
+	curWeight *big.Int
+	curTarget *big.Int
+}
+
+func newKernelSearch(t *StakeKernelTemplate) *kernelSearch {
+	s := &kernelSearch{
+		tpl:              *t,
+		hasher:           fastsha256.New(),
+		sum:              make([]byte, 0, 32),
+		targetPerCoinDay: CompactToBig(t.Bits),
+		weight:           new(big.Int),
+		target:           new(big.Int),
+		hashInt:          new(big.Int),
+	}
+	s.timeReduction = t.Protocol.timeWeightReduction(t.StakeMinAge)
+	s.maxAge = t.Protocol.StakeMaxAge()
+	s.cappedWeight = coinDayWeight(t.PrevTxOutValue, s.maxAge-s.timeReduction)
+	s.cappedTarget = new(big.Int).Mul(s.cappedWeight, s.targetPerCoinDay)
+
+	buf := make([]byte, 28)
+	o := 0
+	if t.Protocol.hashesStakeModifier() {
+		d := t.StakeModifier
+		for i := 0; i < 8; i++ {
+			buf[o] = byte(d & 0xff)
+			d >>= 8
+			o++
+		}
+	} else {
+		d := t.Bits
+		for i := 0; i < 4; i++ {
+			buf[o] = byte(d & 0xff)
+			d >>= 8
+			o++
+		}
+	}
+	data := [4]uint32{uint32(t.BlockFromTime), uint32(t.PrevTxOffset),
+		uint32(t.PrevTxTime), uint32(t.PrevTxOutIndex)}
+	for _, d := range data {
+		for i := 0; i < 4; i++ {
+			buf[o] = byte(d & 0xff)
+			d >>= 8
+			o++
+		}
+	}
+	s.preimage = buf[:o+4]
+	return s
+}
+
+// coinDayWeight returns value*timeWeight expressed in coin-days, the same way
+// CheckStakeKernelHash computes it.
+func coinDayWeight(value, timeWeight int64) *big.Int {
+	valueTime := value * timeWeight
+	if valueTime > 0 {
+		return new(big.Int).SetInt64(valueTime / coinDay)
+	}
+	// overflow, calc w/ big.Int
+	return new(big.Int).Div(new(big.Int).
+		Div(
+			new(big.Int).Mul(big.NewInt(value), big.NewInt(timeWeight)),
+			new(big.Int).SetInt64(coin)),
+		big.NewInt(24*60*60))
+}
+
+// hash computes the kernel hash at txTime and tells if it meets the target.
+// It does not validate txTime against the template's time and min age rules,
+// the caller is responsible for it. The big-endian hash, its value, the
+// coin-day weight and the target are left in sum, hashInt, curWeight and
+// curTarget.
+func (s *kernelSearch) hash(txTime int64) bool {
+	o := len(s.preimage) - 4
+	d := uint32(txTime)
+	for i := 0; i < 4; i++ {
+		s.preimage[o+i] = byte(d & 0xff)
+		d >>= 8
+	}
+	s.hasher.Reset()
+	s.hasher.Write(s.preimage)
+	s.sum = s.hasher.Sum(s.sum[:0])
+	s.hasher.Reset()
+	s.hasher.Write(s.sum)
+	s.sum = s.hasher.Sum(s.sum[:0])
+	for i, l := 0, len(s.sum); i < l/2; i++ {
+		s.sum[i], s.sum[l-1-i] = s.sum[l-1-i], s.sum[i]
+	}
+	s.hashInt.SetBytes(s.sum)
+
+	s.curWeight, s.curTarget = s.cappedWeight, s.cappedTarget
+	nTimeWeight := txTime - s.tpl.PrevTxTime
+	if nTimeWeight < s.maxAge {
+		nTimeWeight -= s.timeReduction
+		valueTime := s.tpl.PrevTxOutValue * nTimeWeight
+		if valueTime > 0 {
+			s.curWeight = s.weight.SetInt64(valueTime / coinDay)
+		} else {
+			s.curWeight = coinDayWeight(s.tpl.PrevTxOutValue, nTimeWeight)
+		}
+		s.curTarget = s.target.Mul(s.curWeight, s.targetPerCoinDay)
+	}
+	return s.hashInt.Cmp(s.curTarget) <= 0
+}
+
+// check tests the kernel at txTime, see hash.
+func (s *kernelSearch) check(txTime int64) (hit *KernelHit) {
+	if !s.hash(txTime) {
+		return nil
+	}
+	hit = &KernelHit{
+		TxTime: txTime,
+		Hash:   append([]byte(nil), s.sum...),
+	}
+	hit.MinTarget = new(big.Int).Sub(new(big.Int).Div(s.hashInt, s.curWeight), big.NewInt(1))
+	hit.MaxBits = IncCompact(BigToCompact(hit.MinTarget))
+	hit.MaxDiff = DiffFromBits(hit.MaxBits)
+	return
+}
+
+// FindStakes checks every second in [from, to] and returns all successful
+// kernels in time order. The template's TxTime is ignored. Seconds at which
+// CheckStakeKernelHash would fail with TimeViolationError or
+// MinAgeViolationError are skipped.
+func FindStakes(t *StakeKernelTemplate, from, to int64) (hits []*KernelHit, err error) {
+	if from > to {
+		err = errFromAfterTo
+		return
+	}
+	if err = checkTemplate(t); err != nil {
+		return
+	}
+	from, to = stakeWindow(t, from, to)
+	s := newKernelSearch(t)
+	for txTime := from; txTime <= to; txTime++ {
+		if hit := s.check(txTime); hit != nil {
+			hits = append(hits, hit)
+		}
+	}
+	return
+}
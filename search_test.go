@@ -0,0 +1,92 @@
+package umint_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kac-/umint"
+	"testing"
+	"time"
+)
+
+func TestFindStakes(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &tpl)
+	if err != nil {
+		t.Errorf("unmarshalling: %v", err)
+		return
+	}
+	// low difficulty so the window has plenty of hits
+	tpl.Bits = umint.BigToCompact(umint.DiffToTarget(0.1))
+	from, to := tpl.TxTime-3000, tpl.TxTime+3000
+	hits, err := umint.FindStakes(&tpl, from, to)
+	if err != nil {
+		t.Errorf("find stakes: %v", err)
+		return
+	}
+	if len(hits) == 0 {
+		t.Errorf("no hits found")
+		return
+	}
+	i := 0
+	for tpl.TxTime = from; tpl.TxTime <= to; tpl.TxTime++ {
+		hash, success, err, minTarget := umint.CheckStakeKernelHash(&tpl)
+		if err != nil {
+			t.Errorf("checking template at %v: %v", tpl.TxTime, err)
+			return
+		}
+		if !success {
+			continue
+		}
+		if i >= len(hits) || hits[i].TxTime != tpl.TxTime {
+			t.Errorf("missing hit at %v", tpl.TxTime)
+			return
+		}
+		if !bytes.Equal(hits[i].Hash, hash) {
+			t.Errorf("wrong hash at %v, have %x want %x", tpl.TxTime, hits[i].Hash, hash)
+			return
+		}
+		if hits[i].MinTarget.Cmp(minTarget) != 0 {
+			t.Errorf("wrong min target at %v, have %v want %v", tpl.TxTime, hits[i].MinTarget, minTarget)
+			return
+		}
+		i++
+	}
+	if i != len(hits) {
+		t.Errorf("wrong number of hits, have %v want %v", len(hits), i)
+	}
+}
+
+func TestFindStakesMinAge(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &tpl)
+	if err != nil {
+		t.Errorf("unmarshalling: %v", err)
+		return
+	}
+	tpl.Bits = umint.BigToCompact(umint.DiffToTarget(0.01))
+	matures := tpl.BlockFromTime + tpl.StakeMinAge
+	hits, err := umint.FindStakes(&tpl, matures-1000, matures+1000)
+	if err != nil {
+		t.Errorf("find stakes: %v", err)
+		return
+	}
+	for _, hit := range hits {
+		if hit.TxTime < matures {
+			t.Errorf("hit before min age: %v", hit.TxTime)
+			return
+		}
+	}
+}
+
+func TestFindStakesPerformance(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &tpl)
+	if err != nil {
+		t.Errorf("unmarshalling: %v", err)
+		return
+	}
+	start := time.Now()
+	umint.FindStakes(&tpl, tpl.TxTime, tpl.TxTime+100000)
+	fmt.Printf("100k seconds search took %v\n", time.Now().Sub(start))
+}
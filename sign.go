@@ -0,0 +1,258 @@
+package umint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mably/btcec"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"time"
+)
+
+const (
+	opChecksig    = 0xac
+	opDup         = 0x76
+	opEqualVerify = 0x88
+	opHash160     = 0xa9
+
+	// SigHashAll is the only signature hash type used by umint.
+	SigHashAll uint32 = 1
+)
+
+// ErrUnsupportedScript is returned when signing an input whose previous
+// output is neither pay-to-pubkey-hash nor pay-to-pubkey.
+var ErrUnsupportedScript = errors.New("unsupported script")
+
+// KeyStore supplies the private keys used to sign coinstakes and blocks.
+type KeyStore interface {
+	// KeyForHash returns the key whose public key hashes (hash160) to
+	// pubKeyHash.
+	KeyForHash(pubKeyHash []byte) (*btcutil.WIF, error)
+}
+
+// pubKeyHashScript returns the hash of a pay-to-pubkey-hash script.
+func pubKeyHashScript(script []byte) ([]byte, bool) {
+	if len(script) == 25 && script[0] == opDup && script[1] == opHash160 && script[2] == 20 &&
+		script[23] == opEqualVerify && script[24] == opChecksig {
+		return script[3:23], true
+	}
+	return nil, false
+}
+
+// pubKeyScript returns the public key of a pay-to-pubkey script.
+func pubKeyScript(script []byte) ([]byte, bool) {
+	if (len(script) == 35 && script[0] == 33 || len(script) == 67 && script[0] == 65) &&
+		script[len(script)-1] == opChecksig {
+		return script[1 : len(script)-1], true
+	}
+	return nil, false
+}
+
+// PayToPubKeyScript returns the pay-to-pubkey script of pubKey.
+func PayToPubKeyScript(pubKey []byte) []byte {
+	return append(pushData(pubKey), opChecksig)
+}
+
+// pushData returns the script pushing data, which must be shorter than 76
+// bytes.
+func pushData(data []byte) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+// scriptKey returns the key able to spend script.
+func scriptKey(script []byte, keys KeyStore) (key *btcutil.WIF, pubKeyHash bool, err error) {
+	if hash, ok := pubKeyHashScript(script); ok {
+		key, err = keys.KeyForHash(hash)
+		return key, true, err
+	}
+	if pubKey, ok := pubKeyScript(script); ok {
+		key, err = keys.KeyForHash(btcutil.Hash160(pubKey))
+		if err == nil && !bytes.Equal(key.SerializePubKey(), pubKey) {
+			err = fmt.Errorf("key for %x serializes differently", pubKey)
+		}
+		return key, false, err
+	}
+	return nil, false, ErrUnsupportedScript
+}
+
+// SignatureHash returns the legacy signature hash of tx's input idx
+// spending an output with subScript.
+func SignatureHash(tx *btcwire.MsgTx, idx int, subScript []byte, hashType uint32) ([]byte, error) {
+	txCopy := *tx
+	txCopy.TxIn = make([]*btcwire.TxIn, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		inCopy := *in
+		inCopy.SignatureScript = nil
+		if i == idx {
+			inCopy.SignatureScript = subScript
+		}
+		txCopy.TxIn[i] = &inCopy
+	}
+	var buf bytes.Buffer
+	if err := txCopy.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	binary.Write(&buf, binary.LittleEndian, hashType)
+	return doubleSha256(buf.Bytes()), nil
+}
+
+// SignCoinStake signs the inputs of coinStake, prevScripts are the scripts
+// of the outputs they spend. Like ppcoind it first turns pay-to-pubkey-hash
+// stake outputs into pay-to-pubkey ones, so the block can be signed with the
+// output's key.
+func SignCoinStake(coinStake *btcwire.MsgTx, prevScripts [][]byte, keys KeyStore) error {
+	if len(prevScripts) != len(coinStake.TxIn) {
+		return fmt.Errorf("%d scripts for %d inputs", len(prevScripts), len(coinStake.TxIn))
+	}
+	for i, out := range coinStake.TxOut {
+		if _, ok := pubKeyHashScript(out.PkScript); !ok {
+			continue
+		}
+		key, _, err := scriptKey(out.PkScript, keys)
+		if err != nil {
+			return fmt.Errorf("output %d: %w", i, err)
+		}
+		out.PkScript = PayToPubKeyScript(key.SerializePubKey())
+	}
+	for i, script := range prevScripts {
+		key, pubKeyHash, err := scriptKey(script, keys)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		hash, err := SignatureHash(coinStake, i, script, SigHashAll)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		sig, err := key.PrivKey.Sign(hash)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		sigScript := pushData(append(sig.Serialize(), byte(SigHashAll)))
+		if pubKeyHash {
+			sigScript = append(sigScript, pushData(key.SerializePubKey())...)
+		}
+		coinStake.TxIn[i].SignatureScript = sigScript
+	}
+	return nil
+}
+
+// merkleRoot returns the merkle root of txs.
+func merkleRoot(txs []*btcwire.MsgTx) (*btcwire.ShaHash, error) {
+	level := make([][]byte, len(txs))
+	for i, tx := range txs {
+		sha, err := tx.TxSha()
+		if err != nil {
+			return nil, err
+		}
+		level[i] = sha[:]
+	}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = doubleSha256(append(append([]byte{}, level[2*i]...), level[2*i+1]...))
+		}
+		level = next
+	}
+	return btcwire.NewShaHash(level[0])
+}
+
+// StakeBlockTemplate is where a new proof-of-stake block attaches.
+type StakeBlockTemplate struct {
+	Version   int32
+	PrevBlock btcwire.ShaHash
+	// Bits is the block's target, see NextTargetRequired.
+	Bits uint32
+}
+
+// NewStakeBlock returns the signed proof-of-stake block holding a coinbase
+// with an empty output and the signed coinStake. The block's time is the
+// coinstake's and it's signed with the key of the coinstake's first stake
+// output, which must pay to a public key.
+func NewStakeBlock(t *StakeBlockTemplate, coinStake *btcwire.MsgTx, keys KeyStore) (*btcwire.MsgBlock, error) {
+	if len(coinStake.TxOut) < 2 {
+		return nil, fmt.Errorf("coinstake with %d outputs", len(coinStake.TxOut))
+	}
+	if _, ok := pubKeyScript(coinStake.TxOut[1].PkScript); !ok {
+		return nil, fmt.Errorf("stake output: %w", ErrUnsupportedScript)
+	}
+	key, _, err := scriptKey(coinStake.TxOut[1].PkScript, keys)
+	if err != nil {
+		return nil, fmt.Errorf("stake output: %w", err)
+	}
+
+	coinBase := btcwire.NewMsgTx()
+	coinBase.Time = coinStake.Time
+	var bits [4]byte
+	binary.LittleEndian.PutUint32(bits[:], t.Bits)
+	coinBase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{}, ^uint32(0)),
+		append(pushData(bits[:]), pushData([]byte{1})...)))
+	coinBase.AddTxOut(btcwire.NewTxOut(0, nil))
+
+	txs := []*btcwire.MsgTx{coinBase, coinStake}
+	root, err := merkleRoot(txs)
+	if err != nil {
+		return nil, err
+	}
+	header := btcwire.NewBlockHeader(&t.PrevBlock, root, t.Bits, 0)
+	header.Version = t.Version
+	header.Timestamp = time.Unix(coinStake.Time.Unix(), 0)
+	block := btcwire.NewMsgBlock(header)
+	for _, tx := range txs {
+		if err := block.AddTransaction(tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := SignBlock(block, key); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// SignBlock sets block's signature, a DER signature of the block hash.
+func SignBlock(block *btcwire.MsgBlock, key *btcutil.WIF) error {
+	sha, err := block.BlockSha()
+	if err != nil {
+		return err
+	}
+	sig, err := key.PrivKey.Sign(sha[:])
+	if err != nil {
+		return fmt.Errorf("sign block: %w", err)
+	}
+	block.Signature = sig.Serialize()
+	return nil
+}
+
+// VerifyBlockSignature tells if block is a proof-of-stake block signed by
+// the key of its coinstake's first stake output.
+func VerifyBlockSignature(block *btcwire.MsgBlock) bool {
+	if len(block.Transactions) < 2 || len(block.Transactions[1].TxOut) < 2 {
+		return false
+	}
+	pubKey, ok := pubKeyScript(block.Transactions[1].TxOut[1].PkScript)
+	if !ok {
+		return false
+	}
+	sha, err := block.BlockSha()
+	if err != nil {
+		return false
+	}
+	return verifySignature(pubKey, block.Signature, sha[:])
+}
+
+// verifySignature tells if sig is a valid DER signature of hash by pubKey.
+func verifySignature(pubKey, sig, hash []byte) bool {
+	pk, err := btcec.ParsePubKey(pubKey, btcec.S256())
+	if err != nil {
+		return false
+	}
+	s, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		return false
+	}
+	return s.Verify(hash, pk)
+}
@@ -0,0 +1,111 @@
+package umint_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kac-/umint"
+	"github.com/mably/btcec"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"testing"
+)
+
+type memKeyStore map[string]*btcutil.WIF
+
+func (s memKeyStore) KeyForHash(pubKeyHash []byte) (*btcutil.WIF, error) {
+	if key, ok := s[string(pubKeyHash)]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key for %x", pubKeyHash)
+}
+
+func (s memKeyStore) add(t *testing.T, compress bool) *btcutil.WIF {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	key, err := btcutil.NewWIF(priv, &btcnet.MainNetParams, compress)
+	if err != nil {
+		t.Fatalf("new wif: %v", err)
+	}
+	s[string(btcutil.Hash160(key.SerializePubKey()))] = key
+	return key
+}
+
+func payToPubKeyHash(key *btcutil.WIF) []byte {
+	script := []byte{0x76, 0xa9, 20}
+	script = append(script, btcutil.Hash160(key.SerializePubKey())...)
+	return append(script, 0x88, 0xac)
+}
+
+func TestNewStakeBlock(t *testing.T) {
+	keys := memKeyStore{}
+	hashKey, pubKey := keys.add(t, true), keys.add(t, false)
+	blockTime := int64(1420000000)
+	txTime := blockTime + 100*24*60*60
+	kernel := coinStakeSource(1, blockTime, 1000*1000000)
+	kernel.Outputs["0"].PkScript = payToPubKeyHash(hashKey)
+	other := coinStakeSource(2, blockTime, 1000*1000000)
+	other.Outputs["0"].PkScript = umint.PayToPubKeyScript(pubKey.SerializePubKey())
+
+	tx, err := umint.NewCoinStake(umint.MainNet, umint.StakeInput{Source: kernel}, nil, txTime, 0x2000ffff)
+	if err != nil {
+		t.Fatalf("new coinstake: %v", err)
+	}
+	// a second input of another key exercises pay-to-pubkey signing
+	outPoint, _ := other.OutPoint(0)
+	tx.AddTxIn(btcwire.NewTxIn(outPoint, nil))
+	prevScripts := [][]byte{kernel.Outputs["0"].PkScript, other.Outputs["0"].PkScript}
+	if err := umint.SignCoinStake(tx, prevScripts, keys); err != nil {
+		t.Fatalf("sign coinstake: %v", err)
+	}
+	if !bytes.Equal(tx.TxOut[1].PkScript, umint.PayToPubKeyScript(hashKey.SerializePubKey())) {
+		t.Errorf("stake output not converted to pay-to-pubkey: %x", tx.TxOut[1].PkScript)
+	}
+	for i, in := range tx.TxIn {
+		script := in.SignatureScript
+		sig := script[1 : 1+script[0]]
+		hash, err := umint.SignatureHash(tx, i, prevScripts[i], umint.SigHashAll)
+		if err != nil {
+			t.Fatalf("signature hash %d: %v", i, err)
+		}
+		key := []*btcutil.WIF{hashKey, pubKey}[i]
+		s, err := btcec.ParseDERSignature(sig[:len(sig)-1], btcec.S256())
+		if err != nil || !s.Verify(hash, key.PrivKey.PubKey()) || sig[len(sig)-1] != byte(umint.SigHashAll) {
+			t.Errorf("input %d: invalid signature (%v)", i, err)
+		}
+		rest := script[1+script[0]:]
+		if i == 0 && !bytes.Equal(rest, append([]byte{33}, hashKey.SerializePubKey()...)) {
+			t.Errorf("input %d: public key not pushed: %x", i, rest)
+		}
+		if i == 1 && len(rest) != 0 {
+			t.Errorf("input %d: pay-to-pubkey with extra data %x", i, rest)
+		}
+	}
+
+	tpl := &umint.StakeBlockTemplate{Version: 1, PrevBlock: btcwire.ShaHash{7}, Bits: 0x2000ffff}
+	block, err := umint.NewStakeBlock(tpl, tx, keys)
+	if err != nil {
+		t.Fatalf("new stake block: %v", err)
+	}
+	if len(block.Transactions) != 2 || block.Transactions[1] != tx ||
+		len(block.Transactions[0].TxOut) != 1 || block.Transactions[0].TxOut[0].Value != 0 {
+		t.Fatalf("wrong block transactions")
+	}
+	if block.Header.Timestamp.Unix() != txTime || block.Header.Bits != tpl.Bits || block.Header.PrevBlock != tpl.PrevBlock {
+		t.Errorf("wrong header %+v", block.Header)
+	}
+	if !umint.VerifyBlockSignature(block) {
+		t.Errorf("invalid block signature")
+	}
+	block.Header.Nonce++
+	if umint.VerifyBlockSignature(block) {
+		t.Errorf("signature valid for another header")
+	}
+
+	tx.TxOut[1].PkScript = []byte{0x6a}
+	if _, err := umint.NewStakeBlock(tpl, tx, keys); err == nil {
+		t.Errorf("block signed for a non pay-to-pubkey stake")
+	}
+}
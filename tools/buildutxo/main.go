@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"github.com/kac-/umint/utxo/build"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	testnet bool
+	dataDir string
+	dbPath  string
+	height  int
+	dbType  string
+	tag     bool
+	index   string
+	verify  string
+)
+
+func init() {
+	flag.BoolVar(&testnet, "testnet", false, "build from testnet blocks")
+	flag.StringVar(&dataDir, "datadir", btcutil.AppDataDir("ppcoin", false), "ppcoind data directory")
+	flag.StringVar(&dbPath, "db", filepath.Join(btcutil.AppDataDir("ppc-umint", false), "unspent_db"), "unspent database to create")
+	flag.IntVar(&height, "height", 0, "build up to this height instead of the best block")
+	flag.StringVar(&dbType, "dbtype", utxo.BackendLevelDB, "backend of the db: leveldb directory or single file in-memory store")
+	flag.BoolVar(&tag, "tag", false, "record the network of an existing db built before metadata was, instead of building")
+	flag.StringVar(&index, "index", "", "also write the block index of the built chain to this file")
+	flag.StringVar(&verify, "verify", "", "verify the stake modifiers of a block index file written by -index, instead of building")
+	flag.Parse()
+}
+
+func main() {
+	configSeelog()
+	defer log.Flush()
+	if err := run(); err != nil {
+		log.Critical(err)
+		log.Flush()
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	params, net, blocksDir := &btcnet.MainNetParams, umint.MainNet, dataDir
+	if testnet {
+		params, net, blocksDir = &btcnet.TestNet3Params, umint.TestNet, filepath.Join(dataDir, "testnet")
+	}
+	if tag {
+		return tagDB(params)
+	}
+	if verify != "" {
+		return verifyIndex(net)
+	}
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("%v already exists", dbPath)
+	}
+	// the db is built next to dbPath and renamed into place once complete,
+	// removing the db of an interrupted build first
+	tmpPath := dbPath + ".building"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+	db, err := utxo.OpenStore(tmpPath, dbType)
+	if err != nil {
+		return fmt.Errorf("create db(%v): %v", tmpPath, err)
+	}
+	started := time.Now()
+	if err := buildDB(db, net, params, blocksDir); err != nil {
+		db.Close()
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	if err := db.Close(); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("close db(%v): %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return err
+	}
+	log.Infof("built %v in %v", dbPath, time.Since(started))
+	return nil
+}
+
+// buildDB builds db from the block files of blocksDir.
+func buildDB(db utxo.Store, net *umint.Network, params *btcnet.Params, blocksDir string) error {
+	files := build.NewBlockFiles(blocksDir, params.Net)
+	defer files.Close()
+	b := &build.Builder{
+		Net:    net,
+		Files:  files,
+		Height: int32(height),
+		Progress: func(height int32, blockTime int64) {
+			if height%10000 == 0 {
+				log.Infof("height %v (%v)", height, time.Unix(blockTime, 0).Format("2006-01-02 15:04:05"))
+			}
+		},
+	}
+	var w *bufio.Writer
+	if index != "" {
+		f, err := os.Create(index)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = bufio.NewWriter(f)
+		b.Index = w
+	}
+	log.Infof("indexing blocks of %v", blocksDir)
+	if err := b.Build(db); err != nil {
+		return err
+	}
+	if w != nil {
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("write block index(%v): %v", index, err)
+		}
+	}
+	return nil
+}
+
+// verifyIndex verifies the stake modifiers of the block index file verify,
+// written for net.
+func verifyIndex(net *umint.Network) error {
+	f, err := os.Open(verify)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	top, checksum, err := umint.VerifyStakeModifierFile(net, bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("verify %v: %v", verify, err)
+	}
+	log.Infof("stake modifiers of %v verified up to height %d, checksum %08x", verify, top, checksum)
+	return nil
+}
+
+// tagDB writes the metadata of the existing db at dbPath, built for params.
+func tagDB(params *btcnet.Params) error {
+	if _, err := os.Stat(dbPath); err != nil {
+		return err
+	}
+	db, err := utxo.OpenStore(dbPath, utxo.BackendDetect)
+	if err != nil {
+		return fmt.Errorf("open db(%v): %v", dbPath, err)
+	}
+	defer db.Close()
+	if meta, err := utxo.FetchMeta(db); err == nil {
+		return fmt.Errorf("%v is already tagged, schema version %d magic %08x builder %q",
+			dbPath, meta.Version, uint32(meta.Net), meta.Builder)
+	} else if err != utxo.ErrNoMeta {
+		return err
+	}
+	if _, _, err := db.FetchHeight(); err != nil {
+		return fmt.Errorf("%v isn't an unspent db: %v", dbPath, err)
+	}
+	meta := utxo.NewMeta(params, "unknown")
+	meta.Version = 1 // the layout before metadata, utxo.Open migrates it
+	if err := utxo.PutMeta(db, meta); err != nil {
+		return err
+	}
+	log.Infof("tagged %v as %v", dbPath, params.Name)
+	return db.Close()
+}
+
+func configSeelog() {
+	l, _ := log.LoggerFromConfigAsString(`
+<seelog>
+	<outputs formatid="main">
+		<console />
+	</outputs>
+	<formats>
+		<format id="main" format="[%Level] %Msg%n"/>
+	</formats>
+</seelog>
+`)
+	log.ReplaceLogger(l)
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	log "github.com/cihub/seelog"
-	"github.com/btcsuite/goleveldb/leveldb"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/keystore"
+	"github.com/kac-/umint/minter"
+	"github.com/kac-/umint/rpc"
 	"github.com/kac-/umint/utxo"
 	"github.com/mably/btcnet"
 	"github.com/mably/btcutil"
@@ -15,6 +19,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -24,28 +29,58 @@ const ()
 
 var (
 	testnet     bool
-	diff        float64
+	diff        umint.Difficulty
 	days        uint
 	startString string
+	workers     int
+	estimate    bool
+	plan        bool
+	policy      umint.StakePolicy
+	splitPPC    float64
+	combinePPC  float64
+	reservePPC  float64
+	keysPath    string
+	rpcURL      string
+	rpcUser     string
+	rpcPass     string
 )
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s: [ADDR|TX:IDX]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s: [ADDR|TX:IDX], scanned along with the addresses of -keystore FILE\n", os.Args[0])
 		flag.PrintDefaults()
 	}
-	flag.Float64Var(&diff, "diff", 10.0, "display success on diff ")
+	diff.Set("10")
+	flag.BoolVar(&testnet, "testnet", false, "scan testnet outputs")
+	flag.Var(&diff, "diff", "display success on diff ")
 	flag.UintVar(&days, "days", 7, "number of days to check")
 	flag.StringVar(&startString, "from", "now", "date from which scan [i.e. 2014-09-12]")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(), "number of scanning goroutines")
+	flag.BoolVar(&estimate, "estimate", false, "print minting estimates instead of scanning")
+	flag.BoolVar(&plan, "plan", false, "print the coinstake each found stake would build (dry run)")
+	flag.Float64Var(&splitPPC, "split", 0, "split stakes of kernels worth at least this many PPCs")
+	flag.Int64Var(&policy.SplitAge, "splitage", 90*24*60*60, "split only kernels younger than this many seconds")
+	flag.Float64Var(&combinePPC, "combine", 0, "combine outputs into stakes worth less than this many PPCs")
+	flag.IntVar(&policy.MaxInputs, "maxinputs", 100, "maximum number of coinstake inputs")
+	flag.Float64Var(&reservePPC, "reserve", 0, "number of PPCs never staked")
+	flag.StringVar(&keysPath, "keystore", "", "scan all addresses of this keystore file")
+	flag.StringVar(&rpcURL, "rpc", "", "take the proof-of-stake difficulty and v0.5 stake modifiers from this ppcoind (i.e. http://127.0.0.1:9902)")
+	flag.StringVar(&rpcUser, "rpcuser", "", "ppcoind rpc user")
+	flag.StringVar(&rpcPass, "rpcpass", "", "ppcoind rpc password")
 	flag.Parse()
+	policy.SplitThreshold = int64(splitPPC * 1000000)
+	policy.CombineThreshold = int64(combinePPC * 1000000)
+	policy.ReserveBalance = int64(reservePPC * 1000000)
 }
 
 func main() {
 	var (
 		err            error
 		params         = &btcnet.MainNetParams
+		net            = umint.MainNet
 		addrOrOutPoint string
 		addr           *btcutil.AddressPubKeyHash
+		addrs          []*btcutil.AddressPubKeyHash
 		outPoint       *btcwire.OutPoint
 	)
 
@@ -60,20 +95,22 @@ func main() {
 		return
 	}
 	dbDestinationDir := filepath.Join(appHome, "unspent_db")
-	topHeight, topTime, err := utxo.FetchHeightFile(dbDestinationDir)
-	if err != nil || topHeight != 142000 {
+	if testnet {
+		params, net = &btcnet.TestNet3Params, umint.TestNet
+		dbDestinationDir = filepath.Join(appHome, "unspent_db_testnet")
+	}
+	if _, err := os.Stat(dbDestinationDir); os.IsNotExist(err) && testnet {
+		// the downloadable db is a mainnet one
+		log.Errorf("no testnet db(%v), build it with buildutxo -testnet -db %v", dbDestinationDir, dbDestinationDir)
+		return
+	} else if os.IsNotExist(err) {
 		var dbTempDir string
-		dbTempDir, topHeight, topTime, err = DownloadDB(url)
+		dbTempDir, _, _, err = DownloadDB(url)
 		defer os.RemoveAll(dbTempDir)
 		if err != nil {
 			log.Errorf("downloading database failed: %v\n", err)
 			return
 		}
-		err = os.RemoveAll(dbDestinationDir)
-		if err != nil {
-			log.Errorf("remove database dir(%v): %v\n", dbDestinationDir, err)
-			return
-		}
 		err = os.Rename(dbTempDir, dbDestinationDir)
 		if err != nil {
 			if strings.HasSuffix(err.Error(), ": invalid cross-device link") {
@@ -91,10 +128,35 @@ func main() {
 			}
 		}
 	}
+	db, err := utxo.Open(dbDestinationDir, utxo.BackendDetect, params)
+	if errors.Is(err, utxo.ErrNoMeta) {
+		log.Errorf("opening db(%v): %v, tag it with buildutxo -tag -db %v", dbDestinationDir, err, dbDestinationDir)
+		return
+	}
+	if err != nil {
+		log.Errorf("opening db(%v): %v", dbDestinationDir, err)
+		return
+	}
+	defer db.Close()
+	topHeight, topTime, err := db.FetchHeight()
+	if err != nil {
+		log.Errorf("fetch height from db(%v): %v", dbDestinationDir, err)
+		return
+	}
 	log.Infof("got db: %v blocks (%v)", topHeight, topTime.Format("2006-01-02 15:04:05"))
 
-	// db path
-	if len(flag.Args()) < 1 {
+	if keysPath != "" {
+		store, err := keystore.Open(keysPath, params)
+		if err != nil {
+			fmt.Printf("open keystore: %v\n", err)
+			return
+		}
+		addrs, err = store.Addresses()
+		if err != nil {
+			fmt.Printf("keystore addresses: %v\n", err)
+			return
+		}
+	} else if len(flag.Args()) < 1 {
 		fmt.Println("arg required")
 		flag.Usage()
 		return
@@ -117,7 +179,7 @@ func main() {
 			return
 		}
 		outPoint = btcwire.NewOutPoint(txSha, uint32(outputIdx))
-	} else { // ADDR
+	} else if addrOrOutPoint != "" { // ADDR
 		decoded, err := btcutil.DecodeAddress(addrOrOutPoint, params)
 		if err != nil {
 			fmt.Printf("invalid address(%v): %v\n", addrOrOutPoint, err)
@@ -129,6 +191,14 @@ func main() {
 			fmt.Printf("pub key hash address expected: %v\n", addrOrOutPoint)
 			return
 		}
+		// scanned along with the keystore's addresses
+		scanned := false
+		for _, a := range addrs {
+			scanned = scanned || *a.Hash160() == *addr.Hash160()
+		}
+		if !scanned {
+			addrs = append(addrs, addr)
+		}
 	}
 
 	// -from
@@ -142,48 +212,91 @@ func main() {
 	}
 	end := start.Add(time.Hour * time.Duration(24*days))
 
+	// -rpc
+	var index umint.BlockIndex
+	if rpcURL != "" {
+		client := rpc.NewClient(rpcURL, rpcUser, rpcPass)
+		d, err := client.GetDifficulty()
+		if err != nil {
+			fmt.Printf("getdifficulty: %v\n", err)
+			return
+		}
+		if err = diff.Set(strconv.FormatFloat(d.ProofOfStake, 'f', -1, 64)); err != nil {
+			fmt.Printf("ppcoind difficulty: %v\n", err)
+			return
+		}
+		if !estimate && end.Unix() >= net.ProtocolV05SwitchTime {
+			// v0.5 kernels hash the stake modifiers selected back from the best block
+			log.Infof("fetching the block index for v0.5 stake modifiers")
+			tip, err := minter.NewRPCNode(client, net).Tip()
+			if err != nil {
+				fmt.Printf("block index: %v\n", err)
+				return
+			}
+			index = tip.Index
+		}
+	}
+
 	// done, now fire
-	if outPoint != nil {
+	if outPoint != nil && len(addrs) == 0 {
 		log.Infof(`params:
 tx:      %v
 idx:     %v
 start:   %v
 end:     %v
 diff:    %v
-`, outPoint.Hash, outPoint.Index, start, end, diff)
+`, outPoint.Hash, outPoint.Index, start, end, &diff)
 	} else {
+		encoded := make([]string, len(addrs))
+		for i, a := range addrs {
+			encoded[i] = a.EncodeAddress()
+		}
+		tx := ""
+		if outPoint != nil {
+			tx = fmt.Sprintf("\ntx:idx:  %v:%v", outPoint.Hash, outPoint.Index)
+		}
 		log.Infof(`params:
-addr:    %v
+addr:    %v%v
 start:   %v
 end:     %v
 diff:    %v
-`, addr.EncodeAddress(), start, end, diff)
+`, strings.Join(encoded, " "), tx, start, end, &diff)
 	}
 
-	db, err := leveldb.OpenFile(dbDestinationDir, nil)
-	if err != nil {
-		fmt.Printf("opening db: %v\n", err)
-		return
-	}
-	if addr != nil {
-		ups, _, err := utxo.FetchCoins(db, addr)
+	var outPoints []*btcwire.OutPoint
+	for _, a := range addrs {
+		// coins maturing after the scanned days can't stake in them
+		coins, _, err := db.FetchMatureCoins(a, end, net.StakeMinAge)
 		if err != nil {
-			log.Criticalf("fetching coins for %v: %v", addr.EncodeAddress(), err)
+			log.Criticalf("fetching coins for %v: %v", a.EncodeAddress(), err)
 			return
 		}
-		for i := range ups {
-			err = findStake(ups[i], db, params, start.Unix(), end.Unix(), float32(diff))
-			if err != nil {
-				log.Errorf("error while searching: %v", err)
-			}
+		outPoints = append(outPoints, coins...)
+	}
+	if outPoint != nil {
+		scanned := false
+		for _, o := range outPoints {
+			scanned = scanned || *o == *outPoint
 		}
-	} else {
-		err = findStake(outPoint, db, params, start.Unix(), end.Unix(), float32(diff))
+		if !scanned {
+			outPoints = append(outPoints, outPoint)
+		}
+	}
+	if estimate {
+		err = estimateStakes(outPoints, db, net, start.Unix(), end.Unix(), &diff)
 		if err != nil {
-			log.Errorf("error while searching: %v", err)
+			log.Errorf("error while estimating: %v", err)
 		}
+		return
+	}
+	var stakePolicy *umint.StakePolicy
+	if plan {
+		stakePolicy = &policy
+	}
+	err = findStakes(outPoints, db, index, net, start.Unix(), end.Unix(), &diff, workers, stakePolicy)
+	if err != nil {
+		log.Errorf("error while searching: %v", err)
 	}
-	_ = addr
 }
 
 func DownloadDB(url string) (dbTempDir string, topHeight uint32, topTime time.Time, err error) {
@@ -274,10 +387,29 @@ func DownloadDB(url string) (dbTempDir string, topHeight uint32, topTime time.Ti
 
 	// test db
 	topHeight, topTime, err = utxo.FetchHeightFile(dbTempDir)
-
+	if err != nil {
+		return
+	}
+	// the archive predates metadata, it's a mainnet db
+	err = tagDB(dbTempDir, &btcnet.MainNetParams, filename)
 	return
 }
 
+// tagDB writes the metadata of the db at dir, built for params by builder.
+func tagDB(dir string, params *btcnet.Params, builder string) error {
+	db, err := utxo.OpenStore(dir, utxo.BackendLevelDB)
+	if err != nil {
+		return fmt.Errorf("open db(%v): %v", dir, err)
+	}
+	defer db.Close()
+	meta := utxo.NewMeta(params, builder)
+	meta.Version = 1 // the layout before metadata, utxo.Open migrates it
+	if err := utxo.PutMeta(db, meta); err != nil {
+		return fmt.Errorf("tag db(%v): %v", dir, err)
+	}
+	return nil
+}
+
 func CopyFile(src string, dst string) error {
 	srcLen := len(src)
 	err := filepath.Walk(src, func(path string, f os.FileInfo, err error) error {
@@ -1,58 +1,179 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/cihub/seelog"
-	"github.com/btcsuite/goleveldb/leveldb"
 	"github.com/kac-/umint"
 	"github.com/kac-/umint/utxo"
-	"github.com/mably/btcnet"
 	"github.com/mably/btcwire"
+	"math"
+	"os"
+	"os/signal"
 	"time"
 )
 
-func findStake(outPoint *btcwire.OutPoint, db *leveldb.DB,
-	params *btcnet.Params, fromTime int64, maxTime int64, diff float32) (err error) {
-	utx, err := utxo.FetchUTXO(db, outPoint)
+// findStakes scans the outputs' kernels from fromTime to maxTime. v0.5
+// kernels hash the stake modifiers selected from index, without an index the
+// scan stops at the v0.5 switch.
+func findStakes(outPoints []*btcwire.OutPoint, db utxo.Store, index umint.BlockIndex,
+	net *umint.Network, fromTime int64, maxTime int64, diff *umint.Difficulty, workers int,
+	policy *umint.StakePolicy) (err error) {
+	bits := diff.Bits()
+
+	if switchTime := net.ProtocolV05SwitchTime; index == nil && maxTime >= switchTime {
+		log.Warnf("no block index to select v0.5 stake modifiers from (see -rpc), scanning until the v0.5 switch at %v",
+			time.Unix(switchTime, 0))
+		if maxTime = switchTime - 1; maxTime < fromTime {
+			return umint.ErrNoBlockIndex
+		}
+	}
+	reach := net.StakeMinAge - umint.StakeModifierSelectionInterval(net)
+	if index != nil && maxTime >= index.Time()+reach {
+		// later modifiers aren't selected yet
+		maxTime = index.Time() + reach - 1
+		log.Warnf("v0.5 stake modifiers are known until %v, scanning until then", time.Unix(maxTime, 0))
+	}
+	windows, err := net.KernelWindows(index, fromTime, maxTime)
 	if err != nil {
-		return fmt.Errorf("fetch utxo(%v): %v", outPoint, err)
+		return fmt.Errorf("kernel windows: %v", err)
+	}
+	var jobs []umint.ScanJob
+	// jobOutput maps the scan jobs to their outputs
+	var jobOutput []int
+	utxos := make([]*utxo.UTXO, len(outPoints))
+	for i, outPoint := range outPoints {
+		utx, err := db.FetchUTXO(outPoint)
+		if err != nil {
+			return fmt.Errorf("fetch utxo(%v): %v", outPoint, err)
+		}
+		utxos[i] = utx
+		tpl := umint.StakeKernelTemplate{
+			BlockFromTime:  int64(utx.BlockTime),
+			StakeModifier:  utx.StakeModifier,
+			PrevTxOffset:   utx.OffsetInBlock,
+			PrevTxTime:     int64(utx.Time),
+			PrevTxOutIndex: outPoint.Index,
+			PrevTxOutValue: int64(utx.Value),
+			StakeMinAge:    net.StakeMinAge,
+			Bits:           bits,
+		}
+		for _, w := range windows {
+			jobs = append(jobs, umint.ScanJob{Template: w.Template(tpl), From: w.From, To: w.To})
+			jobOutput = append(jobOutput, i)
+		}
+		maturity := ""
+		tpl.Protocol = net.ProtocolAt(fromTime)
+		tpl.TxTime = fromTime
+		var minAgeErr *umint.MinAgeViolationError
+		if _, _, err, _ := umint.CheckStakeKernelHash(&tpl); errors.As(err, &minAgeErr) {
+			maturity = " matures in " + formatSeconds(minAgeErr.Remaining())
+		}
+		log.Infof("CHECK %v PPCs from %v%v https://bkchain.org/ppc/tx/%v#o%v",
+			float64(utx.Value)/1000000.0, time.Unix(int64(utx.Time), 0).Format("2006-01-02"),
+			maturity, outPoint.Hash, outPoint.Index)
 	}
-	log.Infof("CHECK %v PPCs from %v https://bkchain.org/ppc/tx/%v#o%v",
-		float64(utx.Value)/1000000.0, time.Unix(int64(utx.Time), 0).Format("2006-01-02"),
-		outPoint.Hash, outPoint.Index)
-
-	var bits uint32
 
-	bits = umint.BigToCompact(umint.DiffToTarget(diff))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	stpl := umint.StakeKernelTemplate{
-		BlockFromTime:  int64(utx.BlockTime),
-		StakeModifier:  utx.StakeModifier,
-		PrevTxOffset:   utx.OffsetInBlock,
-		PrevTxTime:     int64(utx.Time),
-		PrevTxOutIndex: outPoint.Index,
-		PrevTxOutValue: int64(utx.Value),
-		IsProtocolV03:  true,
-		StakeMinAge:    params.StakeMinAge,
-		Bits:           bits,
-		TxTime:         fromTime,
-	}
-	for true {
-		_, succ, ferr, minTarget := umint.CheckStakeKernelHash(&stpl)
-		if ferr != nil {
-			err = fmt.Errorf("check kernel hash error :%v", ferr)
-			return
-		}
-		if succ {
-			comp := umint.IncCompact(umint.BigToCompact(minTarget))
-			maximumDiff := umint.CompactToDiff(comp)
-			log.Infof("MINT %v %v", time.Unix(stpl.TxTime, 0),
-				maximumDiff)
-		}
-		stpl.TxTime++
-		if stpl.TxTime > maxTime {
-			break
+	lastPercent := int64(-1)
+	scanner := umint.Scanner{
+		Workers: workers,
+		Progress: func(done, total int64) {
+			if total == 0 {
+				return
+			}
+			if percent := done * 100 / total; percent/10 != lastPercent/10 {
+				lastPercent = percent
+				log.Debugf("progress %v%%", percent)
+			}
+		},
+	}
+	for r := range scanner.Scan(ctx, jobs) {
+		kernel := jobOutput[r.Job]
+		outPoint := outPoints[kernel]
+		if r.Err != nil {
+			log.Errorf("check kernel hash error(%v:%v): %v", outPoint.Hash, outPoint.Index, r.Err)
+			continue
 		}
+		tpl := &jobs[r.Job].Template
+		coinAge, err := umint.CoinAge(utxos[kernel:kernel+1], r.Hit.TxTime, tpl.StakeMinAge)
+		if err != nil {
+			log.Errorf("coin age error(%v:%v): %v", outPoint.Hash, outPoint.Index, err)
+			continue
+		}
+		reward := umint.StakeReward(coinAge, tpl.Protocol)
+		log.Infof("MINT %v %v reward %v %v:%v", time.Unix(r.Hit.TxTime, 0), r.Hit.MaxDiff,
+			float64(reward)/1000000.0, outPoint.Hash, outPoint.Index)
+		if policy != nil {
+			planned := utxos
+			if tpl.Protocol >= umint.ProtocolV05 {
+				// the kernel hashes the stake modifier selected for the window
+				u := *utxos[kernel]
+				u.StakeModifier = tpl.StakeModifier
+				planned = append([]*utxo.UTXO(nil), utxos...)
+				planned[kernel] = &u
+			}
+			plan, err := policy.Plan(net, outPoints, planned, kernel, r.Hit.TxTime)
+			if err != nil {
+				log.Infof("PLAN %v:%v: %v", outPoint.Hash, outPoint.Index, err)
+				continue
+			}
+			log.Infof("PLAN %v", plan)
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("scan interrupted")
 	}
 	return
 }
+
+func estimateStakes(outPoints []*btcwire.OutPoint, db utxo.Store,
+	net *umint.Network, fromTime int64, maxTime int64, diff *umint.Difficulty) error {
+	for _, outPoint := range outPoints {
+		utx, err := db.FetchUTXO(outPoint)
+		if err != nil {
+			return fmt.Errorf("fetch utxo(%v): %v", outPoint, err)
+		}
+		protocol := net.ProtocolAt(fromTime)
+		e := umint.StakeEstimator{
+			Value:       int64(utx.Value),
+			PrevTxTime:  int64(utx.Time),
+			StakeMinAge: net.StakeMinAge,
+			StakeMaxAge: protocol.StakeMaxAge(),
+			Protocol:    protocol,
+			Difficulty:  umint.ConstantDifficulty(diff.Float64()),
+		}
+		est := e.Estimate(fromTime, maxTime-fromTime)
+		wait := "never"
+		if !math.IsInf(est.ExpectedWait, 1) {
+			wait = formatSeconds(int64(est.ExpectedWait))
+		}
+		log.Infof("ESTIMATE %v PPCs from %v: %.3g/s, expected in %v, %.2f%% until %v %v:%v",
+			float64(utx.Value)/1000000.0, time.Unix(int64(utx.Time), 0).Format("2006-01-02"),
+			est.PerSecond, wait, est.Within*100, time.Unix(maxTime, 0).Format("2006-01-02"),
+			outPoint.Hash, outPoint.Index)
+	}
+	return nil
+}
+
+// formatSeconds formats a duration like "3d 4h".
+func formatSeconds(seconds int64) string {
+	days, hours := seconds/(24*60*60), seconds%(24*60*60)/(60*60)
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh", days, hours)
+	}
+	return fmt.Sprintf("%dh %dm", hours, seconds%(60*60)/60)
+}
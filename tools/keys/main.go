@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/kac-/umint/keystore"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"golang.org/x/term"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	testnet bool
+	path    string
+	stdin   = bufio.NewReader(os.Stdin)
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: create|list|unlock|passwd|import|export ADDR (import reads the WIF from stdin)\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.BoolVar(&testnet, "testnet", false, "use testnet keys")
+	flag.StringVar(&path, "file", filepath.Join(btcutil.AppDataDir("ppc-umint", false), "keystore.json"), "keystore file")
+	flag.Parse()
+}
+
+// readSecret reads a line from stdin after printing prompt, without echo
+// if stdin is a terminal.
+func readSecret(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		secret, _ := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return secret
+	}
+	line, _ := stdin.ReadString('\n')
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+func main() {
+	params := &btcnet.MainNetParams
+	if testnet {
+		params = &btcnet.TestNet3Params
+	}
+	if err := run(params, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(params *btcnet.Params, args []string) error {
+	if len(args) < 1 {
+		flag.Usage()
+		return fmt.Errorf("command required")
+	}
+	if args[0] == "create" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		_, err := keystore.Create(path, params, readSecret("new passphrase: "))
+		return err
+	}
+	store, err := keystore.Open(path, params)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		addrs, err := store.Addresses()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			fmt.Println(addr.EncodeAddress())
+		}
+	case "unlock":
+		// checks the passphrase opens every key, upgrading an old store
+		if err := store.Unlock(readSecret("passphrase: ")); err != nil {
+			return err
+		}
+		store.Lock()
+		fmt.Println("unlocked")
+	case "passwd":
+		if err := store.Unlock(readSecret("passphrase: ")); err != nil {
+			return err
+		}
+		defer store.Lock()
+		passphrase := readSecret("new passphrase: ")
+		if !bytes.Equal(passphrase, readSecret("repeat new passphrase: ")) {
+			return fmt.Errorf("passphrases differ")
+		}
+		if err := store.ChangePassphrase(passphrase); err != nil {
+			return err
+		}
+	case "import":
+		if len(args) != 1 {
+			return fmt.Errorf("import takes the WIF from stdin")
+		}
+		key, err := btcutil.DecodeWIF(string(readSecret("WIF: ")))
+		if err != nil {
+			return fmt.Errorf("invalid WIF: %v", err)
+		}
+		if err := store.Unlock(readSecret("passphrase: ")); err != nil {
+			return err
+		}
+		defer store.Lock()
+		addr, err := store.Import(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println(addr.EncodeAddress())
+	case "export":
+		if len(args) != 2 {
+			return fmt.Errorf("export ADDR")
+		}
+		decoded, err := btcutil.DecodeAddress(args[1], params)
+		if err != nil {
+			return fmt.Errorf("invalid address(%v): %v", args[1], err)
+		}
+		addr, ok := decoded.(*btcutil.AddressPubKeyHash)
+		if !ok {
+			return fmt.Errorf("pub key hash address expected: %v", args[1])
+		}
+		if err := store.Unlock(readSecret("passphrase: ")); err != nil {
+			return err
+		}
+		defer store.Lock()
+		key, err := store.Export(addr)
+		if err != nil {
+			return err
+		}
+		fmt.Println(key.String())
+	default:
+		flag.Usage()
+		return fmt.Errorf("unknown command %v", args[0])
+	}
+	return nil
+}
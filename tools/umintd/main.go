@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/keystore"
+	"github.com/kac-/umint/minter"
+	"github.com/kac-/umint/rpc"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	testnet      bool
+	appHome      string
+	keysPath     string
+	dbPath       string
+	dbType       string
+	statePath    string
+	attemptLog   string
+	rpcURL       string
+	rpcUser      string
+	rpcPass      string
+	blockVersion int
+	refresh      time.Duration
+	horizon      time.Duration
+	schedule     bool
+	policy       umint.StakePolicy
+	splitPPC     float64
+	combinePPC   float64
+	reservePPC   float64
+)
+
+func init() {
+	appHome = btcutil.AppDataDir("ppc-umint", false)
+	flag.BoolVar(&testnet, "testnet", false, "mint on testnet")
+	flag.StringVar(&keysPath, "keystore", filepath.Join(appHome, "keystore.json"), "keystore file of the minting keys")
+	flag.StringVar(&dbPath, "db", filepath.Join(appHome, "unspent_db"), "unspent outputs database")
+	flag.StringVar(&dbType, "dbtype", utxo.BackendDetect, "backend of the db: leveldb or file, detected if empty")
+	flag.StringVar(&statePath, "state", filepath.Join(appHome, "umintd.json"), "state file")
+	flag.StringVar(&attemptLog, "log", filepath.Join(appHome, "attempts.log"), "file minting attempts are appended to")
+	flag.StringVar(&rpcURL, "rpc", "http://127.0.0.1:9902", "ppcoind rpc url")
+	flag.StringVar(&rpcUser, "rpcuser", "", "ppcoind rpc user")
+	flag.StringVar(&rpcPass, "rpcpass", "", "ppcoind rpc password")
+	flag.IntVar(&blockVersion, "blockversion", 1, "version of minted blocks")
+	flag.DurationVar(&refresh, "refresh", 10*time.Minute, "interval between unspent outputs refreshes")
+	flag.DurationVar(&horizon, "horizon", 6*time.Hour, "how far ahead kernels are scheduled")
+	flag.BoolVar(&schedule, "schedule", false, "print the kernels scheduled from now and exit")
+	flag.Float64Var(&splitPPC, "split", 0, "split stakes of kernels worth at least this many PPCs")
+	flag.Int64Var(&policy.SplitAge, "splitage", 90*24*60*60, "split only kernels younger than this many seconds")
+	flag.Float64Var(&combinePPC, "combine", 0, "combine outputs into stakes worth less than this many PPCs")
+	flag.IntVar(&policy.MaxInputs, "maxinputs", 100, "maximum number of coinstake inputs")
+	flag.Float64Var(&reservePPC, "reserve", 0, "number of PPCs never staked")
+	flag.Parse()
+	policy.SplitThreshold = int64(splitPPC * 1000000)
+	policy.CombineThreshold = int64(combinePPC * 1000000)
+	policy.ReserveBalance = int64(reservePPC * 1000000)
+}
+
+func main() {
+	configSeelog()
+	defer log.Flush()
+	if err := run(); err != nil {
+		log.Critical(err)
+		log.Flush()
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	params, net := &btcnet.MainNetParams, umint.MainNet
+	if testnet {
+		params, net = &btcnet.TestNet3Params, umint.TestNet
+	}
+	store, err := keystore.Open(keysPath, params)
+	if err != nil {
+		return err
+	}
+	if !schedule {
+		fmt.Fprint(os.Stderr, "passphrase: ")
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err := store.Unlock([]byte(strings.TrimRight(line, "\r\n"))); err != nil {
+			return err
+		}
+		defer store.Lock()
+	}
+	addrs, err := store.Addresses()
+	if err != nil {
+		return err
+	}
+
+	db, err := utxo.Open(dbPath, dbType, params)
+	if err != nil {
+		return fmt.Errorf("opening db(%v): %v", dbPath, err)
+	}
+	defer db.Close()
+	client := rpc.NewClient(rpcURL, rpcUser, rpcPass)
+	// the db follows the node, dropping the outputs spent since it was built
+	sync := &minter.DBSync{Client: client, Net: net, DB: db}
+	coins := func() ([]*btcwire.OutPoint, []*utxo.UTXO, error) {
+		connected, err := sync.Sync()
+		if err != nil {
+			return nil, nil, fmt.Errorf("syncing db with the node: %v", err)
+		}
+		if connected > 0 {
+			log.Infof("connected %d blocks to the db", connected)
+		}
+		var outPoints []*btcwire.OutPoint
+		var utxos []*utxo.UTXO
+		for _, a := range addrs {
+			o, u, err := db.FetchCoins(a)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fetching coins for %v: %v", a.EncodeAddress(), err)
+			}
+			outPoints = append(outPoints, o...)
+			utxos = append(utxos, u...)
+		}
+		log.Infof("%d outputs of %d addresses", len(outPoints), len(addrs))
+		return outPoints, utxos, nil
+	}
+
+	m, err := minter.New(minter.Config{
+		Net:             net,
+		Policy:          policy,
+		Keys:            store,
+		Coins:           coins,
+		Node:            minter.NewRPCNode(client, net),
+		BlockVersion:    int32(blockVersion),
+		StatePath:       statePath,
+		AttemptLog:      attemptLog,
+		RefreshInterval: refresh,
+		ScheduleHorizon: int64(horizon / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	if schedule {
+		return printSchedule(m)
+	}
+	m.OnAttempt = func(a *minter.Attempt) {
+		log.Infof("block %v at %v staking %v: %v", a.Height, a.TxTime, a.OutPoint, a.Outcome)
+	}
+	m.OnError = func(err error) {
+		log.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("%v, shutting down", sig)
+		cancel()
+	}()
+	state := m.State()
+	log.Infof("minting with %d addresses, %d blocks submitted so far", len(addrs), state.Submitted)
+	return m.Run(ctx)
+}
+
+// printSchedule prints the kernels scheduled from now.
+func printSchedule(m *minter.Minter) error {
+	entries, err := m.Schedule(context.Background(), time.Now())
+	if err != nil {
+		return err
+	}
+	from, to, diff := m.ScheduleWindow()
+	fmt.Printf("%d kernels from %v to %v at diff %v\n", len(entries),
+		time.Unix(from, 0).Format("2006-01-02 15:04:05"), time.Unix(to, 0).Format("2006-01-02 15:04:05"), diff)
+	for _, e := range entries {
+		fmt.Printf("%v %v:%d maxdiff %v\n", time.Unix(e.Time, 0).Format("2006-01-02 15:04:05"),
+			e.OutPoint.Hash, e.OutPoint.Index, e.MaxDiff)
+	}
+	return nil
+}
+
+func configSeelog() {
+	l, _ := log.LoggerFromConfigAsString(`
+<seelog>
+	<outputs formatid="main">
+		<console />
+	</outputs>
+	<formats>
+		<format id="main" format="%Date %Time [%Level] %Msg%n"/>
+	</formats>
+</seelog>
+`)
+	log.ReplaceLogger(l)
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/btcsuite/goleveldb/leveldb"
 	"github.com/kac-/umint/utxo"
 	"github.com/mably/btcnet"
 	"github.com/mably/btcutil"
@@ -15,15 +15,22 @@ import (
 )
 
 var (
-	dbPath string
-	listen string
-	params = &btcnet.MainNetParams
+	dbPath  string
+	dbType  string
+	listen  string
+	testnet bool
+	params  = &btcnet.MainNetParams
 )
 
 func init() {
 	flag.StringVar(&dbPath, "db", "", "unpent database path")
+	flag.StringVar(&dbType, "dbtype", utxo.BackendDetect, "backend of the db: leveldb or file, detected if empty")
 	flag.StringVar(&listen, "s", ":9999", "listen on [ip]:port")
+	flag.BoolVar(&testnet, "testnet", false, "serve a testnet database")
 	flag.Parse()
+	if testnet {
+		params = &btcnet.TestNet3Params
+	}
 }
 
 func main() {
@@ -32,12 +39,13 @@ func main() {
 		flag.Usage()
 		return
 	}
-	db, err := leveldb.OpenFile(dbPath, nil)
+	db, err := utxo.Open(dbPath, dbType, params)
 	if err != nil {
-		fmt.Printf("ERR: open db(%v): %v", dbPath, err)
+		fmt.Printf("ERR: open db(%v): %v\n", dbPath, err)
+		return
 	}
 	defer db.Close()
-	height, time, err := utxo.FetchHeight(db)
+	height, time, err := db.FetchHeight()
 	if err != nil {
 		fmt.Printf("ERR: fetch height(%v): %v\n", dbPath, err)
 		return
@@ -72,7 +80,7 @@ func main() {
 				fmt.Fprintf(w, "ERR: pub key hash address expected: %v\n", addrStr)
 				return
 			}
-			points, complete, err := utxo.FetchOutPoints(db, addr, 100, skip)
+			points, complete, err := db.FetchOutPoints(addr, 100, skip)
 			if err != nil {
 				fmt.Fprintf(w, "ERR: fetch outPoints(%v): %v\n", addr, err)
 				return
@@ -102,9 +110,9 @@ func main() {
 				return
 			}
 			outPoint := btcwire.NewOutPoint(txSha, uint32(outputIdx))
-			u, err := utxo.FetchUTXO(db, outPoint)
+			u, err := db.FetchUTXO(outPoint)
 			if err != nil {
-				if strings.HasSuffix(err.Error(), "leveldb: not found") {
+				if errors.Is(err, utxo.ErrNotFound) {
 					fmt.Fprintln(w, "ERR: not found")
 				} else {
 					fmt.Printf("ERR: fetch utxo: %v\n", err)
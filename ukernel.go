@@ -1,7 +1,6 @@
 package umint
 
 import (
-	"errors"
 	"github.com/btcsuite/fastsha256"
 	"math/big"
 )
@@ -45,6 +44,9 @@ func doubleSha256(b []byte) []byte {
 // This compact form is only used in bitcoin to encode unsigned 256-bit numbers
 // which represent difficulty targets, thus there really is not a need for a
 // sign bit, but it is implemented here to stay consistent with bitcoind.
+//
+// CompactToBig does not validate its input, see DecodeCompact for bits from
+// untrusted sources.
 func CompactToBig(compact uint32) *big.Int {
 	// Extract the mantissa, sign bit, and exponent.
 	mantissa := compact & 0x007fffff
@@ -73,6 +75,30 @@ func CompactToBig(compact uint32) *big.Int {
 	return bn
 }
 
+// DecodeCompact decodes compact bits the way bitcoind's and ppcoind's
+// SetCompact do. It returns the absolute value of the encoded number
+// together with the sign and overflow flags: an encoding is negative only
+// if its mantissa is non-zero, and overflows when the number doesn't fit
+// into 256 bits. Overflowing values are truncated to 256 bits as in bitcoind.
+func DecodeCompact(compact uint32) (n *big.Int, negative, overflow bool) {
+	size := uint(compact >> 24)
+	word := compact & 0x007fffff
+	if size <= 3 {
+		word >>= 8 * (3 - size)
+		n = big.NewInt(int64(word))
+	} else {
+		n = new(big.Int).Lsh(big.NewInt(int64(word)), 8*(size-3))
+	}
+	negative = word != 0 && compact&0x00800000 != 0
+	overflow = word != 0 && (size > 34 ||
+		(word > 0xff && size > 33) ||
+		(word > 0xffff && size > 32))
+	if overflow {
+		n.And(n, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1)))
+	}
+	return
+}
+
 type StakeKernelTemplate struct {
 	BlockFromTime int64
 	StakeModifier uint64
@@ -82,92 +108,68 @@ type StakeKernelTemplate struct {
 	PrevTxOutIndex uint32
 	PrevTxOutValue int64
 
-	IsProtocolV03 bool
-	StakeMinAge   int64
-	Bits          uint32
-	TxTime        int64
+	Protocol    Protocol
+	StakeMinAge int64
+	Bits        uint32
+	TxTime      int64
 }
 
-func CheckStakeKernelHash(t *StakeKernelTemplate) (hashProofOfStake []byte, success bool, err error, minTarget *big.Int) {
-	success = false
+// KernelResult is the outcome of a stake kernel check. All fields are set
+// whether or not the kernel meets the target.
+type KernelResult struct {
+	Success bool
+	// Hash is the kernel hash in internal (little-endian) byte order,
+	// HashBE is the same hash big-endian, as displayed and compared.
+	Hash   [32]byte
+	HashBE [32]byte
+	// CoinDayWeight multiplied by the target per coin-day encoded in
+	// the template's Bits gives Target.
+	CoinDayWeight *big.Int
+	Target        *big.Int
+	// MinTarget is the lowest target per coin-day met by the kernel,
+	// MaxBits and MaxDiff are the matching highest compact bits and
+	// difficulty. MinTarget is nil (and MaxBits, MaxDiff zero) when
+	// the coin-day weight is zero.
+	MinTarget *big.Int
+	MaxBits   uint32
+	MaxDiff   float64
+}
 
-	if t.TxTime < t.PrevTxTime { // Transaction timestamp violation
-		err = errors.New("CheckStakeKernelHash() : nTime violation")
+// CheckStakeKernel checks the kernel described by the template against its
+// Bits. A kernel which misses the target isn't an error, see Success.
+func CheckStakeKernel(t *StakeKernelTemplate) (res KernelResult, err error) {
+	if err = checkTemplate(t); err != nil {
 		return
 	}
-
-	if t.BlockFromTime+t.StakeMinAge > t.TxTime { // Min age requirement
-		err = errors.New("CheckStakeKernelHash() : min age violation")
+	if err = checkTxTime(t); err != nil {
 		return
 	}
-
-	bnTargetPerCoinDay := CompactToBig(t.Bits)
-	var timeReduction int64
-	if t.IsProtocolV03 {
-		timeReduction = t.StakeMinAge
-	} else {
-		timeReduction = 0
-	}
-
-	var nTimeWeight int64 = t.TxTime - t.PrevTxTime
-	if nTimeWeight > stakeMaxAge {
-		nTimeWeight = stakeMaxAge
+	s := newKernelSearch(t)
+	res.Success = s.hash(t.TxTime)
+	copy(res.HashBE[:], s.sum)
+	for i := range res.HashBE {
+		res.Hash[i] = res.HashBE[len(res.HashBE)-1-i]
 	}
-	nTimeWeight -= timeReduction
-
-	var bnCoinDayWeight *big.Int
-	valueTime := t.PrevTxOutValue * nTimeWeight
-	if valueTime > 0 { // no overflow
-		bnCoinDayWeight = new(big.Int).SetInt64(valueTime / coinDay)
-	} else {
-		// overflow, calc w/ big.Int or return error?
-		// err = errors.New("valueTime overflow")
-		// return
-		bnCoinDayWeight = new(big.Int).Div(new(big.Int).
-			Div(
-			new(big.Int).Mul(big.NewInt(t.PrevTxOutValue), big.NewInt(nTimeWeight)),
-			new(big.Int).SetInt64(coin)),
-			big.NewInt(24*60*60))
+	res.CoinDayWeight = new(big.Int).Set(s.curWeight)
+	res.Target = new(big.Int).Set(s.curTarget)
+	if res.CoinDayWeight.Sign() > 0 {
+		res.MinTarget = new(big.Int).Sub(new(big.Int).Div(s.hashInt, res.CoinDayWeight), big.NewInt(1))
+		res.MaxBits = IncCompact(BigToCompact(res.MinTarget))
+		res.MaxDiff = compactToDiff64(res.MaxBits)
 	}
-	targetInt := new(big.Int).Mul(bnCoinDayWeight, bnTargetPerCoinDay)
-
-	buf := make([]byte, 28)
-	o := 0
+	return
+}
 
-	if t.IsProtocolV03 { // v0.3 protocol
-		d := t.StakeModifier
-		for i := 0; i < 8; i++ {
-			buf[o] = byte(d & 0xff)
-			d >>= 8
-			o++
-		}
-	} else { // v0.2 protocol
-		d := t.Bits
-		for i := 0; i < 4; i++ {
-			buf[o] = byte(d & 0xff)
-			d >>= 8
-			o++
-		}
-	}
-	data := [5]uint32{uint32(t.BlockFromTime), uint32(t.PrevTxOffset),
-		uint32(t.PrevTxTime), uint32(t.PrevTxOutIndex), uint32(t.TxTime)}
-	for _, d := range data {
-		for i := 0; i < 4; i++ {
-			buf[o] = byte(d & 0xff)
-			d >>= 8
-			o++
-		}
-	}
-	hashProofOfStake = doubleSha256(buf[:o])
-	buf = hashProofOfStake
-	for i, l := 0, len(buf); i < l/2; i++ {
-		buf[i], buf[l-1-i] = buf[l-1-i], buf[i]
-	}
-	hashProofOfStakeInt := new(big.Int).SetBytes(buf)
-	if hashProofOfStakeInt.Cmp(targetInt) > 0 {
+// CheckStakeKernelHash is the original interface of CheckStakeKernel, it returns
+// the big-endian kernel hash and, on success, the min target.
+func CheckStakeKernelHash(t *StakeKernelTemplate) (hashProofOfStake []byte, success bool, err error, minTarget *big.Int) {
+	res, err := CheckStakeKernel(t)
+	if err != nil {
 		return
 	}
-	minTarget = new(big.Int).Sub(new(big.Int).Div(hashProofOfStakeInt, bnCoinDayWeight), big.NewInt(1))
-	success = true
+	hashProofOfStake = res.HashBE[:]
+	if res.Success {
+		success, minTarget = true, res.MinTarget
+	}
 	return
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/kac-/umint"
+	"math/big"
 	"testing"
 	"time"
 )
@@ -16,7 +17,7 @@ var (
 	"PrevTxTime":1394219584,
 	"PrevTxOutIndex":1,
 	"PrevTxOutValue":210090000,
-	"IsProtocolV03":true,
+	"Protocol":"v0.4",
 	"StakeMinAge":2592000,
 	"Bits":471087779,
 	"TxTime":1411634680}`
@@ -85,3 +86,60 @@ func TestCheckFunctionPerformance(t *testing.T) {
 	}
 	fmt.Printf("100k checks took %v\n", time.Now().Sub(start))
 }
+
+func TestCheckStakeKernel(t *testing.T) {
+	tpl := umint.StakeKernelTemplate{}
+	err := json.Unmarshal([]byte(stpl0), &tpl)
+	if err != nil {
+		t.Errorf("unmarshalling: %v", err)
+		return
+	}
+	res, err := umint.CheckStakeKernel(&tpl)
+	if err != nil {
+		t.Errorf("checking good template: %v", err)
+		return
+	}
+	if !res.Success {
+		t.Errorf("wrong check result, have %v want %v", res.Success, true)
+		return
+	}
+	if !bytes.Equal(tpl0Hash, res.HashBE[:]) {
+		t.Errorf("wrong kernel hash, have %x want %x", res.HashBE, tpl0Hash)
+		return
+	}
+	for i := range res.Hash {
+		if res.Hash[i] != res.HashBE[31-i] {
+			t.Errorf("Hash is not reversed HashBE: %x %x", res.Hash, res.HashBE)
+			return
+		}
+	}
+	if res.Target.Cmp(new(big.Int).Mul(res.CoinDayWeight, umint.CompactToBig(tpl.Bits))) != 0 {
+		t.Errorf("target is not coin-day weight times target per coin-day")
+	}
+
+	// near miss, result is filled in and ranks below the template's difficulty
+	tpl.Bits = umint.IncCompact(umint.BigToCompact(res.MinTarget))
+	tpl.Bits = umint.BigToCompact(new(big.Int).Div(umint.CompactToBig(tpl.Bits), big.NewInt(2)))
+	miss, err := umint.CheckStakeKernel(&tpl)
+	if err != nil {
+		t.Errorf("checking near miss: %v", err)
+		return
+	}
+	if miss.Success {
+		t.Errorf("wrong near miss check result, have %v want %v", miss.Success, false)
+		return
+	}
+	if miss.MaxBits != res.MaxBits || miss.MaxDiff != res.MaxDiff || miss.MinTarget.Cmp(res.MinTarget) != 0 {
+		t.Errorf("near miss result differs: %08x %v", miss.MaxBits, miss.MaxDiff)
+	}
+	if miss.MaxDiff >= float64(umint.CompactToDiff(tpl.Bits)) {
+		t.Errorf("near miss max diff %v not below %v", miss.MaxDiff, umint.CompactToDiff(tpl.Bits))
+	}
+	if d := float64(umint.CompactToDiff(miss.MaxBits)); d/miss.MaxDiff > 1.00001 || d/miss.MaxDiff < 0.99999 {
+		t.Errorf("max diff %v doesn't match max bits %08x (%v)", miss.MaxDiff, miss.MaxBits, d)
+	}
+	tpl.Bits = miss.MaxBits
+	if res, _ = umint.CheckStakeKernel(&tpl); !res.Success {
+		t.Errorf("kernel fails at its max bits")
+	}
+}
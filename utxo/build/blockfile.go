@@ -0,0 +1,118 @@
+package build
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/mably/btcwire"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// maxBlockSize bounds block records, larger sizes mean a corrupt file.
+const maxBlockSize = 1 << 25
+
+// BlockPos locates a block record in the block files.
+type BlockPos struct {
+	// File is the number of the blk%04d.dat file.
+	File int
+	// Offset is the position of the block, after the record's magic and size.
+	Offset int64
+	Size   uint32
+}
+
+// BlockFiles reads the blk0001.dat, blk0002.dat, ... files ppcoind stores
+// blocks in, each block prefixed by the network's magic and its size.
+type BlockFiles struct {
+	Dir   string
+	Magic btcwire.BitcoinNet
+
+	files map[int]*os.File
+}
+
+// NewBlockFiles returns the block files of dir.
+func NewBlockFiles(dir string, magic btcwire.BitcoinNet) *BlockFiles {
+	return &BlockFiles{Dir: dir, Magic: magic, files: make(map[int]*os.File)}
+}
+
+func (f *BlockFiles) path(file int) string {
+	return filepath.Join(f.Dir, fmt.Sprintf("blk%04d.dat", file))
+}
+
+func (f *BlockFiles) open(file int) (*os.File, error) {
+	if fd, ok := f.files[file]; ok {
+		return fd, nil
+	}
+	fd, err := os.Open(f.path(file))
+	if err != nil {
+		return nil, err
+	}
+	f.files[file] = fd
+	return fd, nil
+}
+
+// Scan calls fn with every block record of the files in file order. A
+// record without the magic ends its file, ppcoind leaves garbage after the
+// last block it flushed.
+func (f *BlockFiles) Scan(fn func(pos BlockPos, raw []byte) error) error {
+	for file := 1; ; file++ {
+		fd, err := f.open(file)
+		if os.IsNotExist(err) {
+			if file == 1 {
+				return fmt.Errorf("no block files in %v", f.Dir)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r := bufio.NewReaderSize(fd, 1<<20)
+		var header [8]byte
+		for offset := int64(0); ; {
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				break
+			}
+			size := binary.LittleEndian.Uint32(header[4:])
+			if btcwire.BitcoinNet(binary.LittleEndian.Uint32(header[:4])) != f.Magic || size > maxBlockSize {
+				break
+			}
+			raw := make([]byte, size)
+			if _, err := io.ReadFull(r, raw); err != nil {
+				break
+			}
+			if err := fn(BlockPos{File: file, Offset: offset + 8, Size: size}, raw); err != nil {
+				return err
+			}
+			offset += 8 + int64(size)
+		}
+	}
+}
+
+// Read returns the block at pos.
+func (f *BlockFiles) Read(pos BlockPos) ([]byte, error) {
+	fd, err := f.open(pos.File)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, pos.Size)
+	if _, err := fd.ReadAt(raw, pos.Offset); err != nil {
+		return nil, fmt.Errorf("read block at %v:%d: %v", f.path(pos.File), pos.Offset, err)
+	}
+	return raw, nil
+}
+
+// Close closes the opened files.
+func (f *BlockFiles) Close() error {
+	var err error
+	for file, fd := range f.files {
+		if e := fd.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(f.files, file)
+	}
+	return err
+}
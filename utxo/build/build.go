@@ -0,0 +1,276 @@
+// Package build builds the unspent outputs database read by package utxo
+// from the blk*.dat files of a ppcoind data directory.
+//
+// The best chain is selected by chain trust among the stored blocks, then
+// connected from genesis: proof-of-stake kernels are rechecked to recompute
+// the stake modifiers (verified against the network's checkpoints) and
+// every output is stored with its block time, offset in block and the kernel
+// stake modifier of its block. Outputs younger than a stake modifier
+// selection interval at the top block have no stake modifier yet, they're
+// left pending (see utxo.ConnectBlock). Undo records are kept for the top
+// KeepUndo blocks only. The block index of the chain, from which the stake
+// modifiers can be verified again, is optionally written to a file (see
+// umint.WriteBlockIndex).
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcwire"
+	"io"
+	"math/big"
+)
+
+// Version identifies the stake modifier computation of the builder, it's
+// recorded as the Builder of the built database's metadata.
+const Version = "umint/build 1"
+
+// DefaultKeepUndo is the default Builder.KeepUndo.
+const DefaultKeepUndo = 500
+
+// Builder builds the unspent database from block files.
+type Builder struct {
+	Net   *umint.Network
+	Files *BlockFiles
+	// Height is the top block of the built database, the best chain's top
+	// if 0.
+	Height int32
+	// Progress, if set, is called after every connected block.
+	Progress func(height int32, blockTime int64)
+	// KeepUndo is the number of top blocks whose undo records are kept for
+	// reorganizations, DefaultKeepUndo if 0.
+	KeepUndo int32
+	// Index, if set, receives the block index record of every connected
+	// block, see umint.VerifyStakeModifierFile.
+	Index io.Writer
+
+	tip      *umint.BlockNode
+	checksum uint32
+	// blocks with outputs waiting for their kernel stake modifier
+	pending []*pendingBlock
+}
+
+type pendingBlock struct {
+	node      *umint.BlockNode
+	outPoints []*btcwire.OutPoint
+}
+
+// blockEntry is a stored block, chained to its parent.
+type blockEntry struct {
+	hash   btcwire.ShaHash
+	prev   *blockEntry
+	pos    BlockPos
+	height int32
+	trust  *big.Int
+}
+
+// isProofOfStake tells if block's second transaction is a coinstake.
+func isProofOfStake(block *btcwire.MsgBlock) bool {
+	if len(block.Transactions) < 2 {
+		return false
+	}
+	tx := block.Transactions[1]
+	return len(tx.TxIn) > 0 && !tx.IsCoinBase() &&
+		len(tx.TxOut) >= 2 && tx.TxOut[0].Value == 0 && len(tx.TxOut[0].PkScript) == 0
+}
+
+// bestChain indexes the stored blocks and returns the chain with the most
+// trust, from genesis. Blocks whose parent isn't stored before them are
+// ignored.
+func (b *Builder) bestChain() ([]*blockEntry, error) {
+	entries := make(map[btcwire.ShaHash]*blockEntry)
+	var best *blockEntry
+	err := b.Files.Scan(func(pos BlockPos, raw []byte) error {
+		var block btcwire.MsgBlock
+		if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+			return fmt.Errorf("block at blk%04d.dat:%d: %v", pos.File, pos.Offset, err)
+		}
+		hash, _ := block.BlockSha()
+		if _, ok := entries[hash]; ok {
+			return nil
+		}
+		e := &blockEntry{hash: hash, pos: pos, trust: new(big.Int)}
+		if block.Header.PrevBlock != (btcwire.ShaHash{}) {
+			if e.prev = entries[block.Header.PrevBlock]; e.prev == nil {
+				return nil
+			}
+			e.height = e.prev.height + 1
+			e.trust.Set(e.prev.trust)
+		}
+		e.trust.Add(e.trust, umint.BlockTrust(block.Header.Bits, isProofOfStake(&block),
+			b.Net.ProtocolAt(block.Header.Timestamp.Unix())))
+		entries[hash] = e
+		if best == nil || e.trust.Cmp(best.trust) > 0 {
+			best = e
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no blocks in %v", b.Files.Dir)
+	}
+	chain := make([]*blockEntry, best.height+1)
+	for e := best; e != nil; e = e.prev {
+		chain[e.height] = e
+	}
+	if chain[0].prev != nil || chain[0].height != 0 {
+		return nil, fmt.Errorf("best chain doesn't start at genesis")
+	}
+	if b.Height > 0 {
+		if int(b.Height) >= len(chain) {
+			return nil, fmt.Errorf("best chain ends at height %d", len(chain)-1)
+		}
+		chain = chain[:b.Height+1]
+	}
+	return chain, nil
+}
+
+// Build connects the best chain's blocks to the empty database db, tagged
+// with the network of the block files and its genesis block.
+func (b *Builder) Build(db utxo.Store) error {
+	chain, err := b.bestChain()
+	if err != nil {
+		return err
+	}
+	meta := &utxo.Meta{
+		Version: utxo.SchemaVersion,
+		Net:     b.Files.Magic,
+		Genesis: chain[0].hash,
+		Builder: Version,
+	}
+	if err := utxo.PutMeta(db, meta); err != nil {
+		return fmt.Errorf("write meta: %v", err)
+	}
+	keepUndo := b.KeepUndo
+	if keepUndo <= 0 {
+		keepUndo = DefaultKeepUndo
+	}
+	b.tip, b.checksum, b.pending = nil, 0, nil
+	for _, e := range chain {
+		raw, err := b.Files.Read(e.pos)
+		if err != nil {
+			return err
+		}
+		var block btcwire.MsgBlock
+		if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+			return fmt.Errorf("block %v: %v", e.hash, err)
+		}
+		if err := b.connect(db, e.height, &e.hash, &block); err != nil {
+			return fmt.Errorf("connect block %v at height %d: %v", e.hash, e.height, err)
+		}
+		// keep the undo records of the top keepUndo blocks
+		top := int32(len(chain) - 1)
+		if e.height >= keepUndo && (e.height%keepUndo == 0 || e.height == top) {
+			if err := utxo.PruneUndo(db, uint32(e.height-keepUndo+1)); err != nil {
+				return fmt.Errorf("prune undo records: %v", err)
+			}
+		}
+		if b.Progress != nil {
+			b.Progress(e.height, block.Header.Timestamp.Unix())
+		}
+	}
+	return nil
+}
+
+// kernelHash returns the proof-of-stake hash of block.
+func (b *Builder) kernelHash(db utxo.Store, block *btcwire.MsgBlock) (*btcwire.ShaHash, error) {
+	coinStake := block.Transactions[1]
+	prevOut := &coinStake.TxIn[0].PreviousOutPoint
+	u, err := db.FetchUTXO(prevOut)
+	if err != nil {
+		return nil, fmt.Errorf("kernel: %v", err)
+	}
+	txTime := coinStake.Time.Unix()
+	tpl := umint.StakeKernelTemplate{
+		BlockFromTime:  int64(u.BlockTime),
+		StakeModifier:  u.StakeModifier,
+		PrevTxOffset:   u.OffsetInBlock,
+		PrevTxTime:     int64(u.Time),
+		PrevTxOutIndex: prevOut.Index,
+		PrevTxOutValue: int64(u.Value),
+		Protocol:       b.Net.ProtocolAt(txTime),
+		StakeMinAge:    b.Net.StakeMinAge,
+		Bits:           block.Header.Bits,
+		TxTime:         txTime,
+	}
+	if tpl.Protocol >= umint.ProtocolV05 {
+		if tpl.StakeModifier, _, _, err = umint.KernelStakeModifierV05(b.Net, b.tip, txTime); err != nil {
+			return nil, err
+		}
+	}
+	res, err := umint.CheckStakeKernel(&tpl)
+	if err != nil {
+		return nil, fmt.Errorf("kernel %v:%d: %v", prevOut.Hash, prevOut.Index, err)
+	}
+	if !res.Success {
+		return nil, fmt.Errorf("kernel %v:%d doesn't meet target %08x", prevOut.Hash, prevOut.Index, tpl.Bits)
+	}
+	hash := btcwire.ShaHash(res.Hash)
+	return &hash, nil
+}
+
+// resolveModifiers pops the pending blocks whose kernel stake modifier is
+// known at the tip and returns the updates setting them.
+func (b *Builder) resolveModifiers() []utxo.ModifierUpdate {
+	var updates []utxo.ModifierUpdate
+	for len(b.pending) > 0 {
+		p := b.pending[0]
+		modifier, _, _, err := umint.KernelStakeModifier(b.Net, p.node)
+		if err != nil {
+			break // not generated yet
+		}
+		updates = append(updates, utxo.ModifierUpdate{OutPoints: p.outPoints, Modifier: modifier})
+		b.pending = b.pending[1:]
+	}
+	return updates
+}
+
+// connect appends block to the chain and connects it to db along with the
+// stake modifiers it makes known.
+func (b *Builder) connect(db utxo.Store, height int32, hash *btcwire.ShaHash, block *btcwire.MsgBlock) error {
+	node := &umint.BlockNode{
+		BlockTime:  block.Header.Timestamp.Unix(),
+		BlockHash:  *hash,
+		EntropyBit: b.Net.StakeEntropyBit(height, hash, block.Signature),
+	}
+	if isProofOfStake(block) {
+		kernelHash, err := b.kernelHash(db, block)
+		if err != nil {
+			return err
+		}
+		node.ProofOfStake, node.HashProofOfStake = true, *kernelHash
+	}
+	tip, err := b.tip.Append(b.Net, node)
+	if err != nil {
+		return err
+	}
+	b.tip = tip
+	b.checksum = umint.StakeModifierChecksum(tip, b.checksum)
+	if want, ok := b.Net.ModifierCheckpoints[height]; ok && want != b.checksum {
+		return &umint.ChecksumMismatchError{Height: height, Have: b.checksum, Want: want}
+	}
+	if b.Index != nil {
+		if err := umint.WriteBlockIndex(b.Index, tip); err != nil {
+			return fmt.Errorf("write block index: %v", err)
+		}
+	}
+
+	if err := utxo.ConnectBlock(db, block, uint32(height), b.resolveModifiers()...); err != nil {
+		return err
+	}
+	pending := &pendingBlock{node: tip}
+	for _, tx := range block.Transactions {
+		txSha, _ := tx.TxSha()
+		for idx, out := range tx.TxOut {
+			if len(out.PkScript) > 0 {
+				pending.outPoints = append(pending.outPoints, btcwire.NewOutPoint(&txSha, uint32(idx)))
+			}
+		}
+	}
+	b.pending = append(b.pending, pending)
+	return nil
+}
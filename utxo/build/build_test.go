@@ -0,0 +1,269 @@
+package build_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/kac-/umint"
+	"github.com/kac-/umint/utxo"
+	"github.com/kac-/umint/utxo/build"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testChain is a chain of blocks spaced an hour apart, minted by key A.
+type testChain struct {
+	blocks []*btcwire.MsgBlock
+	start  int64
+	pubKey []byte
+}
+
+func payToPubKeyHash(hash []byte) []byte {
+	return append(append([]byte{0x76, 0xa9, 20}, hash...), 0x88, 0xac)
+}
+
+func (c *testChain) scriptA() []byte {
+	return append(append([]byte{33}, c.pubKey...), 0xac)
+}
+
+// block appends a block on top of prev (the last block if nil) holding a
+// coinbase paying to A (empty if coinStake is set), coinStake and txs.
+func (c *testChain) block(prev *btcwire.MsgBlock, bits uint32, coinStake *btcwire.MsgTx, txs ...*btcwire.MsgTx) *btcwire.MsgBlock {
+	var prevHash btcwire.ShaHash
+	if prev == nil && len(c.blocks) > 0 {
+		prev = c.blocks[len(c.blocks)-1]
+	}
+	if prev != nil {
+		prevHash, _ = prev.BlockSha()
+	}
+	blockTime := time.Unix(c.start+int64(len(c.blocks))*3600, 0)
+	block := btcwire.NewMsgBlock(btcwire.NewBlockHeader(&prevHash, &btcwire.ShaHash{}, bits, 0))
+	block.Header.Timestamp = blockTime
+	coinbase := btcwire.NewMsgTx()
+	coinbase.Time = blockTime
+	coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{}, 0xffffffff),
+		[]byte{4, byte(len(c.blocks)), 0, 0, 0}))
+	if coinStake == nil {
+		coinbase.AddTxOut(btcwire.NewTxOut(50e6, c.scriptA()))
+	} else {
+		coinbase.AddTxOut(btcwire.NewTxOut(0, nil))
+	}
+	block.AddTransaction(coinbase)
+	if coinStake != nil {
+		coinStake.Time = blockTime
+		block.AddTransaction(coinStake)
+	}
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	block.Signature = []byte{byte(len(c.blocks))}
+	c.blocks = append(c.blocks, block)
+	return block
+}
+
+func spend(prev *btcwire.MsgTx, index uint32, outs ...*btcwire.TxOut) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx()
+	tx.Time = prev.Time.Add(time.Minute)
+	sha, _ := prev.TxSha()
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&sha, index), nil))
+	for _, out := range outs {
+		tx.AddTxOut(out)
+	}
+	return tx
+}
+
+func writeBlockFile(t *testing.T, path string, blocks []*btcwire.MsgBlock, garbage bool) {
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		var raw bytes.Buffer
+		if err := block.Serialize(&raw); err != nil {
+			t.Fatalf("serialize: %v", err)
+		}
+		binary.Write(&buf, binary.LittleEndian, uint32(btcwire.TestNet3))
+		binary.Write(&buf, binary.LittleEndian, uint32(raw.Len()))
+		buf.Write(raw.Bytes())
+	}
+	if garbage {
+		buf.Write(make([]byte, 100))
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("write block file: %v", err)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	net := *umint.TestNet
+	net.ModifierCheckpoints = nil
+	c := &testChain{start: 1400000000, pubKey: append([]byte{2}, bytes.Repeat([]byte{7}, 32)...)}
+	hashA := btcutil.Hash160(c.pubKey)
+	hashB, hashC := bytes.Repeat([]byte{0xb}, 20), bytes.Repeat([]byte{0xc}, 20)
+	const bits = 0x2000ffff
+
+	c.block(nil, bits, nil)
+	c.block(nil, bits, nil)
+	c.block(nil, bits, nil)
+	// block 3 pays block 1's coinbase to B and spends the change in the block
+	pay := spend(c.blocks[1].Transactions[0], 0,
+		btcwire.NewTxOut(40e6, payToPubKeyHash(hashB)), btcwire.NewTxOut(10e6, c.scriptA()))
+	change := spend(pay, 1, btcwire.NewTxOut(10e6, payToPubKeyHash(hashC)))
+	c.block(nil, bits, nil, pay, change)
+	for len(c.blocks) < 11 {
+		c.block(nil, bits, nil)
+	}
+	// a shorter fork from block 9 moves B's coins to C
+	fork := c.block(c.blocks[9], bits, nil, spend(pay, 0, btcwire.NewTxOut(40e6, payToPubKeyHash(hashC))))
+	c.block(fork, bits, nil)
+	c.block(c.blocks[10], bits, nil)
+	for len(c.blocks) < 32 {
+		c.block(nil, bits, nil)
+	}
+	// B stakes the coins paid in block 3, at a target any kernel meets
+	coinStake := spend(pay, 0, btcwire.NewTxOut(0, nil), btcwire.NewTxOut(41e6, payToPubKeyHash(hashB)))
+	staked := c.block(nil, 0x207fffff, coinStake)
+	c.block(nil, bits, nil)
+	main := append(append([]*btcwire.MsgBlock{}, c.blocks[:11]...), c.blocks[13:]...)
+
+	dir := t.TempDir()
+	writeBlockFile(t, filepath.Join(dir, "blk0001.dat"), c.blocks[:20], true)
+	writeBlockFile(t, filepath.Join(dir, "blk0002.dat"), c.blocks[20:], false)
+	files := build.NewBlockFiles(dir, btcwire.TestNet3)
+	defer files.Close()
+
+	db, err := utxo.OpenLevelDB(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	var connected int32 = -1
+	var index bytes.Buffer
+	b := &build.Builder{Net: &net, Files: files, Index: &index, Progress: func(height int32, _ int64) { connected = height }}
+	if err := b.Build(db); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	top := int32(len(main) - 1)
+	height, topTime, err := db.FetchHeight()
+	if err != nil || connected != top || height != uint32(top) || !topTime.Equal(main[top].Header.Timestamp) {
+		t.Fatalf("wrong top %d %v (connected %d), want %d: %v", height, topTime, connected, top, err)
+	}
+	if indexed, _, err := umint.VerifyStakeModifierFile(&net, &index); err != nil || indexed != top {
+		t.Errorf("block index verified up to %d, want %d: %v", indexed, top, err)
+	}
+	genesis, _ := c.blocks[0].BlockSha()
+	wantMeta := &utxo.Meta{Version: utxo.SchemaVersion, Net: btcwire.TestNet3, Genesis: genesis, Builder: build.Version}
+	if meta, err := utxo.FetchMeta(db); err != nil || !reflect.DeepEqual(meta, wantMeta) {
+		t.Errorf("meta %+v, want %+v: %v", meta, wantMeta, err)
+	}
+
+	// fetch returns every indexed output of hash, waiting for its stake
+	// modifier or not
+	fetch := func(hash []byte) ([]*btcwire.OutPoint, []*utxo.UTXO) {
+		var outPoints []*btcwire.OutPoint
+		prefix := append([]byte{utxo.DB_ADDR}, hash...)
+		err := db.Seek(prefix, func(key, value []byte) bool {
+			if !bytes.HasPrefix(key, prefix) {
+				return false
+			}
+			outPoints = append(outPoints, utxo.DeserializeOutPoint(value))
+			return true
+		})
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		utxos := make([]*utxo.UTXO, len(outPoints))
+		for i, outPoint := range outPoints {
+			if utxos[i], err = db.FetchUTXO(outPoint); err != nil {
+				t.Fatalf("fetch utxo: %v", err)
+			}
+		}
+		return outPoints, utxos
+	}
+	// every main chain coinbase but the spent one and the stake block's
+	if outPoints, _ := fetch(hashA); len(outPoints) != len(main)-2 {
+		t.Errorf("A has %d outputs, want %d", len(outPoints), len(main)-2)
+	}
+	if outPoints, utxos := fetch(hashC); len(outPoints) != 1 || utxos[0].Value != 10e6 {
+		t.Errorf("wrong outputs of C %v", outPoints)
+	}
+	outPoints, utxos := fetch(hashB)
+	if len(outPoints) != 1 {
+		t.Fatalf("B has %d outputs", len(outPoints))
+	}
+	var raw bytes.Buffer
+	staked.Serialize(&raw)
+	locs, _ := new(btcwire.MsgBlock).DeserializeTxLoc(&raw)
+	stakeSha, _ := coinStake.TxSha()
+	want := utxo.UTXO{
+		BlockTime:     uint32(staked.Header.Timestamp.Unix()),
+		OffsetInBlock: uint32(locs[1].TxStart),
+		Time:          uint32(staked.Header.Timestamp.Unix()),
+		Value:         41e6,
+	}
+	u := utxos[0]
+	if *outPoints[0] != *btcwire.NewOutPoint(&stakeSha, 1) || u.BlockTime != want.BlockTime ||
+		u.OffsetInBlock != want.OffsetInBlock || u.Time != want.Time || u.Value != want.Value ||
+		!bytes.Equal(u.PkScript, payToPubKeyHash(hashB)) {
+		t.Errorf("wrong coinstake output %+v, want %+v", u, want)
+	}
+	if u.StakeModifier != 0 {
+		t.Errorf("modifier of the top output is known")
+	}
+	// the coin queries skip it until then
+	for _, test := range []struct {
+		hash  []byte
+		count int
+	}{{hashB, 0}, {hashC, 1}} {
+		addr, _ := btcutil.NewAddressPubKeyHash(test.hash, &btcnet.TestNet3Params)
+		if outPoints, _, err := db.FetchCoins(addr); err != nil || len(outPoints) != test.count {
+			t.Errorf("fetched %v of %x, want %d: %v", outPoints, test.hash, test.count, err)
+		}
+	}
+
+	// the kernel stake modifier of block 2's coinbase
+	var tip *umint.BlockNode
+	var nodes []*umint.BlockNode
+	for i, block := range main[:len(main)-2] {
+		hash, _ := block.BlockSha()
+		tip, err = tip.Append(&net, &umint.BlockNode{
+			BlockTime:  block.Header.Timestamp.Unix(),
+			BlockHash:  hash,
+			EntropyBit: net.StakeEntropyBit(int32(i), &hash, block.Signature),
+		})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		nodes = append(nodes, tip)
+	}
+	modifier, _, _, err := umint.KernelStakeModifier(&net, nodes[2])
+	if err != nil {
+		t.Fatalf("kernel stake modifier: %v", err)
+	}
+	coinbaseSha, _ := main[2].Transactions[0].TxSha()
+	if u, err := db.FetchUTXO(btcwire.NewOutPoint(&coinbaseSha, 0)); err != nil || u.StakeModifier != modifier {
+		t.Errorf("wrong stake modifier %v, want %016x: %v", u, modifier, err)
+	}
+
+	// stop at a height
+	db2, err := utxo.OpenLevelDB(filepath.Join(dir, "db2"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db2.Close()
+	b = &build.Builder{Net: &net, Files: files, Height: 5, KeepUndo: 2}
+	if err := b.Build(db2); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if height, _, _ := db2.FetchHeight(); height != 5 {
+		t.Errorf("built up to %d", height)
+	}
+	if _, err := utxo.FetchUndo(db2, 3); err != utxo.ErrNoUndo {
+		t.Errorf("undo record below the kept ones: %v", err)
+	}
+	if _, err := utxo.FetchUndo(db2, 4); err != nil {
+		t.Errorf("kept undo record: %v", err)
+	}
+}
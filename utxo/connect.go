@@ -0,0 +1,384 @@
+package utxo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mably/btcwire"
+)
+
+// ErrNoUndo is returned when disconnecting a block without undo record.
+var ErrNoUndo = errors.New("no undo record for the top block")
+
+// BlockUndo is what DisconnectBlock needs to roll a connected block back.
+type BlockUndo struct {
+	Hash      btcwire.ShaHash
+	PrevBlock btcwire.ShaHash
+	// PrevTime is the time of the previous top block.
+	PrevTime uint32
+	// Created are the outputs added by the block.
+	Created []*btcwire.OutPoint
+	// Spent are the outputs spent by the block, as they were stored, and
+	// whether they were waiting for their stake modifier.
+	Spent        []*btcwire.OutPoint
+	SpentUTXOs   []*UTXO
+	SpentPending []bool
+	// Modified are the unspent outputs the block set the stake modifier of.
+	Modified []*btcwire.OutPoint
+}
+
+// ModifierUpdate sets the stake modifier of outputs waiting for it.
+type ModifierUpdate struct {
+	OutPoints []*btcwire.OutPoint
+	Modifier  uint64
+}
+
+func serializeUndoKey(height uint32) []byte {
+	key := make([]byte, 1+4)
+	key[0] = DB_UNDO
+	// big-endian so records sort by height
+	binary.BigEndian.PutUint32(key[1:], height)
+	return key
+}
+
+func serializeUndo(undo *BlockUndo) []byte {
+	var buf bytes.Buffer
+	var b [4]byte
+	putUint32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(b[:], v)
+		buf.Write(b[:])
+	}
+	buf.Write(undo.Hash[:])
+	buf.Write(undo.PrevBlock[:])
+	putUint32(undo.PrevTime)
+	putUint32(uint32(len(undo.Created)))
+	for _, outPoint := range undo.Created {
+		buf.Write(SerializeOutPoint(outPoint)[1:])
+	}
+	putUint32(uint32(len(undo.Spent)))
+	for i, outPoint := range undo.Spent {
+		buf.Write(SerializeOutPoint(outPoint)[1:])
+		u := SerializeUTXO(undo.SpentUTXOs[i])
+		putUint32(uint32(len(u)))
+		buf.Write(u)
+		if undo.SpentPending[i] {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	putUint32(uint32(len(undo.Modified)))
+	for _, outPoint := range undo.Modified {
+		buf.Write(SerializeOutPoint(outPoint)[1:])
+	}
+	return buf.Bytes()
+}
+
+func deserializeUndo(buf []byte) (*BlockUndo, error) {
+	errShort := errors.New("truncated undo record")
+	undo := &BlockUndo{}
+	if len(buf) < 32+32+4+4 {
+		return nil, errShort
+	}
+	copy(undo.Hash[:], buf[0:])
+	copy(undo.PrevBlock[:], buf[32:])
+	undo.PrevTime = binary.LittleEndian.Uint32(buf[64:])
+	count := binary.LittleEndian.Uint32(buf[68:])
+	buf = buf[72:]
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 36 {
+			return nil, errShort
+		}
+		undo.Created = append(undo.Created, DeserializeOutPoint(append([]byte{DB_UTXO}, buf[:36]...)))
+		buf = buf[36:]
+	}
+	if len(buf) < 4 {
+		return nil, errShort
+	}
+	count, buf = binary.LittleEndian.Uint32(buf), buf[4:]
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 36+4 {
+			return nil, errShort
+		}
+		outPoint := DeserializeOutPoint(append([]byte{DB_UTXO}, buf[:36]...))
+		l := binary.LittleEndian.Uint32(buf[36:])
+		buf = buf[36+4:]
+		if uint32(len(buf)) < l+1 || l < 28 {
+			return nil, errShort
+		}
+		undo.Spent = append(undo.Spent, outPoint)
+		undo.SpentUTXOs = append(undo.SpentUTXOs, DeserializeUTXO(buf[:l]))
+		undo.SpentPending = append(undo.SpentPending, buf[l] != 0)
+		buf = buf[l+1:]
+	}
+	if len(buf) < 4 {
+		return nil, errShort
+	}
+	count, buf = binary.LittleEndian.Uint32(buf), buf[4:]
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 36 {
+			return nil, errShort
+		}
+		undo.Modified = append(undo.Modified, DeserializeOutPoint(append([]byte{DB_UTXO}, buf[:36]...)))
+		buf = buf[36:]
+	}
+	return undo, nil
+}
+
+// FetchUndo returns the undo record of the block connected at height.
+func FetchUndo(s Store, height uint32) (*BlockUndo, error) {
+	value, err := s.Get(serializeUndoKey(height))
+	if err == ErrNotFound {
+		return nil, ErrNoUndo
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching undo(%v): %w", height, err)
+	}
+	return deserializeUndo(value)
+}
+
+// varIntSize is the serialized size of a variable length integer.
+func varIntSize(v uint64) int {
+	switch {
+	case v < 0xfd:
+		return 1
+	case v <= 0xffff:
+		return 3
+	case v <= 0xffffffff:
+		return 5
+	}
+	return 9
+}
+
+// txOffsets returns the offsets of the block's transactions from the start
+// of the serialized block.
+func txOffsets(block *btcwire.MsgBlock) []uint32 {
+	offsets := make([]uint32, len(block.Transactions))
+	offset := 80 + varIntSize(uint64(len(block.Transactions)))
+	for i, tx := range block.Transactions {
+		offsets[i] = uint32(offset)
+		offset += tx.SerializeSize()
+	}
+	return offsets
+}
+
+// serializePendingKey returns the DB_PENDING key marking the output as
+// waiting for its stake modifier.
+func serializePendingKey(outPoint *btcwire.OutPoint) []byte {
+	key := SerializeOutPoint(outPoint)
+	key[0] = DB_PENDING
+	return key
+}
+
+// isPending tells if the output is waiting for its stake modifier.
+func isPending(s Store, outPoint *btcwire.OutPoint) (bool, error) {
+	_, err := s.Get(serializePendingKey(outPoint))
+	switch {
+	case err == ErrNotFound:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("fetching pending(%v): %w", outPoint, err)
+	}
+	return true, nil
+}
+
+func putUTXO(batch *Batch, outPoint *btcwire.OutPoint, u *UTXO, pending bool) {
+	key := SerializeOutPoint(outPoint)
+	batch.Put(key, SerializeUTXO(u))
+	if hash, ok := ScriptHash(u.PkScript); ok {
+		batch.Put(SerializeAddrKey(hash, outPoint, u), key)
+	}
+	if pending {
+		batch.Put(serializePendingKey(outPoint), nil)
+	} else {
+		batch.Delete(serializePendingKey(outPoint))
+	}
+}
+
+func deleteUTXO(batch *Batch, outPoint *btcwire.OutPoint, u *UTXO) {
+	batch.Delete(SerializeOutPoint(outPoint))
+	if hash, ok := ScriptHash(u.PkScript); ok {
+		batch.Delete(SerializeAddrKey(hash, outPoint, u))
+	}
+	batch.Delete(serializePendingKey(outPoint))
+}
+
+// ConnectBlock adds the outputs of block, connected at height, removes the
+// outputs it spends, sets the stake modifiers of updates and advances
+// DB_HEIGHT, storing an undo record for DisconnectBlock, all in one batch.
+// height must follow the top height, unless the database is empty and
+// height is 0. The block must follow the top block if its undo record is
+// known.
+//
+// New outputs have no stake modifier, it's known about a stake modifier
+// selection interval later. They're marked pending, and skipped by the
+// coin queries, until an update of a later block sets it.
+func ConnectBlock(s Store, block *btcwire.MsgBlock, height uint32, updates ...ModifierUpdate) error {
+	hash, _ := block.BlockSha()
+	undo := &BlockUndo{Hash: hash, PrevBlock: block.Header.PrevBlock}
+	topHeight, topTime, err := s.FetchHeight()
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if height != 0 {
+			return fmt.Errorf("connect block %v at %d to empty db", hash, height)
+		}
+	case err != nil:
+		return err
+	case height != topHeight+1:
+		return fmt.Errorf("connect block %v at %d on top of %d", hash, height, topHeight)
+	default:
+		undo.PrevTime = uint32(topTime.Unix())
+		if top, err := FetchUndo(s, topHeight); err == nil && top.Hash != block.Header.PrevBlock {
+			return fmt.Errorf("block %v doesn't follow top block %v", hash, top.Hash)
+		}
+	}
+
+	modified := make(map[btcwire.OutPoint]*UTXO)
+	for _, update := range updates {
+		for _, outPoint := range update.OutPoints {
+			if pending, err := isPending(s, outPoint); err != nil || !pending {
+				if err != nil {
+					return err
+				}
+				continue // spent or already set
+			}
+			u, err := s.FetchUTXO(outPoint)
+			if err != nil {
+				return err
+			}
+			u.StakeModifier = update.Modifier
+			modified[*outPoint] = u
+		}
+	}
+
+	batch := new(Batch)
+	blockTime := uint32(block.Header.Timestamp.Unix())
+	offsets := txOffsets(block)
+	created := make(map[btcwire.OutPoint]*UTXO)
+	for i, tx := range block.Transactions {
+		if !tx.IsCoinBase() {
+			for _, in := range tx.TxIn {
+				outPoint := in.PreviousOutPoint
+				u, ok := created[outPoint]
+				if ok {
+					delete(created, outPoint)
+				} else if u, err = s.FetchUTXO(&outPoint); err != nil {
+					return fmt.Errorf("block %v spends: %w", hash, err)
+				}
+				deleteUTXO(batch, &outPoint, u)
+				if !ok {
+					pending, err := isPending(s, &outPoint)
+					if err != nil {
+						return err
+					}
+					undo.Spent = append(undo.Spent, &outPoint)
+					undo.SpentUTXOs = append(undo.SpentUTXOs, u)
+					undo.SpentPending = append(undo.SpentPending, pending)
+					delete(modified, outPoint)
+				}
+			}
+		}
+		txSha, _ := tx.TxSha()
+		for idx, out := range tx.TxOut {
+			if len(out.PkScript) == 0 { // coinstake marker
+				continue
+			}
+			outPoint := btcwire.NewOutPoint(&txSha, uint32(idx))
+			u := &UTXO{
+				BlockTime:     blockTime,
+				OffsetInBlock: offsets[i],
+				Time:          uint32(tx.Time.Unix()),
+				Value:         uint64(out.Value),
+				PkScript:      out.PkScript,
+			}
+			created[*outPoint] = u
+			putUTXO(batch, outPoint, u, true)
+		}
+	}
+	for _, update := range updates {
+		for _, outPoint := range update.OutPoints {
+			if u := modified[*outPoint]; u != nil {
+				putUTXO(batch, outPoint, u, false)
+				undo.Modified = append(undo.Modified, outPoint)
+				delete(modified, *outPoint)
+			}
+		}
+	}
+	for _, tx := range block.Transactions {
+		txSha, _ := tx.TxSha()
+		for idx := range tx.TxOut {
+			if outPoint := btcwire.NewOutPoint(&txSha, uint32(idx)); created[*outPoint] != nil {
+				undo.Created = append(undo.Created, outPoint)
+			}
+		}
+	}
+	batch.Put(serializeUndoKey(height), serializeUndo(undo))
+	batch.Put([]byte{DB_HEIGHT}, SerializeHeight(height, blockTime))
+	if err := s.Write(batch); err != nil {
+		return fmt.Errorf("connect block %v: %w", hash, err)
+	}
+	return nil
+}
+
+// DisconnectBlock rolls the top block back with its undo record: its
+// outputs are removed, the outputs it spent restored, the stake modifiers it
+// set reset to pending and DB_HEIGHT moved to the previous block, all in
+// one batch. It returns the undo record.
+func DisconnectBlock(s Store) (*BlockUndo, error) {
+	topHeight, _, err := s.FetchHeight()
+	if err != nil {
+		return nil, err
+	}
+	undo, err := FetchUndo(s, topHeight)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(Batch)
+	for _, outPoint := range undo.Created {
+		u, err := s.FetchUTXO(outPoint)
+		if err != nil {
+			return nil, fmt.Errorf("disconnect block %v: %w", undo.Hash, err)
+		}
+		deleteUTXO(batch, outPoint, u)
+	}
+	for i, outPoint := range undo.Spent {
+		putUTXO(batch, outPoint, undo.SpentUTXOs[i], undo.SpentPending[i])
+	}
+	for _, outPoint := range undo.Modified {
+		u, err := s.FetchUTXO(outPoint)
+		if err != nil {
+			return nil, fmt.Errorf("disconnect block %v: %w", undo.Hash, err)
+		}
+		u.StakeModifier = 0
+		putUTXO(batch, outPoint, u, true)
+	}
+	batch.Delete(serializeUndoKey(topHeight))
+	if topHeight == 0 {
+		batch.Delete([]byte{DB_HEIGHT})
+	} else {
+		batch.Put([]byte{DB_HEIGHT}, SerializeHeight(topHeight-1, undo.PrevTime))
+	}
+	if err := s.Write(batch); err != nil {
+		return nil, fmt.Errorf("disconnect block %v: %w", undo.Hash, err)
+	}
+	return undo, nil
+}
+
+// PruneUndo deletes the undo records below height, blocks below it can't be
+// disconnected anymore.
+func PruneUndo(s Store, height uint32) error {
+	batch := new(Batch)
+	limit := serializeUndoKey(height)
+	err := s.Seek([]byte{DB_UNDO}, func(key, value []byte) bool {
+		if bytes.Compare(key, limit) >= 0 {
+			return false
+		}
+		batch.Delete(key)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("iterating over undo records: %v", err)
+	}
+	return s.Write(batch)
+}
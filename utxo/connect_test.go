@@ -0,0 +1,231 @@
+package utxo_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func payToPubKeyHash(hash []byte) []byte {
+	return append(append([]byte{0x76, 0xa9, 20}, hash...), 0x88, 0xac)
+}
+
+func newBlock(prev *btcwire.MsgBlock, blockTime int64, txs ...*btcwire.MsgTx) *btcwire.MsgBlock {
+	var prevHash btcwire.ShaHash
+	if prev != nil {
+		prevHash, _ = prev.BlockSha()
+	}
+	block := btcwire.NewMsgBlock(btcwire.NewBlockHeader(&prevHash, &btcwire.ShaHash{}, 0x1d00ffff, 0))
+	block.Header.Timestamp = time.Unix(blockTime, 0)
+	coinbase := btcwire.NewMsgTx()
+	coinbase.Time = block.Header.Timestamp
+	coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&btcwire.ShaHash{}, 0xffffffff),
+		[]byte{byte(blockTime)}))
+	coinbase.AddTxOut(btcwire.NewTxOut(50e6, payToPubKeyHash(bytes.Repeat([]byte{0xa}, 20))))
+	block.AddTransaction(coinbase)
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	return block
+}
+
+func spend(prev *btcwire.MsgTx, index uint32, value int64, hash byte) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx()
+	tx.Time = prev.Time.Add(time.Minute)
+	sha, _ := prev.TxSha()
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&sha, index), nil))
+	tx.AddTxOut(btcwire.NewTxOut(value, payToPubKeyHash(bytes.Repeat([]byte{hash}, 20))))
+	return tx
+}
+
+// resolve returns the update setting the stake modifier of block's outputs.
+func resolve(block *btcwire.MsgBlock, modifier uint64) utxo.ModifierUpdate {
+	update := utxo.ModifierUpdate{Modifier: modifier}
+	for _, tx := range block.Transactions {
+		sha, _ := tx.TxSha()
+		for i := range tx.TxOut {
+			update.OutPoints = append(update.OutPoints, btcwire.NewOutPoint(&sha, uint32(i)))
+		}
+	}
+	return update
+}
+
+// snapshot returns all records of db.
+func snapshot(t *testing.T, db utxo.Store) map[string]string {
+	records := make(map[string]string)
+	err := db.Seek(nil, func(key, value []byte) bool {
+		records[string(key)] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	return records
+}
+
+func TestConnectDisconnect(t *testing.T) {
+	t.Run("leveldb", func(t *testing.T) {
+		db, err := utxo.OpenLevelDB(filepath.Join(t.TempDir(), "db"))
+		if err != nil {
+			t.Fatalf("open db: %v", err)
+		}
+		defer db.Close()
+		testConnectDisconnect(t, db)
+	})
+	t.Run("memory", func(t *testing.T) {
+		testConnectDisconnect(t, utxo.NewMemStore())
+	})
+}
+
+func testConnectDisconnect(t *testing.T, db utxo.Store) {
+
+	genesis := newBlock(nil, 1400000000)
+	b1 := newBlock(genesis, 1400000600, spend(genesis.Transactions[0], 0, 50e6, 0xb))
+	b2 := newBlock(b1, 1400001200, spend(b1.Transactions[1], 0, 50e6, 0xc))
+	fork := newBlock(b1, 1400001201)
+
+	if err := utxo.ConnectBlock(db, b1, 1); err == nil {
+		t.Errorf("connected block 1 to an empty db")
+	}
+	// every block sets the stake modifier of its parent's outputs
+	snapshots := []map[string]string{snapshot(t, db)}
+	for height, block := range []*btcwire.MsgBlock{genesis, b1, b2} {
+		var updates []utxo.ModifierUpdate
+		if height > 0 {
+			updates = append(updates, resolve([]*btcwire.MsgBlock{genesis, b1}[height-1], uint64(height)))
+		}
+		if err := utxo.ConnectBlock(db, block, uint32(height), updates...); err != nil {
+			t.Fatalf("connect %d: %v", height, err)
+		}
+		snapshots = append(snapshots, snapshot(t, db))
+	}
+	if err := utxo.ConnectBlock(db, fork, 3); err == nil {
+		t.Errorf("connected a block not following the top")
+	}
+
+	coins := func(hash byte) []*btcwire.OutPoint {
+		addr, _ := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{hash}, 20), &btcnet.MainNetParams)
+		outPoints, _, err := db.FetchCoins(addr)
+		if err != nil {
+			t.Fatalf("fetch coins: %v", err)
+		}
+		return outPoints
+	}
+	// b2's outputs wait for their modifier
+	if len(coins(0xa)) != 1 || len(coins(0xb)) != 0 || len(coins(0xc)) != 0 {
+		t.Errorf("wrong coins %v %v %v", coins(0xa), coins(0xb), coins(0xc))
+	}
+	b1Sha, _ := b1.Transactions[0].TxSha()
+	if u, err := db.FetchUTXO(btcwire.NewOutPoint(&b1Sha, 0)); err != nil || u.StakeModifier != 2 {
+		t.Errorf("wrong stake modifier of b1's coinbase %+v: %v", u, err)
+	}
+	if height, topTime, err := db.FetchHeight(); err != nil || height != 2 || topTime.Unix() != 1400001200 {
+		t.Errorf("wrong height %v %v: %v", height, topTime, err)
+	}
+
+	// roll back to genesis, then reorganize to the fork
+	for height := 2; height > 0; height-- {
+		undo, err := utxo.DisconnectBlock(db)
+		if err != nil {
+			t.Fatalf("disconnect %d: %v", height, err)
+		}
+		if want, _ := []*btcwire.MsgBlock{genesis, b1, b2}[height].BlockSha(); undo.Hash != want {
+			t.Errorf("disconnected %v, want %v", undo.Hash, want)
+		}
+		if !reflect.DeepEqual(snapshot(t, db), snapshots[height]) {
+			t.Fatalf("db after disconnecting %d differs from before connecting it", height)
+		}
+	}
+	if len(coins(0xb)) != 0 || len(coins(0xa)) != 0 {
+		t.Errorf("wrong coins after rollback %v %v", coins(0xa), coins(0xb))
+	}
+	for height, block := range []*btcwire.MsgBlock{b1, fork} {
+		update := resolve([]*btcwire.MsgBlock{genesis, b1}[height], uint64(height+1))
+		if err := utxo.ConnectBlock(db, block, uint32(height+1), update); err != nil {
+			t.Fatalf("connect fork %d: %v", height+1, err)
+		}
+	}
+	if len(coins(0xb)) != 1 || len(coins(0xc)) != 0 {
+		t.Errorf("wrong coins after reorganization %v %v", coins(0xb), coins(0xc))
+	}
+
+	if err := utxo.PruneUndo(db, 2); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if _, err := utxo.FetchUndo(db, 1); !errors.Is(err, utxo.ErrNoUndo) {
+		t.Errorf("undo record not pruned: %v", err)
+	}
+	if _, err := utxo.DisconnectBlock(db); err != nil {
+		t.Fatalf("disconnect fork: %v", err)
+	}
+	if _, err := utxo.DisconnectBlock(db); !errors.Is(err, utxo.ErrNoUndo) {
+		t.Errorf("disconnected a pruned block: %v", err)
+	}
+}
+
+func TestMemStoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unspent.db")
+	s, err := utxo.OpenStore(path, utxo.BackendFile)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db := s.(*utxo.MemStore)
+	genesis := newBlock(nil, 1400000000)
+	b1 := newBlock(genesis, 1400000600, spend(genesis.Transactions[0], 0, 20e6, 0xb))
+	if err := utxo.ConnectBlock(db, genesis, 0); err != nil {
+		t.Fatalf("connect 0: %v", err)
+	}
+	records := snapshot(t, db)
+
+	// every write is logged, a crashed store reopens up to its last one
+	reopen := func(backend string) utxo.Store {
+		s, err := utxo.OpenStore(path, backend)
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		if _, ok := s.(*utxo.MemStore); !ok {
+			t.Fatalf("reopened %T", s)
+		}
+		if !reflect.DeepEqual(snapshot(t, s), records) {
+			t.Errorf("reopened store differs from the written one")
+		}
+		return s
+	}
+	reopen(utxo.BackendFile).Close()
+	if err := utxo.ConnectBlock(db, b1, 1, resolve(genesis, 1)); err != nil {
+		t.Fatalf("connect 1: %v", err)
+	}
+	records = snapshot(t, db)
+	// db crashes, leaving a torn record, which is dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+	s = reopen(utxo.BackendDetect)
+	batch := new(utxo.Batch)
+	batch.Put([]byte{utxo.DB_MAX}, []byte{1})
+	if err := s.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	records = snapshot(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Close compacts the log
+	s = reopen(utxo.BackendDetect)
+	defer s.Close()
+	if height, _, err := s.FetchHeight(); err != nil || height != 1 {
+		t.Errorf("height %d, %v", height, err)
+	}
+}
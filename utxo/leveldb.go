@@ -0,0 +1,78 @@
+package utxo
+
+import (
+	"github.com/btcsuite/goleveldb/leveldb"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"time"
+)
+
+// LevelDB is a Store in a LevelDB database.
+type LevelDB struct {
+	DB *leveldb.DB
+}
+
+// OpenLevelDB opens, or creates, the LevelDB database at path.
+func OpenLevelDB(path string) (*LevelDB, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDB{DB: db}, nil
+}
+
+func (s *LevelDB) FetchUTXO(outPoint *btcwire.OutPoint) (*UTXO, error) {
+	return fetchUTXO(s, outPoint)
+}
+
+func (s *LevelDB) FetchCoins(addr *btcutil.AddressPubKeyHash) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchCoins(s, addr)
+}
+
+func (s *LevelDB) FetchCoinsByTime(addr *btcutil.AddressPubKeyHash, from, to time.Time) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchCoinsByTime(s, addr, unixTime(from.Unix()), unixTime(to.Unix()))
+}
+
+func (s *LevelDB) FetchMatureCoins(addr *btcutil.AddressPubKeyHash, t time.Time, minAge int64) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchMatureCoins(s, addr, t, minAge)
+}
+
+func (s *LevelDB) FetchOutPoints(addr *btcutil.AddressPubKeyHash, count, skip uint) ([]*btcwire.OutPoint, bool, error) {
+	return fetchOutPoints(s, addr, count, skip)
+}
+
+func (s *LevelDB) FetchHeight() (uint32, time.Time, error) {
+	return fetchHeight(s)
+}
+
+func (s *LevelDB) Get(key []byte) ([]byte, error) {
+	value, err := s.DB.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *LevelDB) Seek(start []byte, fn func(key, value []byte) bool) error {
+	iter := s.DB.NewIterator(nil, nil)
+	defer iter.Release()
+	for ok := iter.Seek(start); ok && fn(iter.Key(), iter.Value()); ok = iter.Next() {
+	}
+	return iter.Error()
+}
+
+func (s *LevelDB) Write(batch *Batch) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return s.DB.Write(b, nil)
+}
+
+func (s *LevelDB) Close() error {
+	return s.DB.Close()
+}
@@ -0,0 +1,304 @@
+package utxo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+	"github.com/btcsuite/goleveldb/leveldb/memdb"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opPut byte = iota
+	opDelete
+)
+
+// maxCompactRecord is the payload size after which a compacted log starts a
+// new record.
+const maxCompactRecord = 1 << 20
+
+// MemStore is a Store in memory, for tests and small wallets. A MemStore
+// opened from a file appends every Write to it, as a checksummed record, before
+// applying it: reopening the file replays the complete records, a record
+// torn by a crash is dropped. The log is compacted on Close. Writes aren't
+// synced to disk, a crash may lose the last ones, but not a part of one.
+type MemStore struct {
+	db *memdb.DB
+
+	// mu serializes writes, keeping the log in their order
+	mu   sync.Mutex
+	path string
+	log  *os.File
+	// logged is the number of records appended since the log was compacted
+	logged int
+	// failed is set when a failed write couldn't be cut from the log,
+	// failing the following writes
+	failed error
+}
+
+// NewMemStore returns an empty store.
+func NewMemStore() *MemStore {
+	return &MemStore{db: memdb.New(comparer.DefaultComparer, 0)}
+}
+
+// OpenMemStore opens, or creates, the store logged to the file at path.
+func OpenMemStore(path string) (*MemStore, error) {
+	s := NewMemStore()
+	s.path = path
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read store(%v): %v", path, err)
+	}
+	// drop a torn record and append after the complete ones
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.log = f
+	return s, nil
+}
+
+// replay applies the complete records of the log r and returns their size.
+func (s *MemStore) replay(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var valid int64
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:]))
+		if _, err := io.ReadFull(br, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return valid, nil
+		}
+		if err := s.apply(payload); err != nil {
+			return 0, fmt.Errorf("record at %d: %v", valid, err)
+		}
+		valid += int64(len(header) + len(payload))
+	}
+}
+
+// encodeOps appends batch's operations to buf.
+func encodeOps(buf []byte, batch *Batch) []byte {
+	var l [binary.MaxVarintLen64]byte
+	for _, op := range batch.ops {
+		if op.delete {
+			buf = append(buf, opDelete)
+		} else {
+			buf = append(buf, opPut)
+		}
+		buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(op.key)))]...)
+		buf = append(buf, op.key...)
+		if !op.delete {
+			buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(op.value)))]...)
+			buf = append(buf, op.value...)
+		}
+	}
+	return buf
+}
+
+// apply applies the operations of a record's payload.
+func (s *MemStore) apply(payload []byte) error {
+	r := bytes.NewReader(payload)
+	field := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf := make([]byte, l)
+		r.Read(buf)
+		return buf, nil
+	}
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		key, err := field()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opPut:
+			value, err := field()
+			if err != nil {
+				return err
+			}
+			s.db.Put(key, value)
+		case opDelete:
+			s.db.Delete(key)
+		default:
+			return fmt.Errorf("unknown operation %d", op)
+		}
+	}
+	return nil
+}
+
+// writeRecord writes payload as a log record to w.
+func writeRecord(w io.Writer, payload []byte) error {
+	record := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[8:], payload)
+	_, err := w.Write(record)
+	return err
+}
+
+func (s *MemStore) FetchUTXO(outPoint *btcwire.OutPoint) (*UTXO, error) {
+	return fetchUTXO(s, outPoint)
+}
+
+func (s *MemStore) FetchCoins(addr *btcutil.AddressPubKeyHash) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchCoins(s, addr)
+}
+
+func (s *MemStore) FetchCoinsByTime(addr *btcutil.AddressPubKeyHash, from, to time.Time) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchCoinsByTime(s, addr, unixTime(from.Unix()), unixTime(to.Unix()))
+}
+
+func (s *MemStore) FetchMatureCoins(addr *btcutil.AddressPubKeyHash, t time.Time, minAge int64) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchMatureCoins(s, addr, t, minAge)
+}
+
+func (s *MemStore) FetchOutPoints(addr *btcutil.AddressPubKeyHash, count, skip uint) ([]*btcwire.OutPoint, bool, error) {
+	return fetchOutPoints(s, addr, count, skip)
+}
+
+func (s *MemStore) FetchHeight() (uint32, time.Time, error) {
+	return fetchHeight(s)
+}
+
+func (s *MemStore) Get(key []byte) ([]byte, error) {
+	value, err := s.db.Get(key)
+	if err == memdb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemStore) Seek(start []byte, fn func(key, value []byte) bool) error {
+	iter := s.db.NewIterator(nil)
+	defer iter.Release()
+	for ok := iter.Seek(start); ok && fn(iter.Key(), iter.Value()); ok = iter.Next() {
+	}
+	return iter.Error()
+}
+
+// Write logs batch, if the store has a file, then applies it.
+func (s *MemStore) Write(batch *Batch) error {
+	if len(batch.ops) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed != nil {
+		return s.failed
+	}
+	payload := encodeOps(nil, batch)
+	if s.log != nil {
+		offset, err := s.log.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("log write: %w", err)
+		}
+		if err := writeRecord(s.log, payload); err != nil {
+			// cut the partial record, the next ones would be appended after
+			// it and dropped with it on replay
+			if terr := s.log.Truncate(offset); terr != nil {
+				s.failed = fmt.Errorf("log write: %v, truncate: %w", err, terr)
+			} else if _, serr := s.log.Seek(offset, io.SeekStart); serr != nil {
+				s.failed = fmt.Errorf("log write: %v, seek: %w", err, serr)
+			}
+			return fmt.Errorf("log write: %w", err)
+		}
+		s.logged++
+	}
+	return s.apply(payload)
+}
+
+// Close compacts and closes the log of a store opened from a file.
+func (s *MemStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	var err error
+	if s.logged > 0 {
+		err = s.compact()
+	}
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	s.log = nil
+	return err
+}
+
+// compact writes the store's records next to its path and renames the file
+// into place of the log.
+func (s *MemStore) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("compact store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	batch := new(Batch)
+	var payload []byte
+	iter := s.db.NewIterator(nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		batch.ops = append(batch.ops[:0], batchOp{key: iter.Key(), value: iter.Value()})
+		if payload = encodeOps(payload, batch); len(payload) >= maxCompactRecord {
+			if err = writeRecord(w, payload); err != nil {
+				break
+			}
+			payload = payload[:0]
+		}
+	}
+	iter.Release()
+	if err == nil && len(payload) > 0 {
+		err = writeRecord(w, payload)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("compact store: %w", err)
+	}
+	s.logged = 0
+	return nil
+}
@@ -0,0 +1,183 @@
+package utxo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcwire"
+)
+
+// SchemaVersion is the version of the records layout written by this
+// package.
+//
+//	1: DB_ADDR keys with little endian block times
+//	2: DB_ADDR keys with big endian block times
+const SchemaVersion = 2
+
+var (
+	// ErrNoMeta is returned for a store without a DB_META record, one built
+	// before they were written or not an unspent outputs store at all.
+	ErrNoMeta = errors.New("unspent db has no metadata")
+	// ErrWrongNetwork is returned opening a store built for another network.
+	ErrWrongNetwork = errors.New("unspent db built for another network")
+)
+
+// Meta is the DB_META record, describing what a store holds.
+type Meta struct {
+	// Version is the schema version of the records.
+	Version uint32
+	// Net is the magic of the network the store was built for, Genesis its
+	// genesis block.
+	Net     btcwire.BitcoinNet
+	Genesis btcwire.ShaHash
+	// Builder identifies the code which computed the stake modifiers.
+	Builder string
+}
+
+// NewMeta returns the metadata of a store of the current schema version
+// built for params by builder.
+func NewMeta(params *btcnet.Params, builder string) *Meta {
+	return &Meta{
+		Version: SchemaVersion,
+		Net:     params.Net,
+		Genesis: *params.GenesisHash,
+		Builder: builder,
+	}
+}
+
+func serializeMeta(meta *Meta) []byte {
+	buf := make([]byte, 4+4+32+len(meta.Builder))
+	binary.LittleEndian.PutUint32(buf[0:], meta.Version)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(meta.Net))
+	copy(buf[8:], meta.Genesis[:])
+	copy(buf[8+32:], meta.Builder)
+	return buf
+}
+
+func deserializeMeta(buf []byte) (*Meta, error) {
+	if len(buf) < 4+4+32 {
+		return nil, fmt.Errorf("invalid 'meta' record length: %v", len(buf))
+	}
+	meta := &Meta{
+		Version: binary.LittleEndian.Uint32(buf[0:]),
+		Net:     btcwire.BitcoinNet(binary.LittleEndian.Uint32(buf[4:])),
+		Builder: string(buf[8+32:]),
+	}
+	copy(meta.Genesis[:], buf[8:8+32])
+	return meta, nil
+}
+
+// FetchMeta returns the store's metadata, ErrNoMeta if it has none.
+func FetchMeta(s Store) (*Meta, error) {
+	value, err := s.Get([]byte{DB_META})
+	if err == ErrNotFound {
+		return nil, ErrNoMeta
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching meta: %w", err)
+	}
+	return deserializeMeta(value)
+}
+
+// PutMeta writes the store's metadata.
+func PutMeta(s Store, meta *Meta) error {
+	batch := new(Batch)
+	batch.Put([]byte{DB_META}, serializeMeta(meta))
+	return s.Write(batch)
+}
+
+// CheckMeta returns the store's metadata, or an error wrapping
+// ErrWrongNetwork if it wasn't built for params.
+func CheckMeta(s Store, params *btcnet.Params) (*Meta, error) {
+	meta, err := FetchMeta(s)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Net != params.Net || meta.Genesis != *params.GenesisHash {
+		return nil, fmt.Errorf("%w: magic %08x genesis %v, %v has magic %08x genesis %v", ErrWrongNetwork,
+			uint32(meta.Net), &meta.Genesis, params.Name, uint32(params.Net), params.GenesisHash)
+	}
+	return meta, nil
+}
+
+// Migration upgrades the records of a store from schema version Version-1
+// to Version.
+type Migration struct {
+	Version     uint32
+	Description string
+	// Migrate adds the writes upgrading s to batch, they're written
+	// atomically with the new version.
+	Migrate func(s Store, batch *Batch) error
+}
+
+// Migrations are the migrations up to SchemaVersion.
+var Migrations = []Migration{
+	{Version: 2, Description: "big endian DB_ADDR times", Migrate: migrateAddrTimes},
+}
+
+// migrateAddrTimes rewrites the DB_ADDR keys with big endian block times.
+func migrateAddrTimes(s Store, batch *Batch) error {
+	return s.Seek([]byte{DB_ADDR}, func(key, value []byte) bool {
+		if key[0] != DB_ADDR {
+			return false
+		}
+		batch.Delete(key)
+		key = append([]byte(nil), key...)
+		blockTime := binary.LittleEndian.Uint32(key[1+20:])
+		binary.BigEndian.PutUint32(key[1+20:], blockTime)
+		batch.Put(key, value)
+		return true
+	})
+}
+
+// Migrate upgrades the store to schema version to, applying migrations one
+// version at a time.
+func Migrate(s Store, to uint32, migrations []Migration) error {
+	meta, err := FetchMeta(s)
+	if err != nil {
+		return err
+	}
+	if meta.Version > to {
+		return fmt.Errorf("unspent db schema version %d is newer than %d", meta.Version, to)
+	}
+	for meta.Version < to {
+		var m *Migration
+		for i := range migrations {
+			if migrations[i].Version == meta.Version+1 {
+				m = &migrations[i]
+			}
+		}
+		if m == nil {
+			return fmt.Errorf("no migration of unspent db schema version %d", meta.Version)
+		}
+		batch := new(Batch)
+		if err := m.Migrate(s, batch); err != nil {
+			return fmt.Errorf("migrate to version %d (%v): %w", m.Version, m.Description, err)
+		}
+		meta.Version = m.Version
+		batch.Put([]byte{DB_META}, serializeMeta(meta))
+		if err := s.Write(batch); err != nil {
+			return fmt.Errorf("migrate to version %d (%v): %w", m.Version, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// Open opens the store at path with backend, see OpenStore, refusing a store
+// built for another network than params, and migrates it to SchemaVersion.
+func Open(path, backend string, params *btcnet.Params) (Store, error) {
+	s, err := OpenStore(path, backend)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := CheckMeta(s, params); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := Migrate(s, SchemaVersion, Migrations); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,123 @@
+package utxo_test
+
+import (
+	"errors"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcwire"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpenChecksNetwork(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := utxo.OpenLevelDB(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	genesis := newBlock(nil, 1400000000)
+	if err := utxo.ConnectBlock(db, genesis, 0); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if _, err := utxo.CheckMeta(db, &btcnet.TestNet3Params); !errors.Is(err, utxo.ErrNoMeta) {
+		t.Errorf("checked a db without metadata: %v", err)
+	}
+	meta := utxo.NewMeta(&btcnet.TestNet3Params, "test")
+	if err := utxo.PutMeta(db, meta); err != nil {
+		t.Fatalf("put meta: %v", err)
+	}
+	if got, err := utxo.FetchMeta(db); err != nil || !reflect.DeepEqual(got, meta) {
+		t.Errorf("meta %+v, want %+v: %v", got, meta, err)
+	}
+	db.Close()
+
+	if _, err := utxo.Open(path, utxo.BackendDetect, &btcnet.MainNetParams); !errors.Is(err, utxo.ErrWrongNetwork) {
+		t.Errorf("opened a testnet db for mainnet: %v", err)
+	}
+	s, err := utxo.Open(path, utxo.BackendDetect, &btcnet.TestNet3Params)
+	if err != nil {
+		t.Fatalf("open testnet db: %v", err)
+	}
+	defer s.Close()
+	if height, _, err := s.FetchHeight(); err != nil || height != 0 {
+		t.Errorf("height %d: %v", height, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := utxo.NewMemStore()
+	meta := utxo.NewMeta(&btcnet.MainNetParams, "test")
+	meta.Version = 1
+	if err := utxo.PutMeta(db, meta); err != nil {
+		t.Fatalf("put meta: %v", err)
+	}
+	var applied []uint32
+	migration := func(version uint32) utxo.Migration {
+		return utxo.Migration{Version: version, Migrate: func(s utxo.Store, batch *utxo.Batch) error {
+			applied = append(applied, version)
+			batch.Put([]byte{utxo.DB_MAX, byte(version)}, nil)
+			return nil
+		}}
+	}
+	migrations := []utxo.Migration{migration(3), migration(2)}
+	if err := utxo.Migrate(db, 4, migrations); err == nil {
+		t.Errorf("migrated without a migration to version 4")
+	}
+	if !reflect.DeepEqual(applied, []uint32{2, 3}) {
+		t.Errorf("applied %v", applied)
+	}
+	if got, _ := utxo.FetchMeta(db); got.Version != 3 || got.Net != btcwire.MainNet {
+		t.Errorf("meta after migrating %+v", got)
+	}
+	if _, err := db.Get([]byte{utxo.DB_MAX, 3}); err != nil {
+		t.Errorf("migration's write missing: %v", err)
+	}
+	if err := utxo.Migrate(db, 2, migrations); err == nil {
+		t.Errorf("downgraded a db")
+	}
+}
+
+func TestMigrateAddrTimes(t *testing.T) {
+	db := utxo.NewMemStore()
+	genesis := newBlock(nil, 1400000000)
+	b1 := newBlock(genesis, 1400000600, spend(genesis.Transactions[0], 0, 20e6, 0xb))
+	for height, block := range []*btcwire.MsgBlock{genesis, b1} {
+		if err := utxo.ConnectBlock(db, block, uint32(height)); err != nil {
+			t.Fatalf("connect %d: %v", height, err)
+		}
+	}
+	if err := utxo.PutMeta(db, utxo.NewMeta(&btcnet.MainNetParams, "test")); err != nil {
+		t.Fatalf("put meta: %v", err)
+	}
+	want := snapshot(t, db)
+
+	// rewrite the store as version 1 wrote it
+	batch := new(utxo.Batch)
+	for key, value := range want {
+		if key[0] == utxo.DB_ADDR {
+			old := []byte(key)
+			old[1+20], old[1+20+1], old[1+20+2], old[1+20+3] = old[1+20+3], old[1+20+2], old[1+20+1], old[1+20]
+			batch.Delete([]byte(key))
+			batch.Put(old, []byte(value))
+		}
+	}
+	meta := utxo.NewMeta(&btcnet.MainNetParams, "test")
+	meta.Version = 1
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := utxo.PutMeta(db, meta); err != nil {
+		t.Fatalf("put meta: %v", err)
+	}
+	if reflect.DeepEqual(snapshot(t, db), want) {
+		t.Fatalf("version 1 store equals version 2")
+	}
+
+	if err := utxo.Migrate(db, utxo.SchemaVersion, utxo.Migrations); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if !reflect.DeepEqual(snapshot(t, db), want) {
+		t.Errorf("migrated store differs from a version %d one", utxo.SchemaVersion)
+	}
+}
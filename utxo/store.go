@@ -0,0 +1,111 @@
+package utxo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"os"
+	"time"
+)
+
+// ErrNotFound is returned for missing records.
+var ErrNotFound = errors.New("not found")
+
+// Store is an unspent outputs database: records keyed by the DB_* prefixes.
+type Store interface {
+	FetchUTXO(outPoint *btcwire.OutPoint) (*UTXO, error)
+	// FetchCoins returns the outputs paying to addr and their UTXOs. The
+	// coin queries skip outputs waiting for their stake modifier.
+	FetchCoins(addr *btcutil.AddressPubKeyHash) ([]*btcwire.OutPoint, []*UTXO, error)
+	// FetchCoinsByTime returns the outputs paying to addr of blocks with
+	// times from from to to, inclusive.
+	FetchCoinsByTime(addr *btcutil.AddressPubKeyHash, from, to time.Time) ([]*btcwire.OutPoint, []*UTXO, error)
+	// FetchMatureCoins returns the outputs paying to addr old enough to stake
+	// at t, those of blocks at least minAge seconds before t.
+	FetchMatureCoins(addr *btcutil.AddressPubKeyHash, t time.Time, minAge int64) ([]*btcwire.OutPoint, []*UTXO, error)
+	// FetchOutPoints returns count (all if 0) outputs paying to addr after
+	// skipping skip of them, complete tells if there are no more.
+	FetchOutPoints(addr *btcutil.AddressPubKeyHash, count, skip uint) (outPoints []*btcwire.OutPoint, complete bool, err error)
+	FetchHeight() (topHeight uint32, topTime time.Time, err error)
+
+	// Get returns the record with key, ErrNotFound if there's none.
+	Get(key []byte) ([]byte, error)
+	// Seek calls fn with the records from the first key at or after start
+	// in key order until fn returns false. key and value are only valid
+	// during the call.
+	Seek(start []byte, fn func(key, value []byte) bool) error
+	// Write applies batch atomically.
+	Write(batch *Batch) error
+	Close() error
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// Batch is a sequence of writes applied atomically by Store.Write.
+type Batch struct {
+	ops []batchOp
+}
+
+// Put adds a write of value at key.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte(nil), key...), value: append([]byte(nil), value...)})
+}
+
+// Delete adds a deletion of key.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte(nil), key...), delete: true})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Store backends of OpenStore.
+const (
+	// BackendDetect opens an existing store as what it is, a new one as
+	// BackendLevelDB.
+	BackendDetect = ""
+	// BackendLevelDB is a LevelDB directory, see OpenLevelDB.
+	BackendLevelDB = "leveldb"
+	// BackendFile is a MemStore logged to a single file, see OpenMemStore.
+	BackendFile = "file"
+)
+
+// OpenStore opens, or creates, the store at path with backend.
+func OpenStore(path, backend string) (Store, error) {
+	if backend == BackendDetect {
+		backend = BackendLevelDB
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			backend = BackendFile
+		}
+	}
+	switch backend {
+	case BackendLevelDB:
+		return OpenLevelDB(path)
+	case BackendFile:
+		return OpenMemStore(path)
+	}
+	return nil, fmt.Errorf("unknown store backend %q", backend)
+}
+
+// FetchHeightFile returns the top height and time of the store at path.
+func FetchHeightFile(dbDir string) (topHeight uint32, topTime time.Time, err error) {
+	var s Store
+	s, err = OpenStore(dbDir, BackendDetect)
+	if err != nil {
+		err = fmt.Errorf("open unspent db(%v): %v", dbDir, err)
+		return
+	}
+	defer s.Close()
+	topHeight, topTime, err = s.FetchHeight()
+	if err != nil {
+		err = fmt.Errorf("fetch height from db(%v): %v", dbDir, err)
+		return
+	}
+	return
+}
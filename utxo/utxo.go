@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/btcsuite/goleveldb/leveldb"
 	"github.com/mably/btcutil"
 	"github.com/mably/btcwire"
+	"math"
 	"time"
 )
 
@@ -14,6 +14,9 @@ const (
 	DB_UTXO byte = iota
 	DB_ADDR
 	DB_HEIGHT
+	DB_UNDO
+	DB_META
+	DB_PENDING
 	DB_MAX
 )
 
@@ -71,80 +74,145 @@ func SerializeUTXO(utxo *UTXO) []byte {
 	return buf
 }
 
-func FetchOutPoints(db *leveldb.DB, addr *btcutil.AddressPubKeyHash, count, skip uint) (outPoints []*btcwire.OutPoint, complete bool, err error) {
+// ScriptHash returns the hash160 an output script pays to, for pay to pubkey
+// hash and pay to pubkey scripts.
+func ScriptHash(pkScript []byte) ([]byte, bool) {
+	switch l := len(pkScript); {
+	case l == 25 && pkScript[0] == 0x76 && pkScript[1] == 0xa9 && pkScript[2] == 20 &&
+		pkScript[23] == 0x88 && pkScript[24] == 0xac: // DUP HASH160 <hash> EQUALVERIFY CHECKSIG
+		return pkScript[3:23], true
+	case (l == 35 || l == 67) && int(pkScript[0]) == l-2 && pkScript[l-1] == 0xac: // <pubkey> CHECKSIG
+		return btcutil.Hash160(pkScript[1 : l-1]), true
+	}
+	return nil, false
+}
+
+// SerializeAddrKey returns the DB_ADDR key of the output paying to the
+// hash160 hash: the hash, the output's block time, big endian for an
+// address's keys to sort by it, and its outpoint.
+func SerializeAddrKey(hash []byte, outPoint *btcwire.OutPoint, utxo *UTXO) []byte {
+	buf := make([]byte, 1+20+4+32+4)
+	buf[0] = DB_ADDR
+	copy(buf[1:], hash)
+	binary.BigEndian.PutUint32(buf[1+20:], utxo.BlockTime)
+	copy(buf[1+20+4:], outPoint.Hash[:])
+	binary.LittleEndian.PutUint32(buf[1+20+4+32:], outPoint.Index)
+	return buf
+}
+
+// SerializeHeight returns the DB_HEIGHT record of the top block.
+func SerializeHeight(topHeight uint32, topTime uint32) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:], topHeight)
+	binary.LittleEndian.PutUint32(buf[4:], topTime)
+	return buf
+}
+
+// addrPrefix returns the prefix of the DB_ADDR keys of addr.
+func addrPrefix(addr *btcutil.AddressPubKeyHash) []byte {
 	key := make([]byte, 1+20)
 	key[0] = DB_ADDR
 	copy(key[1:], addr.ScriptAddress())
-	iter := db.NewIterator(nil, nil)
+	return key
+}
+
+func fetchOutPoints(s Store, addr *btcutil.AddressPubKeyHash, count, skip uint) (outPoints []*btcwire.OutPoint, complete bool, err error) {
+	key := addrPrefix(addr)
+	complete = true
 	position := uint(0)
-	for ok := iter.Seek(key); ok; ok, position = iter.Next(), position+1 {
-		if !bytes.Equal(iter.Key()[:1+20], key) {
-			complete = true
-			break
+	err = s.Seek(key, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, key) {
+			return false
 		}
 		if position >= skip {
-			outPoints = append(outPoints, DeserializeOutPoint(iter.Value()))
 			if count > 0 && uint(len(outPoints)) == count {
-				break
+				complete = false
+				return false
 			}
+			outPoints = append(outPoints, DeserializeOutPoint(v))
 		}
-	}
-	iter.Release()
-	err = iter.Error()
+		position++
+		return true
+	})
 	if err != nil {
 		err = fmt.Errorf("iterator error: %v", err)
 	}
 	return
 }
 
-func FetchCoins(db *leveldb.DB, addr *btcutil.AddressPubKeyHash) ([]*btcwire.OutPoint, []*UTXO, error) {
-	var err error
-	key := make([]byte, 1+20)
-	key[0] = DB_ADDR
-	copy(key[1:], addr.ScriptAddress())
-	iter := db.NewIterator(nil, nil)
-	var outPoints [][]byte
-	for ok := iter.Seek(key); ok; ok = iter.Next() {
-		if !bytes.Equal(iter.Key()[:1+20], key) {
-			break
-		}
-		val := make([]byte, len(iter.Value()))
-		copy(val, iter.Value())
-		outPoints = append(outPoints, val)
+func fetchCoins(s Store, addr *btcutil.AddressPubKeyHash) ([]*btcwire.OutPoint, []*UTXO, error) {
+	return fetchCoinsByTime(s, addr, 0, math.MaxUint32)
+}
+
+// unixTime returns t's unix time within the range of block times.
+func unixTime(t int64) uint32 {
+	switch {
+	case t < 0:
+		return 0
+	case t > math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(t)
+}
 
-		//fmt.Println(time.Unix(int64(binary.LittleEndian.Uint32(iter.Key()[1+20:1+24])),0))
-		//fmt.Println(iter.Key()[1+20:1+24])
+func fetchMatureCoins(s Store, addr *btcutil.AddressPubKeyHash, t time.Time, minAge int64) ([]*btcwire.OutPoint, []*UTXO, error) {
+	to := t.Unix() - minAge
+	if to < 0 {
+		return nil, nil, nil
 	}
-	iter.Release()
-	err = iter.Error()
+	return fetchCoinsByTime(s, addr, 0, unixTime(to))
+}
+
+// fetchCoinsByTime returns the outputs paying to addr of blocks with times
+// from from to to, seeking to from's DB_ADDR key. Outputs waiting for their
+// stake modifier are skipped.
+func fetchCoinsByTime(s Store, addr *btcutil.AddressPubKeyHash, from, to uint32) ([]*btcwire.OutPoint, []*UTXO, error) {
+	key := addrPrefix(addr)
+	start := make([]byte, 1+20+4)
+	copy(start, key)
+	binary.BigEndian.PutUint32(start[1+20:], from)
+	var outPoints [][]byte
+	err := s.Seek(start, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, key) || binary.BigEndian.Uint32(k[1+20:]) > to {
+			return false
+		}
+		outPoints = append(outPoints, append([]byte(nil), v...))
+		return true
+	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("iterating over address entries: %v", err)
 	}
-	outs := make([]*btcwire.OutPoint, len(outPoints))
-	utxos := make([]*UTXO, len(outPoints))
-	for i, outPoint := range outPoints {
-		value, err := db.Get(outPoint, nil)
+	outs := make([]*btcwire.OutPoint, 0, len(outPoints))
+	utxos := make([]*UTXO, 0, len(outPoints))
+	for _, outPoint := range outPoints {
+		out := DeserializeOutPoint(outPoint)
+		if pending, err := isPending(s, out); err != nil {
+			return nil, nil, err
+		} else if pending {
+			continue // no stake modifier yet
+		}
+		value, err := s.Get(outPoint)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error getting utxo: %v", err)
+			return nil, nil, fmt.Errorf("error getting utxo: %w", err)
 		}
-		outs[i] = DeserializeOutPoint(outPoint)
-		utxos[i] = DeserializeUTXO(value)
+		outs = append(outs, out)
+		utxos = append(utxos, DeserializeUTXO(value))
 	}
 	return outs, utxos, nil
 }
 
-func FetchUTXO(db *leveldb.DB, outPoint *btcwire.OutPoint) (*UTXO, error) {
-	value, err := db.Get(SerializeOutPoint(outPoint), nil)
+func fetchUTXO(s Store, outPoint *btcwire.OutPoint) (*UTXO, error) {
+	value, err := s.Get(SerializeOutPoint(outPoint))
 	if err != nil {
-		return nil, fmt.Errorf("fetching utxo(%v): %v", outPoint, err)
+		return nil, fmt.Errorf("fetching utxo(%v): %w", outPoint, err)
 	}
 	return DeserializeUTXO(value), nil
 }
 
-func FetchHeight(db *leveldb.DB) (topHeight uint32, topTime time.Time, err error) {
-	value, err := db.Get([]byte{DB_HEIGHT}, nil)
+func fetchHeight(s Store) (topHeight uint32, topTime time.Time, err error) {
+	value, err := s.Get([]byte{DB_HEIGHT})
 	if err != nil {
-		return 0, time.Time{}, fmt.Errorf("db error: %v", err)
+		return 0, time.Time{}, fmt.Errorf("db error: %w", err)
 	}
 	if len(value) < 8 {
 		return 0, time.Time{}, fmt.Errorf("invalid 'height' record length: %v", len(value))
@@ -152,19 +220,3 @@ func FetchHeight(db *leveldb.DB) (topHeight uint32, topTime time.Time, err error
 	return binary.LittleEndian.Uint32(value[0:4]),
 		time.Unix(int64(binary.LittleEndian.Uint32(value[4:8])), 0), nil
 }
-
-func FetchHeightFile(dbDir string) (topHeight uint32, topTime time.Time, err error) {
-	var db *leveldb.DB
-	db, err = leveldb.OpenFile(dbDir, nil)
-	if err != nil {
-		err = fmt.Errorf("open unspent db(%v): %v", dbDir, err)
-		return
-	}
-	defer db.Close()
-	topHeight, topTime, err = FetchHeight(db)
-	if err != nil {
-		err = fmt.Errorf("fetch height from db(%v): %v", dbDir, err)
-		return
-	}
-	return
-}
@@ -0,0 +1,88 @@
+package utxo_test
+
+import (
+	"bytes"
+	"github.com/kac-/umint/utxo"
+	"github.com/mably/btcnet"
+	"github.com/mably/btcutil"
+	"github.com/mably/btcwire"
+	"testing"
+	"time"
+)
+
+func TestFetchCoinsByTime(t *testing.T) {
+	db := utxo.NewMemStore()
+	// B is paid an output in each of blocks 1, 2 and 3, ten minutes apart
+	genesis := newBlock(nil, 1400000000)
+	b1 := newBlock(genesis, 1400000600, spend(genesis.Transactions[0], 0, 20e6, 0xb))
+	b2 := newBlock(b1, 1400001200, spend(b1.Transactions[0], 0, 20e6, 0xb))
+	b3 := newBlock(b2, 1400001800, spend(b2.Transactions[0], 0, 20e6, 0xb))
+	b4 := newBlock(b3, 1400002400)
+	blocks := []*btcwire.MsgBlock{genesis, b1, b2, b3, b4}
+	for height, block := range blocks {
+		var updates []utxo.ModifierUpdate
+		if height > 0 {
+			updates = append(updates, resolve(blocks[height-1], 1))
+		}
+		if err := utxo.ConnectBlock(db, block, uint32(height), updates...); err != nil {
+			t.Fatalf("connect %d: %v", height, err)
+		}
+	}
+	addr, _ := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{0xb}, 20), &btcnet.MainNetParams)
+	blockTimes := func(utxos []*utxo.UTXO) []uint32 {
+		times := make([]uint32, len(utxos))
+		for i, u := range utxos {
+			times[i] = u.BlockTime
+		}
+		return times
+	}
+	for _, c := range []struct {
+		from, to int64
+		want     []uint32
+	}{
+		{0, 1 << 40, []uint32{1400000600, 1400001200, 1400001800}},
+		{1400000600, 1400001200, []uint32{1400000600, 1400001200}},
+		{1400000601, 1400001799, []uint32{1400001200}},
+		{1400001801, 1 << 40, []uint32{}},
+		{-1, 1400000599, []uint32{}},
+	} {
+		outPoints, utxos, err := db.FetchCoinsByTime(addr, time.Unix(c.from, 0), time.Unix(c.to, 0))
+		if err != nil {
+			t.Fatalf("fetch %d-%d: %v", c.from, c.to, err)
+		}
+		if got := blockTimes(utxos); len(outPoints) != len(utxos) || !equalTimes(got, c.want) {
+			t.Errorf("coins of blocks %d-%d at %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+
+	const minAge = 1000
+	for _, c := range []struct {
+		t    int64
+		want []uint32
+	}{
+		{1400001599, []uint32{}},
+		{1400001600, []uint32{1400000600}},
+		{1400002800, []uint32{1400000600, 1400001200, 1400001800}},
+		{500, []uint32{}},
+	} {
+		_, utxos, err := db.FetchMatureCoins(addr, time.Unix(c.t, 0), minAge)
+		if err != nil {
+			t.Fatalf("fetch mature at %d: %v", c.t, err)
+		}
+		if got := blockTimes(utxos); !equalTimes(got, c.want) {
+			t.Errorf("coins mature at %d of blocks at %v, want %v", c.t, got, c.want)
+		}
+	}
+}
+
+func equalTimes(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}